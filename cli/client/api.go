@@ -0,0 +1,455 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// the API spoken by client/model/api.js
+
+// wsFrameSize is how much ciphertext goes into one WebSocket message, well
+// below the server's message size limit.
+const wsFrameSize = 16 * eceRecordSize
+
+type uploadInit struct {
+	FileMetadata  string `json:"fileMetadata"`
+	Authorization string `json:"authorization"`
+	HasPassword   bool   `json:"has_password"`
+	TimeLimit     int    `json:"timeLimit"`
+	Down          int    `json:"dlimit"`
+	Size          int64  `json:"size"`
+	Request       string `json:"request,omitempty"`
+	Sealed        string `json:"sealed,omitempty"`
+	Collection    string `json:"collection,omitempty"`
+	OwnerToken    string `json:"owner_token,omitempty"`
+}
+
+type uploadResult struct {
+	ID         string `json:"id"`
+	OwnerToken string `json:"ownerToken"`
+	URL        string `json:"url"`
+}
+
+type metaResponse struct {
+	Metadata string         `json:"metadata"`
+	Final    bool           `json:"finalDownload"`
+	TTL      int64          `json:"ttl"`
+	Items    []itemResponse `json:"items"`
+	Data     []byte         `json:"data"`
+}
+
+type itemResponse struct {
+	ID            string `json:"id"`
+	Size          int64  `json:"size"`
+	DownloadLimit int    `json:"dlimit"`
+	DownloadCount int    `json:"dtotal"`
+}
+
+type snippetInit struct {
+	FileMetadata  string `json:"fileMetadata"`
+	Authorization string `json:"authorization"`
+	HasPassword   bool   `json:"has_password"`
+	TimeLimit     int    `json:"timeLimit"`
+	Down          int    `json:"dlimit"`
+	Data          []byte `json:"data"`
+}
+
+type collectionInit struct {
+	Authorization string `json:"authorization"`
+	HasPassword   bool   `json:"has_password"`
+	TimeLimit     int    `json:"timeLimit"`
+	Down          int    `json:"dlimit"`
+}
+
+type infoResponse struct {
+	DownloadLimit int   `json:"dlimit"`
+	DownloadCount int   `json:"dtotal"`
+	TTL           int64 `json:"ttl"`
+	Exist         bool  `json:"exist"`
+}
+
+type requestInit struct {
+	MaxFiles  int   `json:"maxFiles"`
+	MaxBytes  int64 `json:"maxBytes"`
+	TimeLimit int   `json:"timeLimit"`
+	Down      int   `json:"dlimit"`
+}
+
+type requestResult struct {
+	ID         string `json:"id"`
+	OwnerToken string `json:"ownerToken"`
+	URL        string `json:"url"`
+}
+
+type requestInfo struct {
+	List []struct {
+		ID            string `json:"id"`
+		Complete      bool   `json:"complete"`
+		Sealed        string `json:"sealed"`
+		Metadata      string `json:"metadata"`
+		DownloadLimit int    `json:"dlimit"`
+		DownloadCount int    `json:"dtotal"`
+	} `json:"list"`
+}
+
+type ownerEvent struct {
+	DownloadLimit int    `json:"dlimit"`
+	DownloadCount int    `json:"dtotal"`
+	TTL           int64  `json:"ttl"`
+	Bytes         int64  `json:"bytes"`
+	Reason        string `json:"reason"`
+}
+
+// StatusError is returned when the server answers with an unexpected status.
+type StatusError int
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("server responded %d %s", int(e), http.StatusText(int(e)))
+}
+
+// uploadWs sends the ciphertext read from r over /api/ws and reports the
+// number of bytes sent to progress.
+func (c *Client) uploadWs(ctx context.Context, server string, init uploadInit, r io.Reader, progress func(int64)) (uploadResult, error) {
+	var res uploadResult
+	endpoint, err := url.Parse(server + "/api/ws")
+	if err != nil {
+		return res, err
+	}
+	switch endpoint.Scheme {
+	case "https":
+		endpoint.Scheme = "wss"
+	case "http":
+		endpoint.Scheme = "ws"
+	}
+	conn, _, err := c.dialer().DialContext(ctx, endpoint.String(), nil)
+	if err != nil {
+		return res, err
+	}
+	stop := make(chan struct{})
+	defer func() {
+		close(stop)
+		_ = conn.Close()
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-stop:
+		}
+	}()
+	res, err = sendUpload(conn, init, r, progress)
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return res, err
+}
+
+func sendUpload(conn *websocket.Conn, init uploadInit, r io.Reader, progress func(int64)) (uploadResult, error) {
+	var res uploadResult
+	if err := conn.WriteJSON(init); err != nil {
+		return res, err
+	}
+	if err := readResponse(conn, &res); err != nil {
+		return res, err
+	}
+
+	// a message holding the single byte 0 marks the end of the upload, so a
+	// trailing piece of ciphertext that short is appended to the frame before
+	var sent int64
+	send := func(p []byte) error {
+		if err := conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+			return err
+		}
+		sent += int64(len(p))
+		progress(sent)
+		return nil
+	}
+	var prev []byte
+	for {
+		buf := make([]byte, wsFrameSize, wsFrameSize+1)
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return res, err
+		}
+		buf = buf[:n]
+		if prev != nil {
+			if n == 1 {
+				prev, buf = append(prev, buf...), nil
+			}
+			if err := send(prev); err != nil {
+				return res, err
+			}
+		}
+		if err != nil {
+			if len(buf) > 0 {
+				if err := send(buf); err != nil {
+					return res, err
+				}
+			}
+			break
+		}
+		prev = buf
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte{0}); err != nil {
+		return res, err
+	}
+	var done struct {
+		OK bool `json:"ok"`
+	}
+	if err := readResponse(conn, &done); err != nil || !done.OK {
+		return res, errors.New("upload was not confirmed by the server")
+	}
+	return res, nil
+}
+
+func readResponse(conn *websocket.Conn, v interface{}) error {
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(msg, v); err != nil {
+		return err
+	}
+	var e struct {
+		Error string `json:"error"`
+	}
+	_ = json.Unmarshal(msg, &e)
+	if e.Error != "" {
+		return errors.New(e.Error)
+	}
+	return nil
+}
+
+// fetchWithAuth signs a request with the current nonce and stores the one
+// the server hands out for the next request. A 401 carrying a new nonce is
+// retried once, like fetchWithAuthAndRetry. owner is sent as the owner
+// token of a request if set.
+func (c *Client) fetchWithAuth(ctx context.Context, k *keychain, target, owner string) (*http.Response, error) {
+	for tries := 2; ; tries-- {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", k.authHeader())
+		if owner != "" {
+			req.Header.Set("X-Owner-Token", owner)
+		}
+		resp, err := c.httpClient().Do(req)
+		if err != nil {
+			return nil, err
+		}
+		old := k.nonce
+		if nonce := parseNonce(resp.Header.Get("WWW-Authenticate")); nonce != "" {
+			k.nonce = nonce
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized || k.nonce == old || tries == 1 {
+			return nil, StatusError(resp.StatusCode)
+		}
+	}
+}
+
+func parseNonce(header string) string {
+	if parts := strings.SplitN(header, " ", 2); len(parts) == 2 {
+		return parts[1]
+	}
+	return ""
+}
+
+func (c *Client) fetchMetadata(ctx context.Context, server, id string, k *keychain, owner string) (metaResponse, Metadata, error) {
+	var res metaResponse
+	resp, err := c.fetchWithAuth(ctx, k, server+"/api/metadata/"+id, owner)
+	if err != nil {
+		return res, Metadata{}, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return res, Metadata{}, err
+	}
+	meta, err := k.decryptMetadata(b58decode(res.Metadata))
+	if err != nil {
+		return res, meta, ErrWrongKey
+	}
+	return res, meta, nil
+}
+
+// download returns the ciphertext of id, or of an item given as
+// <collection>/<item>. The nonce is expected to be fresh from a metadata
+// request.
+func (c *Client) download(ctx context.Context, server, id string, k *keychain, owner string) (io.ReadCloser, error) {
+	resp, err := c.fetchWithAuth(ctx, k, server+"/api/download/"+id, owner)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// post sends body as JSON and fails unless the status is one of ok.
+func (c *Client) post(ctx context.Context, target string, body, v interface{}, ok ...int) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			if v == nil {
+				return nil
+			}
+			return json.NewDecoder(resp.Body).Decode(v)
+		}
+	}
+	return StatusError(resp.StatusCode)
+}
+
+func (c *Client) fileInfo(ctx context.Context, server, id, token string) (infoResponse, error) {
+	var res []infoResponse
+	err := c.post(ctx, server+"/api/info", map[string][]string{
+		"id":          {id},
+		"owner_token": {token},
+	}, &res, http.StatusOK)
+	if err != nil {
+		return infoResponse{}, err
+	}
+	if len(res) != 1 {
+		return infoResponse{}, errors.New("unexpected info response")
+	}
+	return res[0], nil
+}
+
+// events reads the owner event stream of id and passes every event to fn,
+// until the server ends the stream.
+func (c *Client) events(ctx context.Context, server, id, token string, fn func(string, ownerEvent)) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server+"/api/events/"+id, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return StatusError(resp.StatusCode)
+	}
+	var typ, data string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if typ != "" && data != "" {
+				var ev ownerEvent
+				if err := json.Unmarshal([]byte(data), &ev); err != nil {
+					return err
+				}
+				fn(typ, ev)
+			}
+			typ, data = "", ""
+		case strings.HasPrefix(line, "event: "):
+			typ = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	return scanner.Err()
+}
+
+// ownerRequest sends a request authenticated with an owner token, with body
+// as JSON unless it is nil, and fails unless the status is ok.
+func (c *Client) ownerRequest(ctx context.Context, method, target, token string, body, v interface{}, ok int) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != ok {
+		return StatusError(resp.StatusCode)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *Client) requestFiles(ctx context.Context, server, id, token string) (requestInfo, error) {
+	var info requestInfo
+	err := c.ownerRequest(ctx, http.MethodGet, server+"/api/request/"+id+"/files", token, nil, &info, http.StatusOK)
+	return info, err
+}
+
+func (c *Client) deleteRequest(ctx context.Context, server, id, token string) error {
+	return c.ownerRequest(ctx, http.MethodDelete, server+"/api/request/"+id, token, nil, nil, http.StatusNoContent)
+}
+
+// setManifest shares the collection id with the encrypted manifest of its
+// items.
+func (c *Client) setManifest(ctx context.Context, server, id, token string, manifest []byte) error {
+	body := map[string]string{"metadata": b58encode(manifest)}
+	return c.ownerRequest(ctx, http.MethodPost, server+"/api/collection/"+id+"/manifest", token, body, nil, http.StatusNoContent)
+}
+
+func (c *Client) deleteFile(ctx context.Context, server, id, token string) error {
+	return c.post(ctx, server+"/api/delete", map[string][]string{
+		"id":          {id},
+		"owner_token": {token},
+	}, nil, http.StatusOK, http.StatusNoContent)
+}
+
+func (c *Client) setPassword(ctx context.Context, server, id, token string, k *keychain) error {
+	return c.post(ctx, server+"/api/password/"+id, map[string]string{
+		"owner_token": token,
+		"auth":        k.authKeyB58(),
+	}, nil, http.StatusOK)
+}
@@ -0,0 +1,418 @@
+// Package client talks to a Send server the way its web client does. Files
+// are encrypted before they leave the process and links work in both
+// directions between this package and the browser.
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ArchiveType is the type of an upload made of several files, the browser
+// offers it as a zip.
+const ArchiveType = "send-archive"
+
+var (
+	ErrNotFound     = errors.New("file does not exist")
+	ErrUnauthorized = errors.New("wrong key or password")
+	ErrWrongKey     = errors.New("cannot decrypt metadata, wrong key")
+)
+
+// Client uploads to Server and downloads from whatever server a link names.
+// The zero value of HTTPClient and Dialer uses the package defaults.
+type Client struct {
+	Server     string
+	HTTPClient *http.Client
+	Dialer     *websocket.Dialer
+}
+
+// Options describe an upload.
+type Options struct {
+	// Name, Type and Size describe the content, Size must be the exact
+	// length of the reader. Type defaults to application/octet-stream.
+	Name string
+	Type string
+	Size int64
+	// Files makes the upload an archive of these files, concatenated in
+	// the reader. Name, Type and Size are then derived from them.
+	Files []File
+	// Expire defaults to one day and Downloads to one, like the web UI.
+	Expire    time.Duration
+	Downloads int
+	// Password is required from downloaders in addition to the link.
+	Password string
+	// Progress receives the ciphertext bytes sent and the total.
+	Progress func(sent, total int64)
+	// Request uploads into the request link instead, for its owner.
+	// Expire and Downloads are then set by the request, and Password
+	// must be empty.
+	Request string
+}
+
+// DownloadOptions configure a download.
+type DownloadOptions struct {
+	Password string
+	// Item picks the file of a collection to download, see Items.
+	Item string
+	// OwnerToken is the owner token of the request a file was uploaded to,
+	// which the server wants along with the key of such files.
+	OwnerToken string
+	// Progress receives the ciphertext bytes received and the total.
+	Progress func(received, total int64)
+}
+
+// Upload is a finished upload. URL is the share link, it carries the key in
+// its fragment. OwnerToken is needed to manage the file. An upload to a
+// request has neither, the file is its owner's.
+type Upload struct {
+	ID         string
+	URL        string
+	OwnerToken string
+}
+
+// Info is the state of an uploaded file.
+type Info struct {
+	Downloads     int
+	DownloadLimit int
+	TTL           time.Duration
+}
+
+// New returns a client uploading to server.
+func New(server string) *Client {
+	return &Client{Server: server}
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (c *Client) dialer() *websocket.Dialer {
+	if c.Dialer != nil {
+		return c.Dialer
+	}
+	return websocket.DefaultDialer
+}
+
+// Upload encrypts r and uploads it to c.Server.
+func (c *Client) Upload(ctx context.Context, r io.Reader, opts Options) (*Upload, error) {
+	meta := Metadata{Name: opts.Name, Type: opts.Type, Size: opts.Size}
+	if len(opts.Files) > 0 {
+		meta.Size = 0
+		for _, f := range opts.Files {
+			meta.Size += f.Size
+		}
+		meta.Manifest.Files = opts.Files
+		if len(opts.Files) > 1 {
+			meta.Name, meta.Type = "Send-Archive.zip", ArchiveType
+		} else {
+			meta.Name, meta.Type = opts.Files[0].Name, opts.Files[0].Type
+		}
+	} else {
+		meta.Manifest.Files = []File{{Name: meta.Name, Size: meta.Size, Type: meta.Type}}
+	}
+	if opts.Expire == 0 {
+		opts.Expire = 24 * time.Hour
+	}
+	if opts.Downloads == 0 {
+		opts.Downloads = 1
+	}
+
+	if opts.Request != "" && opts.Password != "" {
+		return nil, ErrRequestPassword
+	}
+
+	k, err := newKeychain(nil)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Password != "" {
+		k.setPassword(opts.Password)
+	}
+	encMeta, err := k.encryptMetadata(meta)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := encryptStream(&sizedReader{r: r, left: meta.Size}, k.secret)
+	if err != nil {
+		return nil, err
+	}
+	init := uploadInit{
+		FileMetadata:  b58encode(encMeta),
+		Authorization: "send-v1 " + k.authKeyB58(),
+		HasPassword:   opts.Password != "",
+		TimeLimit:     int(opts.Expire / time.Second),
+		Down:          opts.Downloads,
+		Size:          EncryptedSize(meta.Size),
+	}
+	server := strings.TrimSuffix(c.Server, "/")
+	if opts.Request != "" {
+		var pub []byte
+		server, init.Request, pub, err = c.parseRequestLink(opts.Request)
+		if err != nil {
+			return nil, err
+		}
+		if pub == nil {
+			return nil, fmt.Errorf("%q has no key", opts.Request)
+		}
+		if init.Sealed, err = sealSecret(pub, k.secret); err != nil {
+			return nil, err
+		}
+	}
+	total := init.Size
+	res, err := c.uploadWs(ctx, server, init, encrypted, func(n int64) {
+		if opts.Progress != nil {
+			opts.Progress(n, total)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if opts.Request != "" {
+		return &Upload{}, nil
+	}
+	return &Upload{
+		ID:         res.ID,
+		URL:        res.URL + "#" + k.secretB58(),
+		OwnerToken: res.OwnerToken,
+	}, nil
+}
+
+// sizedReader fails the upload if the content is not as long as announced,
+// since the length is part of the encrypted metadata.
+type sizedReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (s *sizedReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.left -= int64(n)
+	if s.left < 0 || (err == io.EOF && s.left != 0) {
+		return n, errors.New("content length does not match Options.Size")
+	}
+	return n, err
+}
+
+// Download fetches the metadata of the file behind link and returns a
+// reader decrypting its content. The content is requested on the first Read
+// and only authenticated in full once the reader returned io.EOF. A
+// collection needs opts.Item, the metadata is then the item's. A snippet
+// comes along with its metadata, this call already counts as its download.
+func (c *Client) Download(ctx context.Context, link string, opts DownloadOptions) (io.ReadCloser, Metadata, error) {
+	server, id, secret, err := c.parseLink(link)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	if secret == nil {
+		return nil, Metadata{}, fmt.Errorf("%q has no key", link)
+	}
+	k, err := newKeychain(secret)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	if opts.Password != "" {
+		k.setPassword(opts.Password)
+	}
+	res, meta, err := c.fetchMetadata(ctx, server, id, k, opts.OwnerToken)
+	if err != nil {
+		return nil, meta, statusErr(err)
+	}
+	if len(res.Data) > 0 {
+		return &plainReader{
+			open: func() (io.Reader, io.Closer, error) {
+				return decryptStream(bytes.NewReader(res.Data), k.secret), nil, nil
+			},
+		}, meta, nil
+	}
+	target := id
+	if opts.Item != "" {
+		var ok bool
+		if meta, ok = collectionItem(meta, opts.Item); !ok {
+			return nil, meta, ErrNotFound
+		}
+		target = id + "/" + opts.Item
+	} else if meta.Type == CollectionType {
+		return nil, meta, ErrCollection
+	}
+	return &plainReader{
+		open: func() (io.Reader, io.Closer, error) {
+			body, err := c.download(ctx, server, target, k, opts.OwnerToken)
+			if err != nil {
+				return nil, nil, statusErr(err)
+			}
+			var src io.Reader = body
+			if opts.Progress != nil {
+				src = &progressReader{r: body, total: EncryptedSize(meta.Size), report: opts.Progress}
+			}
+			return decryptStream(src, k.secret), body, nil
+		},
+	}, meta, nil
+}
+
+// plainReader requests the content on the first Read, so a caller can look
+// at the metadata and back out without using up a download.
+type plainReader struct {
+	open func() (io.Reader, io.Closer, error)
+	r    io.Reader
+	body io.Closer
+	err  error
+}
+
+func (p *plainReader) Read(b []byte) (int, error) {
+	if p.r == nil && p.err == nil {
+		p.r, p.body, p.err = p.open()
+	}
+	if p.err != nil {
+		return 0, p.err
+	}
+	return p.r.Read(b)
+}
+
+func (p *plainReader) Close() error {
+	if p.body == nil {
+		return nil
+	}
+	return p.body.Close()
+}
+
+type progressReader struct {
+	r      io.Reader
+	n      int64
+	total  int64
+	report func(int64, int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if n > 0 {
+		p.report(p.n, p.total)
+	}
+	return n, err
+}
+
+// Info reports the download count and the remaining lifetime of a file.
+func (c *Client) Info(ctx context.Context, link, ownerToken string) (Info, error) {
+	server, id, _, err := c.parseLink(link)
+	if err != nil {
+		return Info{}, err
+	}
+	res, err := c.fileInfo(ctx, server, id, ownerToken)
+	if err != nil {
+		return Info{}, err
+	}
+	if !res.Exist {
+		return Info{}, ErrNotFound
+	}
+	return Info{
+		Downloads:     res.DownloadCount,
+		DownloadLimit: res.DownloadLimit,
+		TTL:           time.Duration(res.TTL) * time.Millisecond,
+	}, nil
+}
+
+// Event is a change of an uploaded file reported by Watch. Info is the state
+// of the file after it, Bytes the size of a completed download and Reason
+// why a file was deleted.
+type Event struct {
+	Type string
+	Info
+	Bytes  int64
+	Reason string
+}
+
+// Watch passes the events of an uploaded file to fn as they happen, the
+// first one is its current "status". It returns once the file is gone, the
+// last event being "expired" or "deleted", or when ctx is done.
+func (c *Client) Watch(ctx context.Context, link, ownerToken string, fn func(Event)) error {
+	server, id, _, err := c.parseLink(link)
+	if err != nil {
+		return err
+	}
+	err = c.events(ctx, server, id, ownerToken, func(typ string, ev ownerEvent) {
+		fn(Event{
+			Type: typ,
+			Info: Info{
+				Downloads:     ev.DownloadCount,
+				DownloadLimit: ev.DownloadLimit,
+				TTL:           time.Duration(ev.TTL) * time.Millisecond,
+			},
+			Bytes:  ev.Bytes,
+			Reason: ev.Reason,
+		})
+	})
+	return statusErr(err)
+}
+
+// Delete removes a file. The server does not tell whether the owner token
+// matched, Info does.
+func (c *Client) Delete(ctx context.Context, link, ownerToken string) error {
+	server, id, _, err := c.parseLink(link)
+	if err != nil {
+		return err
+	}
+	return c.deleteFile(ctx, server, id, ownerToken)
+}
+
+// SetPassword makes downloads of the file require password.
+func (c *Client) SetPassword(ctx context.Context, link, ownerToken, password string) error {
+	server, id, _, err := c.parseLink(link)
+	if err != nil {
+		return err
+	}
+	k, err := newKeychain(nil)
+	if err != nil {
+		return err
+	}
+	k.setPassword(password)
+	return statusErr(c.setPassword(ctx, server, id, ownerToken, k))
+}
+
+func statusErr(err error) error {
+	switch err {
+	case StatusError(http.StatusNotFound):
+		return ErrNotFound
+	case StatusError(http.StatusUnauthorized):
+		return ErrUnauthorized
+	}
+	return err
+}
+
+// parseLink splits a share link of the form <server>/download/<id>#<key>.
+// A bare file id refers to c.Server. The key is nil if there is none.
+func (c *Client) parseLink(link string) (string, string, []byte, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", "", nil, err
+	}
+	server := strings.TrimSuffix(c.Server, "/")
+	id := u.Path
+	if u.Scheme != "" || strings.Contains(u.Path, "/") {
+		i := strings.LastIndex(u.Path, "/download/")
+		if u.Scheme == "" || u.Host == "" || i < 0 {
+			return "", "", nil, fmt.Errorf("%q is not a share link", link)
+		}
+		server = u.Scheme + "://" + u.Host + u.Path[:i]
+		id = path.Base(u.Path)
+	}
+	var secret []byte
+	if u.Fragment != "" {
+		if secret = b58decode(u.Fragment); len(secret) != secretLength {
+			return "", "", nil, errors.New("invalid key in link")
+		}
+	}
+	return server, id, secret, nil
+}
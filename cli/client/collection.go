@@ -0,0 +1,160 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CollectionType is the type of an upload whose files are encrypted and
+// downloaded one by one. The manifest names each of them by its item ID.
+const CollectionType = "send-collection"
+
+// ErrCollection is returned by Download for a collection when no item is
+// given, see Items.
+var ErrCollection = errors.New("link is a collection, download its items one by one")
+
+// Item is a file of a collection upload, R yields exactly Size bytes.
+type Item struct {
+	File
+	R io.Reader
+}
+
+// CollectionItem is an item of a collection that can still be downloaded.
+type CollectionItem struct {
+	File
+	Downloads     int
+	DownloadLimit int
+}
+
+// UploadCollection encrypts every item on its own and uploads them to
+// c.Server as a collection, one link for all of them. Of opts only Expire,
+// Downloads, Password and Progress apply, Downloads to every item.
+func (c *Client) UploadCollection(ctx context.Context, items []Item, opts Options) (*Upload, error) {
+	if opts.Expire == 0 {
+		opts.Expire = 24 * time.Hour
+	}
+	if opts.Downloads == 0 {
+		opts.Downloads = 1
+	}
+	k, err := newKeychain(nil)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Password != "" {
+		k.setPassword(opts.Password)
+	}
+	server := strings.TrimSuffix(c.Server, "/")
+	var res uploadResult
+	err = c.post(ctx, server+"/api/collection", collectionInit{
+		Authorization: "send-v1 " + k.authKeyB58(),
+		HasPassword:   opts.Password != "",
+		TimeLimit:     int(opts.Expire / time.Second),
+		Down:          opts.Downloads,
+	}, &res, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.uploadItems(ctx, server, res, k, items, opts.Progress); err != nil {
+		// the owner token is the only way to the half made collection
+		_ = c.deleteFile(context.Background(), server, res.ID, res.OwnerToken)
+		return nil, err
+	}
+	return &Upload{
+		ID:         res.ID,
+		URL:        res.URL + "#" + k.secretB58(),
+		OwnerToken: res.OwnerToken,
+	}, nil
+}
+
+// uploadItems uploads items into the collection col and shares it with
+// their manifest.
+func (c *Client) uploadItems(ctx context.Context, server string, col uploadResult, k *keychain, items []Item, progress func(int64, int64)) error {
+	meta := Metadata{Name: "Send-Collection", Type: CollectionType}
+	var sent, total int64
+	for _, item := range items {
+		total += EncryptedSize(item.Size)
+	}
+	for _, item := range items {
+		encrypted, err := encryptStream(&sizedReader{r: item.R, left: item.Size}, k.secret)
+		if err != nil {
+			return err
+		}
+		init := uploadInit{
+			Collection: col.ID,
+			OwnerToken: col.OwnerToken,
+			Size:       EncryptedSize(item.Size),
+		}
+		res, err := c.uploadWs(ctx, server, init, encrypted, func(n int64) {
+			if progress != nil {
+				progress(sent+n, total)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		sent += init.Size
+		f := item.File
+		f.ID = res.ID
+		meta.Size += f.Size
+		meta.Manifest.Files = append(meta.Manifest.Files, f)
+	}
+	encMeta, err := k.encryptMetadata(meta)
+	if err != nil {
+		return err
+	}
+	return statusErr(c.setManifest(ctx, server, col.ID, col.OwnerToken, encMeta))
+}
+
+// Items lists the files of the collection behind link that are left to
+// download.
+func (c *Client) Items(ctx context.Context, link string, opts DownloadOptions) ([]CollectionItem, error) {
+	server, id, secret, err := c.parseLink(link)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, errors.New("link has no key")
+	}
+	k, err := newKeychain(secret)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Password != "" {
+		k.setPassword(opts.Password)
+	}
+	res, meta, err := c.fetchMetadata(ctx, server, id, k, opts.OwnerToken)
+	if err != nil {
+		return nil, statusErr(err)
+	}
+	if meta.Type != CollectionType {
+		return nil, errors.New("link is not a collection")
+	}
+	var list []CollectionItem
+	for _, f := range meta.Manifest.Files {
+		for _, item := range res.Items {
+			if item.ID == f.ID && (item.DownloadLimit == 0 || item.DownloadCount < item.DownloadLimit) {
+				list = append(list, CollectionItem{
+					File:          f,
+					Downloads:     item.DownloadCount,
+					DownloadLimit: item.DownloadLimit,
+				})
+			}
+		}
+	}
+	return list, nil
+}
+
+// collectionItem returns the metadata of the item id of the collection
+// described by meta.
+func collectionItem(meta Metadata, id string) (Metadata, bool) {
+	for _, f := range meta.Manifest.Files {
+		if f.ID == id {
+			return Metadata{Name: f.Name, Size: f.Size, Type: f.Type, Manifest: Manifest{Files: []File{f}}}, true
+		}
+	}
+	return Metadata{}, false
+}
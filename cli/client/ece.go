@@ -0,0 +1,251 @@
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// aes128gcm content encoding (RFC 8188) as produced by client/model/ece.js:
+// a 21 byte header of salt, record size and an empty key id, followed by
+// records of rs bytes. Every record holds rs-17 bytes of plaintext, a
+// delimiter (1, or 2 for the last record) and the 16 byte tag.
+const (
+	eceRecordSize   = 64 * 1024
+	eceTagLength    = 16
+	eceKeyLength    = 16
+	eceNonceLength  = 12
+	eceHeaderLength = eceKeyLength + 5
+)
+
+var errECERecord = errors.New("ece: malformed record")
+
+// EncryptedSize returns the length of the ciphertext for size plaintext bytes.
+func EncryptedSize(size int64) int64 {
+	meta := int64(eceTagLength + 1)
+	records := (size + eceRecordSize - meta - 1) / (eceRecordSize - meta)
+	return eceHeaderLength + size + meta*records
+}
+
+func eceKeys(ikm, salt []byte) (cipher.AEAD, []byte, error) {
+	key, err := hkdfKey(ikm, salt, "Content-Encoding: aes128gcm\x00", eceKeyLength)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce, err := hkdfKey(ikm, salt, "Content-Encoding: nonce\x00", eceKeyLength)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gcm, nonce[:eceNonceLength], nil
+}
+
+// eceStream holds what encryption and decryption share: the keys, the record
+// sequence and a one record look-ahead, since the last record is marked.
+type eceStream struct {
+	src       io.Reader
+	aead      cipher.AEAD
+	nonceBase []byte
+	rs        int
+	seq       uint64
+	pending   []byte
+	eof       bool
+	done      bool
+	out       []byte
+}
+
+func (s *eceStream) nonce() ([]byte, error) {
+	if s.seq > 0xffffffff {
+		return nil, errors.New("ece: record sequence number exceeds limit")
+	}
+	nonce := append([]byte(nil), s.nonceBase...)
+	m := binary.BigEndian.Uint32(nonce[eceNonceLength-4:])
+	binary.BigEndian.PutUint32(nonce[eceNonceLength-4:], m^uint32(s.seq))
+	s.seq++
+	return nonce, nil
+}
+
+// next returns the pending chunk and whether it is the last one, and reads
+// the following chunk of size n.
+func (s *eceStream) next(n int) ([]byte, bool, error) {
+	if s.done || (s.eof && len(s.pending) == 0) {
+		s.done = true
+		return nil, false, io.EOF
+	}
+	chunk, last := s.pending, s.eof
+	if !last {
+		if err := s.fill(n); err != nil {
+			return nil, false, err
+		}
+		last = s.eof && len(s.pending) == 0
+	}
+	s.done = last
+	return chunk, last, nil
+}
+
+func (s *eceStream) fill(n int) error {
+	buf := make([]byte, n)
+	read, err := io.ReadFull(s.src, buf)
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		s.eof = true
+	default:
+		return err
+	}
+	s.pending = buf[:read]
+	return nil
+}
+
+func (s *eceStream) read(p []byte, record func() error) (int, error) {
+	for len(s.out) == 0 {
+		if err := record(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+type eceEncrypter struct {
+	eceStream
+}
+
+// encryptStream encrypts src with ikm using 64 KiB records and a random salt.
+func encryptStream(src io.Reader, ikm []byte) (io.Reader, error) {
+	salt := make([]byte, eceKeyLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return newEncrypter(src, ikm, salt, eceRecordSize)
+}
+
+// newEncrypter encrypts src with the given salt and record size, like the
+// optional arguments of encryptStream in ece.js.
+func newEncrypter(src io.Reader, ikm, salt []byte, rs int) (*eceEncrypter, error) {
+	if rs <= eceTagLength+1 {
+		return nil, errors.New("ece: invalid record size")
+	}
+	aead, nonceBase, err := eceKeys(ikm, salt)
+	if err != nil {
+		return nil, err
+	}
+	e := &eceEncrypter{eceStream{
+		src:       src,
+		aead:      aead,
+		nonceBase: nonceBase,
+		rs:        rs,
+	}}
+	header := make([]byte, eceHeaderLength)
+	copy(header, salt)
+	binary.BigEndian.PutUint32(header[eceKeyLength:], uint32(e.rs))
+	e.out = header
+	if err := e.fill(e.rs - eceTagLength - 1); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *eceEncrypter) Read(p []byte) (int, error) {
+	return e.read(p, e.record)
+}
+
+func (e *eceEncrypter) record() error {
+	chunk, last, err := e.next(e.rs - eceTagLength - 1)
+	if err != nil {
+		return err
+	}
+	nonce, err := e.nonce()
+	if err != nil {
+		return err
+	}
+	var padded []byte
+	if last {
+		padded = append(chunk, 2)
+	} else {
+		padded = make([]byte, e.rs-eceTagLength)
+		copy(padded, chunk)
+		padded[len(chunk)] = 1
+	}
+	e.out = e.aead.Seal(padded[:0], nonce, padded, nil)
+	return nil
+}
+
+type eceDecrypter struct {
+	eceStream
+	ikm []byte
+}
+
+// decryptStream decrypts an aes128gcm stream, the record size is taken from
+// its header.
+func decryptStream(src io.Reader, ikm []byte) io.Reader {
+	return &eceDecrypter{eceStream: eceStream{src: src}, ikm: ikm}
+}
+
+func (d *eceDecrypter) Read(p []byte) (int, error) {
+	return d.read(p, d.record)
+}
+
+func (d *eceDecrypter) header() error {
+	header := make([]byte, eceHeaderLength)
+	if _, err := io.ReadFull(d.src, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errors.New("ece: stream too short for header")
+		}
+		return err
+	}
+	d.rs = int(binary.BigEndian.Uint32(header[eceKeyLength:]))
+	if d.rs <= eceTagLength+1 {
+		return errors.New("ece: invalid record size")
+	}
+	if _, err := io.CopyN(ioutil.Discard, d.src, int64(header[eceKeyLength+4])); err != nil {
+		return err
+	}
+	aead, nonceBase, err := eceKeys(d.ikm, header[:eceKeyLength])
+	if err != nil {
+		return err
+	}
+	d.aead, d.nonceBase = aead, nonceBase
+	return d.fill(d.rs)
+}
+
+func (d *eceDecrypter) record() error {
+	if d.aead == nil {
+		if err := d.header(); err != nil {
+			return err
+		}
+	}
+	chunk, last, err := d.next(d.rs)
+	if err != nil {
+		return err
+	}
+	nonce, err := d.nonce()
+	if err != nil {
+		return err
+	}
+	plain, err := d.aead.Open(chunk[:0], nonce, chunk, nil)
+	if err != nil {
+		return err
+	}
+	i := len(plain) - 1
+	for i >= 0 && plain[i] == 0 {
+		i--
+	}
+	if i < 0 || (last && plain[i] != 2) || (!last && plain[i] != 1) {
+		return errECERecord
+	}
+	d.out = plain[:i]
+	return nil
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"testing"
+)
+
+// The vectors below come from encryptStream of client/model/ece.js, run under
+// Node with the same key, salt and record size.
+var (
+	vectorIKM  = []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	vectorSalt = []byte{0xa0, 0xa1, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xab, 0xac, 0xad, 0xae, 0xaf}
+)
+
+var eceVectors = []struct {
+	size, rs int
+	// ciphertext is the whole stream up to 256 bytes, or its SHA-256
+	ciphertext string
+	length     int
+}{
+	{0, 64, "a0a1a2a3a4a5a6a7a8a9aaabacadaeaf0000004000", 21},
+	{100, 64, "a0a1a2a3a4a5a6a7a8a9aaabacadaeaf0000004000beb342db95064927cd015c403730d1d716ffa84ccbcc97c05fd14bcf64dae0a0373dbb6d8b8825a0c76e87fff172e6b325417edc8468f2f90786567cadb7605e85fb355bfcd9c7443ee9f05b3ad0ad5930848717e3f7d2ddd84d2b238029e212d59927638c5bfb6f1c38de64882693754810346b19c659de06019bd119a36a440f565e11f5adc54ad08ddb882a15e3f386f667be92130d", 172},
+	// a multiple of the record's plaintext, the last record is full
+	{94, 64, "a0a1a2a3a4a5a6a7a8a9aaabacadaeaf0000004000beb342db95064927cd015c403730d1d716ffa84ccbcc97c05fd14bcf64dae0a0373dbb6d8b8825a0c76e87fff172e6b325417edc8468f2f90786567cadb7605e85fb355bfcd9c7443ee9f05b3ad0ad5930848717e3f7d2ddd84d2b238029e212d59927638c5bfb6f1c38de6488269376d40b5c4a4ab006fa80803d559b094852", 149},
+	{200000, eceRecordSize, "a68f2f38558677d69dbee2eb261928cfd7412db332aeeb6df6ec75043bcf7c99", 200089},
+}
+
+func vectorPlaintext(n int) []byte {
+	p := make([]byte, n)
+	for i := range p {
+		p[i] = byte(i % 251)
+	}
+	return p
+}
+
+func TestECEVectors(t *testing.T) {
+	for _, v := range eceVectors {
+		plain := vectorPlaintext(v.size)
+		e, err := newEncrypter(bytes.NewReader(plain), vectorIKM, vectorSalt, v.rs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct, err := ioutil.ReadAll(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ct) != v.length {
+			t.Errorf("%d bytes, rs %d: ciphertext of %d bytes, want %d", v.size, v.rs, len(ct), v.length)
+			continue
+		}
+		got := hex.EncodeToString(ct)
+		if len(ct) > 256 {
+			sum := sha256.Sum256(ct)
+			got = hex.EncodeToString(sum[:])
+		}
+		if got != v.ciphertext {
+			t.Errorf("%d bytes, rs %d: ciphertext differs from ece.js", v.size, v.rs)
+		}
+		if v.rs == eceRecordSize && int64(len(ct)) != EncryptedSize(int64(v.size)) {
+			t.Errorf("EncryptedSize(%d) = %d, want %d", v.size, EncryptedSize(int64(v.size)), len(ct))
+		}
+
+		dec, err := ioutil.ReadAll(decryptStream(bytes.NewReader(ct), vectorIKM))
+		if err != nil {
+			t.Fatalf("%d bytes, rs %d: %v", v.size, v.rs, err)
+		}
+		if !bytes.Equal(dec, plain) {
+			t.Errorf("%d bytes, rs %d: decrypted plaintext differs", v.size, v.rs)
+		}
+	}
+}
+
+func TestECERoundTrip(t *testing.T) {
+	for _, n := range []int{0, 1, eceRecordSize - eceTagLength - 1, eceRecordSize, 3*eceRecordSize + 5} {
+		plain := vectorPlaintext(n)
+		enc, err := encryptStream(bytes.NewReader(plain), vectorIKM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct, err := ioutil.ReadAll(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(ct)) != EncryptedSize(int64(n)) {
+			t.Errorf("%d bytes: ciphertext of %d bytes, EncryptedSize says %d", n, len(ct), EncryptedSize(int64(n)))
+		}
+		dec, err := ioutil.ReadAll(decryptStream(bytes.NewReader(ct), vectorIKM))
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if !bytes.Equal(dec, plain) {
+			t.Fatalf("%d bytes: round trip changed the plaintext", n)
+		}
+	}
+}
+
+func TestECETamperedRecord(t *testing.T) {
+	e, err := newEncrypter(bytes.NewReader(vectorPlaintext(100)), vectorIKM, vectorSalt, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, _ := ioutil.ReadAll(e)
+	// dropping the last record turns the previous one into the last, whose
+	// delimiter is wrong
+	if _, err := ioutil.ReadAll(decryptStream(bytes.NewReader(ct[:len(ct)-23]), vectorIKM)); err == nil {
+		t.Fatal("truncated stream decrypted")
+	}
+	ct[30] ^= 1
+	if _, err := ioutil.ReadAll(decryptStream(bytes.NewReader(ct), vectorIKM)); err == nil {
+		t.Fatal("modified record decrypted")
+	}
+}
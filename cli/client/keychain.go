@@ -0,0 +1,151 @@
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	secretLength = 16
+	// WebCrypto derives HMAC keys with the block size of the hash when no
+	// length is given, 64 bytes for SHA-256.
+	authKeyLength = 64
+	// the nonce client/model/keychain.js starts with, the server answers the
+	// first request with the real one
+	defaultNonce = "yRCdyQ1EMSA3mo4rqSkuNQ"
+)
+
+// keychain mirrors client/model/keychain.js. Every key is derived from the
+// secret carried in the fragment of the share link, a password replaces the
+// send-v1 authentication key.
+type keychain struct {
+	secret  []byte
+	metaKey cipher.AEAD
+	authKey []byte
+	nonce   string
+}
+
+// Metadata describes an upload. It is encrypted with the link's key, so the
+// server never sees it.
+type Metadata struct {
+	Name     string   `json:"name"`
+	Size     int64    `json:"size"`
+	Type     string   `json:"type"`
+	Manifest Manifest `json:"manifest"`
+}
+
+// Manifest lists the files of an upload. An upload of type ArchiveType is
+// the concatenation of these files, one of type CollectionType has them as
+// separate items.
+type Manifest struct {
+	Files []File `json:"files"`
+}
+
+// File is an entry of a manifest, ID names the item of a collection.
+type File struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+}
+
+// newKeychain derives the keys for secret, a nil secret generates a new one.
+func newKeychain(secret []byte) (*keychain, error) {
+	if secret == nil {
+		secret = make([]byte, secretLength)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	metaKey, err := hkdfKey(secret, nil, "metadata", 16)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(metaKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	authKey, err := hkdfKey(secret, nil, "authentication", authKeyLength)
+	if err != nil {
+		return nil, err
+	}
+	return &keychain{
+		secret:  secret,
+		metaKey: gcm,
+		authKey: authKey,
+		nonce:   defaultNonce,
+	}, nil
+}
+
+func hkdfKey(secret, salt []byte, info string, length int) ([]byte, error) {
+	key := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// setPassword derives the authentication key from password the way the
+// browser does: PBKDF2-SHA256, empty salt, 100 iterations.
+func (k *keychain) setPassword(password string) {
+	k.authKey = pbkdf2.Key([]byte(password), nil, 100, authKeyLength, sha256.New)
+}
+
+func (k *keychain) secretB58() string {
+	return b58encode(k.secret)
+}
+
+func (k *keychain) authKeyB58() string {
+	return b58encode(k.authKey)
+}
+
+func (k *keychain) authHeader() string {
+	mac := hmac.New(sha256.New, k.authKey)
+	mac.Write(b58decode(k.nonce))
+	return "send-v1 " + b58encode(mac.Sum(nil))
+}
+
+// encryptMetadata seals meta with the metadata key. The key is used for a
+// single message, so the IV is all zeros like in the browser.
+func (k *keychain) encryptMetadata(meta Metadata) ([]byte, error) {
+	if meta.Type == "" {
+		meta.Type = "application/octet-stream"
+	}
+	plain, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	return k.metaKey.Seal(nil, make([]byte, k.metaKey.NonceSize()), plain, nil), nil
+}
+
+func (k *keychain) decryptMetadata(ciphertext []byte) (Metadata, error) {
+	var meta Metadata
+	plain, err := k.metaKey.Open(nil, make([]byte, k.metaKey.NonceSize()), ciphertext, nil)
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(plain, &meta)
+	return meta, err
+}
+
+var bs58 = NewAlphabet("123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz")
+
+func b58encode(a []byte) string {
+	return Encode(a, bs58)
+}
+
+func b58decode(a string) []byte {
+	return Decode(a, bs58)
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// The vectors below come from Keychain of client/model/keychain.js, run
+// under Node for the secret 0x10, 0x11, ... 0x1f.
+const (
+	vectorSecret     = "2z57mqVKV81ov6EoKXKtP8"
+	vectorAuthKey    = "VY3MjLxsSxaMAV5LP66nH9cETongBJPoGTHLTo38xH8MqTJjJAVMZmuDi9Cy7erQoe2qiAQsi629tQaeZxaUD8a"
+	vectorHeader     = "send-v1 9UNCb2uUPvi2MjUE9fgAUugGfHJW8xSr7hKouhysPivY"
+	vectorNonce      = "Ab3x9KfQ"
+	vectorNonceAuth  = "send-v1 9hXow5g9NrMbVLf3EoNderudF7y1uS439kDizj1cB6QS"
+	vectorPwAuthKey  = "3pspr9jhUAmzTDu2XLFZSZ9s5n2KjPK3cFcpVnQF3NKXbFKomJT2beP2sKsXxpSy6sLAYdSoUWX9imHR38sfSWEF"
+	vectorPwHeader   = "send-v1 E5Pwsh8BJp13kXBq5qaEYu5joR4PUuFWVgWoSL8YUqDP"
+	vectorMetaCipher = "7d8ad744785325db653a3d7a3eb9dee9820e2980c72068798757dfb89a43b7bb78684f2867d3cf6fe80fed596ee3ce9120d978f456417f69211a43eb39d88cc6bc5ece28e9686de9740f6812c7656d9ae7f62164cbf6780949f5b8a4801ca59dd9d4622b56beb540f04958daa0320ba9795df4e33da3650155ac313bc3d2cf87de4cf0dc14e4802089d5"
+)
+
+var vectorMeta = Metadata{
+	Name:     "notes.txt",
+	Size:     5,
+	Type:     "text/plain",
+	Manifest: Manifest{Files: []File{{Name: "notes.txt", Size: 5, Type: "text/plain"}}},
+}
+
+func vectorKeychain(t *testing.T) *keychain {
+	t.Helper()
+	k, err := newKeychain(b58decode(vectorSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestKeychainVectors(t *testing.T) {
+	k := vectorKeychain(t)
+	if k.secretB58() != vectorSecret {
+		t.Fatalf("secret %s, want %s", k.secretB58(), vectorSecret)
+	}
+	if k.authKeyB58() != vectorAuthKey {
+		t.Errorf("auth key %s, want %s", k.authKeyB58(), vectorAuthKey)
+	}
+	if h := k.authHeader(); h != vectorHeader {
+		t.Errorf("header %s, want %s", h, vectorHeader)
+	}
+	k.nonce = vectorNonce
+	if h := k.authHeader(); h != vectorNonceAuth {
+		t.Errorf("header for nonce %s: %s, want %s", vectorNonce, h, vectorNonceAuth)
+	}
+	k.setPassword("hunter2")
+	if k.authKeyB58() != vectorPwAuthKey {
+		t.Errorf("password auth key %s, want %s", k.authKeyB58(), vectorPwAuthKey)
+	}
+	if h := k.authHeader(); h != vectorPwHeader {
+		t.Errorf("password header %s, want %s", h, vectorPwHeader)
+	}
+}
+
+func TestMetadataVector(t *testing.T) {
+	k := vectorKeychain(t)
+	ct, err := k.encryptMetadata(vectorMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(ct) != vectorMetaCipher {
+		t.Errorf("metadata ciphertext differs from keychain.js")
+	}
+	js, _ := hex.DecodeString(vectorMetaCipher)
+	meta, err := k.decryptMetadata(js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Name != vectorMeta.Name || meta.Size != vectorMeta.Size || len(meta.Manifest.Files) != 1 {
+		t.Fatalf("decrypted %+v", meta)
+	}
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	k, err := newKeychain(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, err := k.encryptMetadata(Metadata{Name: "a.bin", Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := k.decryptMetadata(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Name != "a.bin" || meta.Type != "application/octet-stream" {
+		t.Fatalf("decrypted %+v", meta)
+	}
+	other, _ := newKeychain(nil)
+	if _, err := other.decryptMetadata(ct); err == nil {
+		t.Fatal("metadata opened with another secret")
+	}
+}
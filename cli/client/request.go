@@ -0,0 +1,225 @@
+package client
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// the key of a file uploaded to a request is sealed to the request's P-256
+// public key: ECDH with an ephemeral key, HKDF-SHA256 salted with the
+// ephemeral public key, then AES-128-GCM with a zero IV since every key
+// seals a single secret
+const (
+	requestKeyInfo = "send request"
+	publicKeyLen   = 65
+	privateKeyLen  = 32
+	sealedLen      = publicKeyLen + secretLength + 16
+)
+
+var errRequestKey = errors.New("invalid request key")
+
+// ErrRequestPassword is returned for uploads to a request with a password.
+// The owner opens them with the request's key alone, so a password would
+// lock them out.
+var ErrRequestPassword = errors.New("uploads to a request cannot have a password")
+
+// FileRequest is a request link made by CreateRequest. URL is for the
+// people who should upload, it carries the public key in its fragment. Key
+// opens what they upload and OwnerToken lists it, both stay with the owner.
+type FileRequest struct {
+	ID         string
+	URL        string
+	OwnerToken string
+	Key        string
+}
+
+// RequestOptions limit what a request accepts. Bytes counts ciphertext,
+// see EncryptedSize. Expire defaults to one day and Downloads, the
+// downloads allowed for every received file, to one.
+type RequestOptions struct {
+	Files     int
+	Bytes     int64
+	Expire    time.Duration
+	Downloads int
+}
+
+// ReceivedFile is a file uploaded to a request. URL is its share link,
+// with the key, for Download along with the request's owner token. Files
+// still being uploaded are not Complete.
+type ReceivedFile struct {
+	ID            string
+	URL           string
+	Metadata      Metadata
+	Complete      bool
+	Downloads     int
+	DownloadLimit int
+}
+
+// CreateRequest makes a request link on c.Server that lets others upload
+// files only its owner can read.
+func (c *Client) CreateRequest(ctx context.Context, opts RequestOptions) (*FileRequest, error) {
+	if opts.Expire == 0 {
+		opts.Expire = 24 * time.Hour
+	}
+	if opts.Downloads == 0 {
+		opts.Downloads = 1
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	var res requestResult
+	err = c.post(ctx, strings.TrimSuffix(c.Server, "/")+"/api/request", requestInit{
+		MaxFiles:  opts.Files,
+		MaxBytes:  opts.Bytes,
+		TimeLimit: int(opts.Expire / time.Second),
+		Down:      opts.Downloads,
+	}, &res, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	pub := elliptic.Marshal(elliptic.P256(), key.X, key.Y)
+	return &FileRequest{
+		ID:         res.ID,
+		URL:        res.URL + "#" + b58encode(pub),
+		OwnerToken: res.OwnerToken,
+		Key:        b58encode(key.D.FillBytes(make([]byte, privateKeyLen))),
+	}, nil
+}
+
+// RequestFiles lists the files uploaded to the request behind link and
+// opens their keys with key.
+func (c *Client) RequestFiles(ctx context.Context, link, ownerToken, key string) ([]ReceivedFile, error) {
+	server, id, _, err := c.parseRequestLink(link)
+	if err != nil {
+		return nil, err
+	}
+	priv := b58decode(key)
+	if len(priv) == 0 || len(priv) > privateKeyLen {
+		return nil, errRequestKey
+	}
+	info, err := c.requestFiles(ctx, server, id, ownerToken)
+	if err != nil {
+		return nil, statusErr(err)
+	}
+	var files []ReceivedFile
+	for _, f := range info.List {
+		secret, err := openSecret(priv, f.Sealed)
+		if err != nil {
+			return nil, fmt.Errorf("file %s: %v", f.ID, err)
+		}
+		k, err := newKeychain(secret)
+		if err != nil {
+			return nil, err
+		}
+		meta, err := k.decryptMetadata(b58decode(f.Metadata))
+		if err != nil {
+			return nil, fmt.Errorf("file %s: %v", f.ID, ErrWrongKey)
+		}
+		files = append(files, ReceivedFile{
+			ID:            f.ID,
+			URL:           server + "/download/" + f.ID + "#" + k.secretB58(),
+			Metadata:      meta,
+			Complete:      f.Complete,
+			Downloads:     f.DownloadCount,
+			DownloadLimit: f.DownloadLimit,
+		})
+	}
+	return files, nil
+}
+
+// DeleteRequest closes the request behind link and deletes its files.
+func (c *Client) DeleteRequest(ctx context.Context, link, ownerToken string) error {
+	server, id, _, err := c.parseRequestLink(link)
+	if err != nil {
+		return err
+	}
+	return statusErr(c.deleteRequest(ctx, server, id, ownerToken))
+}
+
+// parseRequestLink splits a request link of the form
+// <server>/request/<id>#<public key>. The key is nil if there is none.
+func (c *Client) parseRequestLink(link string) (string, string, []byte, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", "", nil, err
+	}
+	i := strings.LastIndex(u.Path, "/request/")
+	if u.Scheme == "" || u.Host == "" || i < 0 {
+		return "", "", nil, fmt.Errorf("%q is not a request link", link)
+	}
+	var pub []byte
+	if u.Fragment != "" {
+		if pub = b58decode(u.Fragment); len(pub) != publicKeyLen {
+			return "", "", nil, errors.New("invalid key in request link")
+		}
+	}
+	return u.Scheme + "://" + u.Host + u.Path[:i], path.Base(u.Path), pub, nil
+}
+
+// sealSecret encrypts secret to the public key pub.
+func sealSecret(pub, secret []byte) (string, error) {
+	x, y := elliptic.Unmarshal(elliptic.P256(), pub)
+	if x == nil {
+		return "", errRequestKey
+	}
+	eph, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	ephPub := elliptic.Marshal(elliptic.P256(), eph.X, eph.Y)
+	gcm, err := requestCipher(x, y, eph.D.Bytes(), ephPub)
+	if err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(ephPub, make([]byte, gcm.NonceSize()), secret, nil)
+	return b58encode(sealed), nil
+}
+
+// openSecret decrypts a secret sealed to the public key of priv.
+func openSecret(priv []byte, sealed string) ([]byte, error) {
+	data := b58decode(sealed)
+	if len(data) != sealedLen {
+		return nil, errRequestKey
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), data[:publicKeyLen])
+	if x == nil {
+		return nil, errRequestKey
+	}
+	gcm, err := requestCipher(x, y, priv, data[:publicKeyLen])
+	if err != nil {
+		return nil, err
+	}
+	secret, err := gcm.Open(nil, make([]byte, gcm.NonceSize()), data[publicKeyLen:], nil)
+	if err != nil {
+		return nil, errRequestKey
+	}
+	return secret, nil
+}
+
+// requestCipher derives the cipher sealing a secret from the ECDH of the
+// point x, y with the scalar d.
+func requestCipher(x, y *big.Int, d, ephPub []byte) (cipher.AEAD, error) {
+	sx, _ := elliptic.P256().ScalarMult(x, y, d)
+	key, err := hkdfKey(sx.FillBytes(make([]byte, 32)), ephPub, requestKeyInfo, 16)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRequestUploadRejectsPassword(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer ts.Close()
+	c := New(ts.URL)
+	_, err := c.Upload(context.Background(), strings.NewReader("secret"), Options{
+		Name:     "a.txt",
+		Size:     6,
+		Password: "hunter2",
+		Request:  ts.URL + "/request/0123456789abcdef#key",
+	})
+	if err != ErrRequestPassword {
+		t.Fatalf("upload with a password to a request: %v, want ErrRequestPassword", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Fatalf("%d requests sent for a rejected upload", n)
+	}
+}
+
+// the owner of a request opens uploads with the sealed secret alone, which
+// is why they cannot have a password
+func TestSealedSecretOpensWithRequestKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, _ := newKeychain(nil)
+	sealed, err := sealSecret(elliptic.Marshal(elliptic.P256(), key.X, key.Y), k.secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := openSecret(key.D.FillBytes(make([]byte, privateKeyLen)), sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b58encode(secret) != k.secretB58() {
+		t.Fatal("opened a different secret")
+	}
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if _, err := openSecret(other.D.FillBytes(make([]byte, privateKeyLen)), sealed); err != errRequestKey {
+		t.Fatalf("opened with another key: %v", err)
+	}
+}
+
+func TestDownloadSendsRequestOwnerToken(t *testing.T) {
+	var got atomic.Value
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got.Store(r.Header.Get("X-Owner-Token"))
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer ts.Close()
+	k, _ := newKeychain(nil)
+	_, _, err := New(ts.URL).Download(context.Background(), ts.URL+"/download/0123456789abcdef#"+k.secretB58(), DownloadOptions{
+		OwnerToken: "owner",
+	})
+	if err == nil {
+		t.Fatal("download refused by the server succeeded")
+	}
+	if token, _ := got.Load().(string); token != "owner" {
+		t.Fatalf("owner token %q sent, want %q", token, "owner")
+	}
+}
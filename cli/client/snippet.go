@@ -0,0 +1,67 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Snippet encrypts data and stores it on c.Server in a single request, for
+// secrets and other short texts up to the server's snippet limit. Reading
+// it with Download uses up one of opts.Downloads, one by default, and
+// opts.Name and Type default to snippet.txt and text/plain.
+func (c *Client) Snippet(ctx context.Context, data []byte, opts Options) (*Upload, error) {
+	if opts.Name == "" {
+		opts.Name = "snippet.txt"
+	}
+	if opts.Type == "" {
+		opts.Type = "text/plain"
+	}
+	if opts.Expire == 0 {
+		opts.Expire = 24 * time.Hour
+	}
+	if opts.Downloads == 0 {
+		opts.Downloads = 1
+	}
+	meta := Metadata{Name: opts.Name, Type: opts.Type, Size: int64(len(data))}
+	meta.Manifest.Files = []File{{Name: meta.Name, Size: meta.Size, Type: meta.Type}}
+	k, err := newKeychain(nil)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Password != "" {
+		k.setPassword(opts.Password)
+	}
+	encMeta, err := k.encryptMetadata(meta)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := encryptStream(bytes.NewReader(data), k.secret)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := ioutil.ReadAll(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	var res uploadResult
+	err = c.post(ctx, strings.TrimSuffix(c.Server, "/")+"/api/snippet", snippetInit{
+		FileMetadata:  b58encode(encMeta),
+		Authorization: "send-v1 " + k.authKeyB58(),
+		HasPassword:   opts.Password != "",
+		TimeLimit:     int(opts.Expire / time.Second),
+		Down:          opts.Downloads,
+		Data:          ciphertext,
+	}, &res, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return &Upload{
+		ID:         res.ID,
+		URL:        res.URL + "#" + k.secretB58(),
+		OwnerToken: res.OwnerToken,
+	}, nil
+}
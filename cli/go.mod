@@ -0,0 +1,8 @@
+module send
+
+go 1.15
+
+require (
+	github.com/gorilla/websocket v1.4.2
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
+)
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"send/client"
+)
+
+const usage = `usage: send <command> [flags] [arguments]
+
+commands:
+  upload    encrypt and upload files, print the share link and owner token
+  snippet   share a short text read once by default, like a secret
+  download  download and decrypt a share link
+  list      list the files of a collection
+  info      show the download count and expiry of an uploaded file
+  watch     follow the downloads of an uploaded file as they happen
+  delete    delete an uploaded file
+  password  protect an uploaded file with a password
+  request   create a link others can upload files to for you
+  inbox     list and download the files uploaded to a request
+
+Run 'send <command> -h' for the flags of a command.
+`
+
+var commands = map[string]func(args []string) error{
+	"upload":   uploadCmd,
+	"snippet":  snippetCmd,
+	"download": downloadCmd,
+	"list":     listCmd,
+	"info":     infoCmd,
+	"watch":    watchCmd,
+	"delete":   deleteCmd,
+	"password": passwordCmd,
+	"request":  requestCmd,
+	"inbox":    inboxCmd,
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("send: ")
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err := cmd(os.Args[2:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func defaultServer() string {
+	if s := os.Getenv("SEND_SERVER"); s != "" {
+		return s
+	}
+	return "https://neko.nz"
+}
+
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: send %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func uploadCmd(args []string) error {
+	fs := newFlagSet("upload", "file...")
+	server := fs.String("server", defaultServer(), "server to upload to, defaults to $SEND_SERVER")
+	expire := fs.Duration("expire", 24*time.Hour, "time until the file expires")
+	downloads := fs.Int("downloads", 1, "number of downloads allowed")
+	password := fs.String("password", "", "require this password to download")
+	request := fs.String("request", "", "upload to this request link instead, for its owner")
+	collection := fs.Bool("collection", false, "upload the files as a collection, downloadable one by one, instead of an archive")
+	quiet := fs.Bool("q", false, "do not report progress")
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *collection && *request != "" {
+		log.Fatal("-collection cannot upload to a request")
+	}
+
+	files, manifest, err := openFiles(fs.Args())
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	readers := make([]io.Reader, len(files))
+	for i, f := range files {
+		readers[i] = f
+	}
+	c := client.New(*server)
+	opts := client.Options{
+		Files:     manifest,
+		Expire:    *expire,
+		Downloads: *downloads,
+		Password:  *password,
+		Progress:  progress(*quiet),
+		Request:   *request,
+	}
+	var res *client.Upload
+	if *collection {
+		items := make([]client.Item, len(files))
+		for i, f := range files {
+			items[i] = client.Item{File: manifest[i], R: f}
+		}
+		res, err = c.UploadCollection(context.Background(), items, opts)
+	} else {
+		res, err = c.Upload(context.Background(), io.MultiReader(readers...), opts)
+	}
+	if err != nil {
+		return err
+	}
+	if *request != "" {
+		fmt.Fprintln(os.Stderr, "uploaded to the request")
+		return nil
+	}
+	fmt.Printf("%s\n%s\n", res.URL, res.OwnerToken)
+	return nil
+}
+
+func snippetCmd(args []string) error {
+	fs := newFlagSet("snippet", "[file]")
+	server := fs.String("server", defaultServer(), "server to upload to, defaults to $SEND_SERVER")
+	expire := fs.Duration("expire", 24*time.Hour, "time until the snippet expires")
+	downloads := fs.Int("downloads", 1, "number of times it can be read")
+	password := fs.String("password", "", "require this password to read it")
+	_ = fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	opts := client.Options{
+		Expire:    *expire,
+		Downloads: *downloads,
+		Password:  *password,
+	}
+	var data []byte
+	var err error
+	if fs.NArg() == 1 {
+		data, err = ioutil.ReadFile(fs.Arg(0))
+		opts.Name = filepath.Base(fs.Arg(0))
+		opts.Type = mime.TypeByExtension(filepath.Ext(opts.Name))
+	} else {
+		data, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return errors.New("nothing to share")
+	}
+	res, err := client.New(*server).Snippet(context.Background(), data, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n%s\n", res.URL, res.OwnerToken)
+	return nil
+}
+
+func openFiles(names []string) ([]*os.File, []client.File, error) {
+	var files []*os.File
+	var manifest []client.File
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			return files, nil, err
+		}
+		files = append(files, f)
+		info, err := f.Stat()
+		if err != nil {
+			return files, nil, err
+		}
+		if !info.Mode().IsRegular() {
+			return files, nil, fmt.Errorf("%s is not a regular file", name)
+		}
+		manifest = append(manifest, client.File{
+			Name: info.Name(),
+			Size: info.Size(),
+			Type: mime.TypeByExtension(filepath.Ext(name)),
+		})
+	}
+	return files, manifest, nil
+}
+
+func downloadCmd(args []string) error {
+	fs := newFlagSet("download", "link")
+	out := fs.String("o", ".", "directory to save to, - writes to stdout")
+	password := fs.String("password", "", "password of the file")
+	item := fs.String("item", "", "download only this item of a collection")
+	quiet := fs.Bool("q", false, "do not report progress")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	c := client.New(defaultServer())
+	err := downloadTo(c, fs.Arg(0), *out, *quiet, client.DownloadOptions{Password: *password, Item: *item})
+	if err != client.ErrCollection {
+		return err
+	}
+	if *out == "-" {
+		return errors.New("pick the item of the collection to write to stdout with -item")
+	}
+	items, err := c.Items(context.Background(), fs.Arg(0), client.DownloadOptions{Password: *password})
+	if err != nil {
+		return err
+	}
+	for _, it := range items {
+		if err := downloadTo(c, fs.Arg(0), *out, *quiet, client.DownloadOptions{Password: *password, Item: it.ID}); err != nil {
+			return fmt.Errorf("%s: %v", it.ID, err)
+		}
+	}
+	return nil
+}
+
+// downloadTo saves the file behind link, or its item of a collection, in the
+// directory out, or writes it to stdout for -.
+func downloadTo(c *client.Client, link, out string, quiet bool, opts client.DownloadOptions) error {
+	opts.Progress = progress(quiet)
+	plain, meta, err := c.Download(context.Background(), link, opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = plain.Close()
+	}()
+
+	if out == "-" {
+		_, err := io.Copy(os.Stdout, plain)
+		return err
+	}
+	files := []client.File{{Name: meta.Name, Size: -1}}
+	if meta.Type == client.ArchiveType {
+		files = meta.Manifest.Files
+	}
+	// check before reading, a download only counts once it completed
+	for _, file := range files {
+		name := filepath.Join(out, safeName(file.Name))
+		if _, err := os.Lstat(name); err == nil {
+			return fmt.Errorf("%s already exists", name)
+		}
+	}
+	for _, file := range files {
+		if err := saveFile(filepath.Join(out, safeName(file.Name)), plain, file.Size); err != nil {
+			return err
+		}
+	}
+	// reading to the end authenticates the last record
+	if n, err := io.Copy(ioutil.Discard, plain); err != nil || n != 0 {
+		if err == nil {
+			err = errors.New("archive is longer than its manifest")
+		}
+		return err
+	}
+	return nil
+}
+
+// saveFile writes size bytes from r to name, or everything if size is
+// negative. It never overwrites and removes what it wrote on failure.
+func saveFile(name string, r io.Reader, size int64) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		_, err = io.Copy(f, r)
+	} else {
+		_, err = io.CopyN(f, r, size)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(name)
+		return err
+	}
+	fmt.Fprintln(os.Stderr, name)
+	return nil
+}
+
+// safeName keeps a name from the sender inside the target directory. It is
+// URI decoded first, like the browser does when saving.
+func safeName(name string) string {
+	if unescaped, err := url.PathUnescape(name); err == nil {
+		name = unescaped
+	}
+	name = filepath.Base(filepath.Clean(string(filepath.Separator) + name))
+	if name == string(filepath.Separator) || name == "." {
+		return "download"
+	}
+	return name
+}
+
+func listCmd(args []string) error {
+	fs := newFlagSet("list", "link")
+	password := fs.String("password", "", "password of the collection")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	items, err := client.New(defaultServer()).Items(context.Background(), fs.Arg(0), client.DownloadOptions{
+		Password: *password,
+	})
+	if err != nil {
+		return err
+	}
+	for _, it := range items {
+		fmt.Printf("%s  %s  downloads: %d/%d  %s\n", it.ID, humanBytes(it.Size), it.Downloads, it.DownloadLimit, it.Name)
+	}
+	return nil
+}
+
+func infoCmd(args []string) error {
+	fs := newFlagSet("info", "link")
+	token := fs.String("token", "", "owner token printed by upload")
+	_ = fs.Parse(args)
+	link := ownedFile(fs, *token)
+	info, err := client.New(defaultServer()).Info(context.Background(), link, *token)
+	if err == client.ErrNotFound {
+		return errors.New("file does not exist or the owner token is wrong")
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("downloads: %d/%d\n", info.Downloads, info.DownloadLimit)
+	fmt.Printf("expires in: %s\n", info.TTL.Round(time.Second))
+	return nil
+}
+
+func watchCmd(args []string) error {
+	fs := newFlagSet("watch", "link")
+	token := fs.String("token", "", "owner token printed by upload")
+	_ = fs.Parse(args)
+	link := ownedFile(fs, *token)
+	err := client.New(defaultServer()).Watch(context.Background(), link, *token, func(ev client.Event) {
+		now := time.Now().Format("15:04:05")
+		switch ev.Type {
+		case "download_completed":
+			fmt.Printf("%s %s, %s, downloads: %d/%d\n", now, ev.Type, humanBytes(ev.Bytes), ev.Downloads, ev.DownloadLimit)
+		case "deleted":
+			fmt.Printf("%s %s (%s)\n", now, ev.Type, ev.Reason)
+		default:
+			fmt.Printf("%s %s, downloads: %d/%d, expires in: %s\n", now, ev.Type, ev.Downloads, ev.DownloadLimit, ev.TTL.Round(time.Second))
+		}
+	})
+	if err == client.ErrUnauthorized {
+		return errors.New("wrong owner token")
+	}
+	return err
+}
+
+func requestCmd(args []string) error {
+	fs := newFlagSet("request", "")
+	server := fs.String("server", defaultServer(), "server to create the request on, defaults to $SEND_SERVER")
+	files := fs.Int("files", 10, "number of files that can be uploaded")
+	size := fs.Int64("bytes", 1<<30, "total encrypted bytes that can be uploaded")
+	expire := fs.Duration("expire", 24*time.Hour, "time until the request and its files expire")
+	downloads := fs.Int("downloads", 1, "number of downloads allowed for every file")
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	req, err := client.New(*server).CreateRequest(context.Background(), client.RequestOptions{
+		Files:     *files,
+		Bytes:     *size,
+		Expire:    *expire,
+		Downloads: *downloads,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n%s\n%s\n", req.URL, req.OwnerToken, req.Key)
+	return nil
+}
+
+func inboxCmd(args []string) error {
+	fs := newFlagSet("inbox", "link")
+	token := fs.String("token", "", "owner token printed by request")
+	key := fs.String("key", "", "key printed by request")
+	out := fs.String("o", "", "download the complete files to this directory")
+	del := fs.Bool("delete", false, "close the request and delete its files")
+	quiet := fs.Bool("q", false, "do not report progress")
+	_ = fs.Parse(args)
+	link := ownedFile(fs, *token)
+	c := client.New(defaultServer())
+	if *del {
+		return c.DeleteRequest(context.Background(), link, *token)
+	}
+	if *key == "" {
+		log.Fatal("-key is required")
+	}
+	files, err := c.RequestFiles(context.Background(), link, *token, *key)
+	if err == client.ErrNotFound {
+		return errors.New("request does not exist or has expired")
+	}
+	if err == client.ErrUnauthorized {
+		return errors.New("wrong owner token")
+	}
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		status := fmt.Sprintf("downloads: %d/%d", f.Downloads, f.DownloadLimit)
+		if !f.Complete {
+			status = "uploading"
+		}
+		fmt.Printf("%s  %s  %s  %s\n", f.ID, humanBytes(f.Metadata.Size), status, f.Metadata.Name)
+	}
+	if *out == "" {
+		return nil
+	}
+	for _, f := range files {
+		if !f.Complete || f.Downloads >= f.DownloadLimit {
+			continue
+		}
+		if err := downloadTo(c, f.URL, *out, *quiet, client.DownloadOptions{OwnerToken: *token}); err != nil {
+			return fmt.Errorf("%s: %v", f.ID, err)
+		}
+	}
+	return nil
+}
+
+func deleteCmd(args []string) error {
+	fs := newFlagSet("delete", "link")
+	token := fs.String("token", "", "owner token printed by upload")
+	_ = fs.Parse(args)
+	link := ownedFile(fs, *token)
+	return client.New(defaultServer()).Delete(context.Background(), link, *token)
+}
+
+func passwordCmd(args []string) error {
+	fs := newFlagSet("password", "link")
+	token := fs.String("token", "", "owner token printed by upload")
+	password := fs.String("password", "", "new password")
+	_ = fs.Parse(args)
+	link := ownedFile(fs, *token)
+	if *password == "" {
+		log.Fatal("-password is required")
+	}
+	return client.New(defaultServer()).SetPassword(context.Background(), link, *token, *password)
+}
+
+// ownedFile returns the link argument of a command that needs the owner token.
+func ownedFile(fs *flag.FlagSet, token string) string {
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if token == "" {
+		log.Fatal("-token is required")
+	}
+	return fs.Arg(0)
+}
+
+// progress returns a callback printing the transferred share to stderr.
+func progress(quiet bool) func(int64, int64) {
+	if quiet {
+		return nil
+	}
+	return func(n, total int64) {
+		if total <= 0 {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "\r%3d%% %s / %s", n*100/total, humanBytes(n), humanBytes(total))
+		if n >= total {
+			fmt.Fprintln(os.Stderr)
+		}
+	}
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
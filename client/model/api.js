@@ -47,6 +47,9 @@ async function fetchWithAuth(url, params, keychain) {
         Authorization: h,
         'Content-Type': 'application/json'
     });
+    if (keychain.ownerToken) {
+        params.headers.set('X-Owner-Token', keychain.ownerToken);
+    }
     const response = await fetch(url, params);
     result.response = response;
     result.ok = response.ok;
@@ -119,6 +122,104 @@ export async function fileInfo(id, owner_token) {
     throw new Error(response.status);
 }
 
+const ownerEvents = [
+    'status',
+    'download_started',
+    'download_completed',
+    'limit_reached',
+    'password_changed',
+    'expired',
+    'deleted',
+    'rejected'
+];
+
+// the server follows at most this many files per stream
+const MAX_WATCHED_FILES = 64;
+
+// Every watched file shares one event stream (one per MAX_WATCHED_FILES),
+// reopened when the set of files changes.
+const watchedFiles = new Map();
+let ownerSources = [];
+let reopenScheduled = false;
+
+function openOwnerStreams() {
+    reopenScheduled = false;
+    ownerSources.forEach(source => source.close());
+    ownerSources = [];
+    const ids = Array.from(watchedFiles.keys());
+    for (let i = 0; i < ids.length; i += MAX_WATCHED_FILES) {
+        const params = new URLSearchParams();
+        ids.slice(i, i + MAX_WATCHED_FILES).forEach(id => {
+            params.append('id', id);
+            params.append('owner_token', watchedFiles.get(id).ownerToken);
+        });
+        const source = new EventSource(getApiUrl(`/api/events?${params}`));
+        ownerEvents.forEach(type =>
+            source.addEventListener(type, e => {
+                const data = JSON.parse(e.data);
+                const watcher = watchedFiles.get(data.id);
+                if (watcher) {
+                    watcher.onEvent(type, data);
+                }
+            })
+        );
+        ownerSources.push(source);
+    }
+}
+
+function reopenOwnerStreams() {
+    if (!reopenScheduled) {
+        reopenScheduled = true;
+        // batch the changes of one tick into a single reconnect
+        Promise.resolve().then(openOwnerStreams);
+    }
+}
+
+export function watchFileEvents(id, owner_token, onEvent) {
+    watchedFiles.set(id, { ownerToken: owner_token, onEvent });
+    reopenOwnerStreams();
+}
+
+export function unwatchFileEvents(id) {
+    if (watchedFiles.delete(id)) {
+        reopenOwnerStreams();
+    }
+}
+
+export async function createRequest(limits) {
+    const response = await fetch(getApiUrl('/api/request'), post(limits));
+    if (response.ok) {
+        return response.json();
+    }
+    throw new Error(response.status);
+}
+
+export async function requestStatus(id, owner_token) {
+    const headers = {};
+    if (owner_token) {
+        headers.Authorization = `Bearer ${owner_token}`;
+    }
+    const response = await fetch(
+        getApiUrl(`/api/request/${id}${owner_token ? '/files' : ''}`), {
+            headers
+        }
+    );
+    if (response.ok) {
+        return response.json();
+    }
+    throw new Error(response.status);
+}
+
+export async function deleteRequest(id, owner_token) {
+    const response = await fetch(getApiUrl(`/api/request/${id}`), {
+        method: 'DELETE',
+        headers: {
+            Authorization: `Bearer ${owner_token}`
+        }
+    });
+    return response.ok;
+}
+
 export async function metadata(id, keychain) {
     const result = await fetchWithAuthAndRetry(
         getApiUrl(`/api/metadata/${id}`), {
@@ -203,7 +304,9 @@ async function upload(
     timeLimit,
     dlimit,
     pwd,
+    expectedSize,
     token,
+    request,
     onprogress,
     canceller
 ) {
@@ -222,8 +325,13 @@ async function upload(
             authorization: `send-v1 ${verifierB64}`,
             has_password: pwd,
             timeLimit,
-            dlimit
+            dlimit,
+            size: expectedSize
         };
+        if (request) {
+            fileMeta.request = request.id;
+            fileMeta.sealed = request.sealed;
+        }
         const uploadInfoResponse = listenForResponse(ws, canceller);
         ws.send(JSON.stringify(fileMeta));
         const uploadInfo = await uploadInfoResponse;
@@ -283,7 +391,9 @@ export function uploadWs(
     timeLimit,
     dlimit,
     pwd,
+    expectedSize,
     token,
+    request,
     onprogress
 ) {
     const canceller = {
@@ -302,7 +412,9 @@ export function uploadWs(
             timeLimit,
             dlimit,
             pwd,
+            expectedSize,
             token,
+            request,
             onprogress,
             canceller
         )
@@ -314,13 +426,17 @@ export function uploadWs(
 async function downloadS(id, keychain, token, signal) {
     const auth = await keychain.authHeader();
 
+    const headers = {
+        "x-token": token,
+        Authorization: auth
+    };
+    if (keychain.ownerToken) {
+        headers['X-Owner-Token'] = keychain.ownerToken;
+    }
     const response = await fetch(getApiUrl(`/api/download/${id}`), {
         signal: signal,
         method: 'GET',
-        headers: {
-            "x-token": token,
-            Authorization: auth
-        }
+        headers
     });
 
     const authHeader = response.headers.get('WWW-Authenticate');
@@ -393,6 +509,9 @@ async function download(id, keychain, token, onprogress, canceller) {
         xhr.open('get', getApiUrl(`/api/download/blob/${id}`));
         xhr.setRequestHeader('Authorization', auth);
         xhr.setRequestHeader('x-token', token);
+        if (keychain.ownerToken) {
+            xhr.setRequestHeader('X-Owner-Token', keychain.ownerToken);
+        }
         xhr.responseType = 'blob';
         xhr.send();
         onprogress(0);
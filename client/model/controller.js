@@ -1,5 +1,9 @@
 import FileReceiver from './fileReceiver';
 import FileSender from './fileSender';
+import Archive from './archive';
+import Keychain from './keychain';
+import { createRequest, deleteRequest, requestStatus } from './api';
+import { createRequestKey, openSecret } from './request';
 import copyDialog from '../ui/copyDialog';
 import { updateFavicon } from '../ui/faviconProgressbar';
 import okDialog from '../ui/okDialog';
@@ -9,10 +13,12 @@ import shareDialog from '../ui/shareDialog';
 import {
     bytes,
     locale,
+    bufferToStr,
     copyToClipboard,
     delay,
     openLinksInNewTab,
-    percent
+    percent,
+    strToBuffer
 } from './utils';
 
 export default function(state, emitter) {
@@ -25,11 +31,23 @@ export default function(state, emitter) {
 
     async function checkFiles(toRender = true) {
         const changes = await state.storage.merge();
+        state.storage.files.forEach(watchFile);
         if (changes.incoming || changes.downloadCount) {
             toRender && render();
         }
     }
 
+    function watchFile(file) {
+        file.watch(async () => {
+            if (file.expired) {
+                state.storage.remove(file.id);
+            } else {
+                await state.storage.writeFile(file);
+            }
+            render();
+        });
+    }
+
     function updateProgress() {
         emitter.emit('DOMTitleChange', 'Sending ' + percent(state.transfer.progressRatio));
         updateFavicon(state.transfer.progressRatio);
@@ -185,6 +203,7 @@ export default function(state, emitter) {
             const ownedFile = await sender.upload(archive, token, state.capabilities);
             state.storage.totalUploads += 1;
             state.storage.addFile(ownedFile);
+            watchFile(ownedFile);
             console.log(state.storage, ownedFile)
             const duration = Date.now() - start;
             emitter.emit('DOMTitleChange', 'Neko Send');
@@ -308,4 +327,105 @@ export default function(state, emitter) {
         // }
         render();
     });
-}
\ No newline at end of file
+
+    // request links: the owner makes one here and reads what is sent to it,
+    // anybody holding the link can send files
+
+    emitter.on('createRequest', async limits => {
+        try {
+            const key = await createRequestKey();
+            const result = await createRequest(limits);
+            state.storage.writeRequest({
+                id: result.id,
+                url: `${result.url}#${key.publicKey}`,
+                ownerToken: result.ownerToken,
+                privateKey: key.privateKey,
+                files: []
+            });
+            emitter.emit('pushState', `/request/${result.id}`);
+        } catch (e) {
+            console.error(e);
+            emitter.emit('pushState', '/error');
+        }
+    });
+
+    emitter.on('loadRequest', async id => {
+        // what a send to the request left behind outlives the reload
+        const prev = state.request && state.request.id === id ? state.request : {};
+        state.request = { id, loading: true, sent: prev.sent, failed: prev.failed };
+        const own = state.storage.getRequest(id);
+        try {
+            const info = await requestStatus(id, own && own.ownerToken);
+            state.request.info = info;
+            if (own) {
+                state.request.files = await openRequestFiles(own, info.list || []);
+                own.files = state.request.files.map(f => f.id);
+                state.storage.writeRequest(own);
+            }
+        } catch (e) {
+            state.request.error = e.message;
+        }
+        state.request.loading = false;
+        render();
+    });
+
+    async function openRequestFiles(own, list) {
+        const files = [];
+        for (const f of list) {
+            try {
+                const secret = bufferToStr(await openSecret(own.privateKey, f.sealed));
+                const meta = await new Keychain(secret).decryptMetadata(strToBuffer(f.metadata));
+                files.push({
+                    id: f.id,
+                    name: meta.name,
+                    size: meta.size,
+                    complete: f.complete,
+                    dlimit: f.dlimit,
+                    dtotal: f.dtotal,
+                    url: `/download/${f.id}#${secret}`
+                });
+            } catch (e) {
+                // sealed to another key, nothing the owner can read
+            }
+        }
+        return files;
+    }
+
+    emitter.on('uploadToRequest', async ({ files }) => {
+        const req = state.request;
+        const archive = new Archive(files);
+        archive.request = { id: req.id, publicKey: state.params.key };
+        const sender = new FileSender();
+        sender.on('progress', updateProgress);
+        sender.on('encrypting', render);
+        state.transfer = sender;
+        req.sent = false;
+        req.failed = false;
+        render();
+        try {
+            let token = await prepareReCaptcha()
+            self.cachedRecaptcha = null
+            await sender.upload(archive, token, state.capabilities);
+            req.sent = true;
+        } catch (err) {
+            if (err.message !== '0') {
+                console.error(err);
+                req.failed = true;
+            }
+        } finally {
+            state.transfer = null;
+            emitter.emit('DOMTitleChange', 'Neko Send');
+            updateFavicon(0);
+            emitter.emit('loadRequest', req.id);
+        }
+    });
+
+    emitter.on('deleteRequest', async id => {
+        const own = state.storage.getRequest(id);
+        if (own && await deleteRequest(id, own.ownerToken)) {
+            state.storage.removeRequest(id);
+        }
+        state.request = null;
+        emitter.emit('pushState', '/');
+    });
+}
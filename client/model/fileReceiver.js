@@ -12,6 +12,8 @@ export default class FileReceiver extends Nanobus {
         if (fileInfo.requiresPassword) {
             this.keychain.setPassword(fileInfo.password);
         }
+        // files sent to a request need the request's owner token too
+        this.keychain.ownerToken = fileInfo.ownerToken;
         this.fileInfo = fileInfo;
         this.reset();
     }
@@ -132,6 +134,7 @@ export default class FileReceiver extends Nanobus {
                 url: this.fileInfo.url,
                 size: this.fileInfo.size,
                 nonce: this.keychain.nonce,
+                ownerToken: this.fileInfo.ownerToken,
                 token: token,
                 noSave
             };
@@ -3,6 +3,7 @@ import OwnedFile from './ownedFile';
 import Keychain from './keychain';
 import swMsg from './swMsg';
 import { uploadWs } from './api';
+import { sealSecret } from './request';
 import { encryptedSize } from './utils';
 import { blobStream, concatStream } from './streams';
 import { bufferToStr, strToBuffer, bytes } from './utils';
@@ -60,8 +61,16 @@ export default class FileSender extends Nanobus {
         const totalSize = encryptedSize(archive.size)
         const metadata = await this.keychain.encryptMetadata(archive);
         const authKey = await this.keychain.authKeyB64()
+        // an upload to a request is its owner's, who opens the sealed key
+        let request = null;
+        if (archive.request) {
+            request = {
+                id: archive.request.id,
+                sealed: await sealSecret(archive.request.publicKey, this.keychain.rawSecret)
+            };
+        }
         this.uploadRequest = uploadWs(encStream, metadata, authKey, 
-            archive.timeLimit, archive.dlimit, hasPassword, token,
+            archive.timeLimit, archive.dlimit, hasPassword, totalSize, token, request,
             p => {
                 this.progress = [p, totalSize];
                 this.emit('progress');
@@ -79,6 +88,9 @@ export default class FileSender extends Nanobus {
             this.msg = 'notifyUploadEncryptDone';
             this.uploadRequest = null;
             this.progress = [1, 1];
+            if (request) {
+                return null;
+            }
             const secretKey = bufferToStr(this.keychain.rawSecret);
             const ownedFile = new OwnedFile({
                 id: result.id,
@@ -1,6 +1,13 @@
 import Keychain from './keychain';
 import { bufferToStr } from './utils';
-import { del, fileInfo, setParams, setPassword } from './api';
+import {
+    del,
+    fileInfo,
+    setParams,
+    setPassword,
+    unwatchFileEvents,
+    watchFileEvents
+} from './api';
 
 export default class OwnedFile {
     constructor(obj) {
@@ -42,9 +49,41 @@ export default class OwnedFile {
     }
 
     del() {
+        this.unwatch();
         return del(this.id, this.ownerToken);
     }
 
+    watch(onChange) {
+        if (this.watching || typeof EventSource === 'undefined') {
+            return;
+        }
+        this.watching = true;
+        watchFileEvents(this.id, this.ownerToken, async (type, result) => {
+            if (type === 'rejected') {
+                // gone or not ours, the next merge tells which
+                this.unwatch();
+                return;
+            }
+            if (type === 'expired' || type === 'deleted') {
+                this.expiresAt = 0;
+                this.unwatch();
+            } else if (result.item) {
+                // the counts are the item's, refresh the collection's
+                await this.updateDownloadCount();
+            } else {
+                await this.updateDownloadCount(result);
+            }
+            onChange(type);
+        });
+    }
+
+    unwatch() {
+        if (this.watching) {
+            this.watching = false;
+            unwatchFileEvents(this.id);
+        }
+    }
+
     changeLimit(dlimit, user = {}) {
         if (this.dlimit !== dlimit) {
             this.dlimit = dlimit;
@@ -0,0 +1,124 @@
+import { bufferToStr, strToBuffer } from './utils';
+const encoder = new TextEncoder();
+
+// The key of a file uploaded to a request is sealed to the request's P-256
+// public key, like the CLI does: ECDH with an ephemeral key, HKDF-SHA256 of
+// the shared X coordinate with the ephemeral public key as salt, and
+// AES-128-GCM with an all-zero IV.
+const ECDH = {
+    name: 'ECDH',
+    namedCurve: 'P-256'
+};
+const PUBLIC_KEY_LENGTH = 65;
+const PRIVATE_KEY_LENGTH = 32;
+
+// PKCS #8 wrapping of a bare P-256 private key, WebCrypto has no raw import
+const PKCS8_PREFIX = new Uint8Array([
+    0x30, 0x41, 0x02, 0x01, 0x00, 0x30, 0x13, 0x06, 0x07, 0x2a, 0x86, 0x48,
+    0xce, 0x3d, 0x02, 0x01, 0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03,
+    0x01, 0x07, 0x04, 0x27, 0x30, 0x25, 0x02, 0x01, 0x01, 0x04, 0x20
+]);
+
+async function requestCipher(privateKey, publicKey, salt) {
+    const shared = await crypto.subtle.deriveBits({
+            name: 'ECDH',
+            public: publicKey
+        },
+        privateKey,
+        256
+    );
+    const ikm = await crypto.subtle.importKey('raw', shared, 'HKDF', false, [
+        'deriveKey'
+    ]);
+    return crypto.subtle.deriveKey({
+            name: 'HKDF',
+            salt,
+            info: encoder.encode('send request'),
+            hash: 'SHA-256'
+        },
+        ikm, {
+            name: 'AES-GCM',
+            length: 128
+        },
+        false,
+        ['encrypt', 'decrypt']
+    );
+}
+
+// createRequestKey returns a key pair for a new request: publicKey goes in
+// the fragment of the request link, privateKey stays with its owner.
+export async function createRequestKey() {
+    const pair = await crypto.subtle.generateKey(ECDH, true, ['deriveBits']);
+    const pub = await crypto.subtle.exportKey('raw', pair.publicKey);
+    const jwk = await crypto.subtle.exportKey('jwk', pair.privateKey);
+    return {
+        publicKey: bufferToStr(new Uint8Array(pub)),
+        privateKey: bufferToStr(base64UrlToBuffer(jwk.d))
+    };
+}
+
+function base64UrlToBuffer(s) {
+    const b = atob(s.replace(/-/g, '+').replace(/_/g, '/'));
+    return Uint8Array.from(b, c => c.charCodeAt(0));
+}
+
+function importPrivateKey(privateKey) {
+    const d = strToBuffer(privateKey);
+    if (d.length === 0 || d.length > PRIVATE_KEY_LENGTH) {
+        throw new Error('invalid request key');
+    }
+    const der = new Uint8Array(PKCS8_PREFIX.length + PRIVATE_KEY_LENGTH);
+    der.set(PKCS8_PREFIX);
+    der.set(d, der.length - d.length);
+    return crypto.subtle.importKey('pkcs8', der, ECDH, false, ['deriveBits']);
+}
+
+// sealSecret encrypts the secret of a file to the public key of a request.
+export async function sealSecret(publicKey, secret) {
+    const pub = await crypto.subtle.importKey(
+        'raw',
+        strToBuffer(publicKey),
+        ECDH,
+        false,
+        []
+    );
+    const eph = await crypto.subtle.generateKey(ECDH, true, ['deriveBits']);
+    const ephPub = new Uint8Array(
+        await crypto.subtle.exportKey('raw', eph.publicKey)
+    );
+    const key = await requestCipher(eph.privateKey, pub, ephPub);
+    const sealed = await crypto.subtle.encrypt({
+            name: 'AES-GCM',
+            iv: new Uint8Array(12),
+            tagLength: 128
+        },
+        key,
+        secret
+    );
+    const out = new Uint8Array(PUBLIC_KEY_LENGTH + sealed.byteLength);
+    out.set(ephPub);
+    out.set(new Uint8Array(sealed), PUBLIC_KEY_LENGTH);
+    return bufferToStr(out);
+}
+
+// openSecret decrypts a secret sealed to the request whose private key is
+// privateKey.
+export async function openSecret(privateKey, sealed) {
+    const data = strToBuffer(sealed);
+    const ephPub = data.slice(0, PUBLIC_KEY_LENGTH);
+    const pub = await crypto.subtle.importKey('raw', ephPub, ECDH, false, []);
+    const key = await requestCipher(
+        await importPrivateKey(privateKey),
+        pub,
+        ephPub
+    );
+    const secret = await crypto.subtle.decrypt({
+            name: 'AES-GCM',
+            iv: new Uint8Array(12),
+            tagLength: 128
+        },
+        key,
+        data.slice(PUBLIC_KEY_LENGTH)
+    );
+    return new Uint8Array(secret);
+}
@@ -7,12 +7,16 @@ import legal from '../ui/legal';
 import error from '../ui/error';
 import blank from '../ui/blank';
 import notFound from '../ui/notFound';
+import request from '../ui/request';
 
 export default (app = choo({ hash: true })) => {
     // console.log(body, home)
     app.route('/', body(home));
     app.route('/download/:id', body(download));
     app.route('/download/:id/:key', body(download));
+    app.route('/request', body(request));
+    app.route('/request/:id', body(request));
+    app.route('/request/:id/:key', body(request));
     app.route('/unsupported/:reason', body(unsupported));
     app.route('/legal', body(legal));
     app.route('/error', body(error));
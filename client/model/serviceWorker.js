@@ -55,6 +55,7 @@ async function decryptHandler(id) {
         if (file.requiresPassword) {
             keychain.setPassword(file.password);
         }
+        keychain.ownerToken = file.ownerToken;
 
         file.download = downloadStream(id, keychain, file.token);
         const body = await file.download.result;
@@ -165,6 +166,7 @@ self.onmessage = event => {
         const info = {
             key: event.data.key,
             nonce: event.data.nonce,
+            ownerToken: event.data.ownerToken,
             filename: event.data.filename,
             requiresPassword: event.data.requiresPassword,
             password: event.data.password,
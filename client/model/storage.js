@@ -128,6 +128,10 @@ class Storage {
 
     remove(property) {
         if (isFile(property)) {
+            const file = this._files.get(property);
+            if (file) {
+                file.unwatch();
+            }
             this._files.delete(property);
         }
         this.engine.removeItem(property);
@@ -147,10 +151,52 @@ class Storage {
     }
 
     clearLocalFiles() {
-        this._files.forEach(f => this.engine.removeItem(f.id));
+        this._files.forEach(f => {
+            f.unwatch();
+            this.engine.removeItem(f.id);
+        });
         this._files = new Map();
     }
 
+    // Requests made here are kept under request:<id>, with their owner
+    // token, private key and the files seen in them.
+    get requests() {
+        const list = [];
+        for (let i = 0; i < this.engine.length; i++) {
+            const k = this.engine.key(i);
+            if (k && k.startsWith('request:')) {
+                const req = this.getRequest(k.slice(8));
+                if (req) {
+                    list.push(req);
+                }
+            }
+        }
+        return list;
+    }
+
+    getRequest(id) {
+        try {
+            return JSON.parse(this.engine.getItem(`request:${id}`));
+        } catch (e) {
+            return null;
+        }
+    }
+
+    writeRequest(req) {
+        this.engine.setItem(`request:${req.id}`, JSON.stringify(req));
+    }
+
+    removeRequest(id) {
+        this.engine.removeItem(`request:${id}`);
+    }
+
+    // requestOwnerToken returns the owner token of the request the file id
+    // was sent to, if it is one of ours.
+    requestOwnerToken(id) {
+        const req = this.requests.find(r => (r.files || []).includes(id));
+        return req ? req.ownerToken : undefined;
+    }
+
     async merge(files = []) {
         let incoming = false;
         let outgoing = false;
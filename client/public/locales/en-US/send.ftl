@@ -142,3 +142,20 @@ shareLinkButton = Share link
 # $name is the name of the file
 shareMessage = Download “{ $name }” with { -send-brand }: simple, safe file sharing
 learnMore = Learn more.
+requestFilesLink = Ask someone to send you files
+requestTitle = Request files
+requestDescription = Make a link that lets anybody send you files, encrypted so only you can open them.
+requestMaxFiles = Number of files
+requestMaxSize = Total size (MB)
+requestExpiry = Open for (hours)
+requestCreateButton = Create link
+requestLinkLabel = Share this link with the people who should send you files:
+requestInboxEmpty = Nothing has been sent yet.
+requestDeleteButton = Close request
+requestUploadTitle = Send files
+requestUploadDescription = { $num ->
+        [one] You can send 1 more file, up to { $size }.
+       *[other] You can send { $num } more files, up to { $size }.
+    }
+requestSent = Your files were sent.
+requestClosed = This request no longer accepts files.
@@ -19,6 +19,7 @@ function createFileInfo(state) {
         requiresPassword: downloadMetadata.pwd,
         password: null,
         invalidPwd: false,
+        ownerToken: state.storage.requestOwnerToken(state.params.id)
     };
 }
 
@@ -13,6 +13,9 @@ export default (state) => {
         <p class="max-w-sm leading-loose mt-6 md:mt-2 md:pr-14">
           ${state.translate('introDescription')}
         </p>
+        <a href="/request" class="link-blue mt-2">
+          ${state.translate('requestFilesLink')}
+        </a>
         <img class="intro" src="${assets.get('intro.svg')}" />
       </div>
     </send-intro>
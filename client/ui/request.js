@@ -0,0 +1,202 @@
+import html from 'choo/html';
+import { bytes, percent } from '../model/utils';
+
+const MB = 1000 * 1000;
+
+function createForm(state, emit) {
+    function submit(event) {
+        event.preventDefault();
+        const form = event.target;
+        emit('createRequest', {
+            maxFiles: parseInt(form.maxFiles.value, 10),
+            maxBytes: Math.round(parseFloat(form.maxSize.value) * MB),
+            timeLimit: parseInt(form.expiry.value, 10) * 3600,
+            dlimit: 1
+        });
+    }
+
+    return html `
+    <form class="flex flex-col w-full max-w-sm" onsubmit="${submit}">
+      <label class="my-2">
+        ${state.translate('requestMaxFiles')}
+        <input
+          name="maxFiles"
+          type="number"
+          min="1"
+          value="10"
+          class="w-full border rounded-lg p-2 mt-1 dark:bg-grey-80"
+        />
+      </label>
+      <label class="my-2">
+        ${state.translate('requestMaxSize')}
+        <input
+          name="maxSize"
+          type="number"
+          min="1"
+          value="${Math.floor(state.LIMITS.MAX_FILE_SIZE / MB)}"
+          class="w-full border rounded-lg p-2 mt-1 dark:bg-grey-80"
+        />
+      </label>
+      <label class="my-2">
+        ${state.translate('requestExpiry')}
+        <input
+          name="expiry"
+          type="number"
+          min="1"
+          value="24"
+          class="w-full border rounded-lg p-2 mt-1 dark:bg-grey-80"
+        />
+      </label>
+      <button type="submit" class="btn rounded-lg flex-shrink-0 mt-4">
+        ${state.translate('requestCreateButton')}
+      </button>
+    </form>
+  `;
+}
+
+function inbox(state, emit, own) {
+    const req = state.request;
+    const files = req.files || [];
+    return html `
+    <div class="flex flex-col w-full max-w-sm">
+      <p class="my-2">${state.translate('requestLinkLabel')}</p>
+      <input
+        type="text"
+        readonly
+        value="${own.url}"
+        class="w-full border rounded-lg p-2 dark:bg-grey-80"
+        onfocus="${e => e.target.select()}"
+      />
+      <button
+        class="btn rounded-lg flex-shrink-0 mt-2"
+        onclick="${() => emit('copy', { url: own.url })}"
+      >
+        ${state.translate('copyLinkButton')}
+      </button>
+      <ul class="my-4">
+        ${files.length
+          ? files.map(
+              f => html `
+                <li class="flex flex-row justify-between py-1">
+                  <a class="link-blue truncate" href="${f.url}">${f.name}</a>
+                  <span class="text-grey-70 ml-2">${bytes(f.size)}</span>
+                </li>
+              `
+            )
+          : html `<li class="text-grey-70">${state.translate('requestInboxEmpty')}</li>`}
+      </ul>
+      <button
+        class="btn rounded-lg flex-shrink-0 bg-red-60 hover:bg-red-70"
+        onclick="${() => emit('deleteRequest', own.id)}"
+      >
+        ${state.translate('requestDeleteButton')}
+      </button>
+    </div>
+  `;
+}
+
+function dropBox(state, emit) {
+    const req = state.request;
+    if (state.transfer) {
+        return html `
+      <p class="my-4">
+        ${percent(state.transfer.progressRatio)}
+      </p>
+    `;
+    }
+    if (req.error || !req.info || !state.params.key) {
+        return html `
+      <p class="my-4">${state.translate('requestClosed')}</p>
+    `;
+    }
+    const info = req.info;
+    const files = info.maxFiles - info.files;
+    const size = info.maxBytes - info.bytes;
+    if (files <= 0 || size <= 0) {
+        return html `
+      <p class="my-4">${state.translate('requestClosed')}</p>
+    `;
+    }
+
+    function add(event) {
+        event.preventDefault();
+        const picked = Array.from(event.target.files);
+        if (picked.length) {
+            emit('uploadToRequest', { files: picked });
+        }
+    }
+
+    return html `
+    <div class="flex flex-col items-center w-full max-w-sm">
+      <p class="my-2 text-center">
+        ${state.translate('requestUploadDescription', {
+          num: files,
+          size: bytes(size)
+        })}
+      </p>
+      ${req.sent
+        ? html `<p class="my-2 text-green-60">${state.translate('requestSent')}</p>`
+        : ''}
+      ${req.failed
+        ? html `<p class="my-2 text-red-60">${state.translate('errorPageHeader')}</p>`
+        : ''}
+      <input
+        id="request-upload"
+        class="opacity-0 w-0 h-0 appearance-none absolute overflow-hidden"
+        type="file"
+        multiple
+        onchange="${add}"
+      />
+      <label
+        for="request-upload"
+        role="button"
+        class="btn rounded-lg flex items-center mt-4"
+      >
+        ${state.translate('addFilesButton')}
+      </label>
+    </div>
+  `;
+}
+
+export default (state, emit) => {
+    const id = state.params.id;
+    let title = 'requestTitle';
+    let content;
+    if (!id) {
+        content = html `
+      <div class="flex flex-col items-center w-full">
+        <p class="max-w-md text-center text-grey-80 leading-normal dark:text-grey-40 mb-4">
+          ${state.translate('requestDescription')}
+        </p>
+        ${createForm(state, emit)}
+      </div>
+    `;
+    } else {
+        if (!state.request || state.request.id !== id) {
+            emit('loadRequest', id);
+        }
+        const own = state.storage.getRequest(id);
+        if (!own) {
+            title = 'requestUploadTitle';
+        }
+        if (state.request.loading && !state.transfer) {
+            content = html `<p class="my-4">…</p>`;
+        } else if (own) {
+            content = inbox(state, emit, own);
+        } else {
+            content = dropBox(state, emit);
+        }
+    }
+    return html `
+    <main class="main">
+      <section
+        class="flex flex-col items-center justify-center h-full w-full p-6 md:p-8 overflow-hidden md:rounded-xl md:shadow-big"
+      >
+        <h1 class="text-center text-3xl font-bold my-2">
+          ${state.translate(title)}
+        </h1>
+        ${content}
+      </section>
+    </main>
+  `;
+};
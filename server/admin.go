@@ -0,0 +1,449 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	adminPrefix    = "/admin"
+	adminAPIPrefix = "/admin/api"
+	// adminPageSize is the default and adminMaxPage the largest page of
+	// the file listing.
+	adminPageSize = 50
+	adminMaxPage  = 1000
+)
+
+// adminFile is a file as the admin API shows it.
+type adminFile struct {
+	ID        string `json:"id"`
+	Size      int64  `json:"size"`
+	Expire    int64  `json:"expire"`
+	DownLimit int    `json:"dlimit"`
+	DownCount int    `json:"dtotal"`
+	Pwd       bool   `json:"pwd"`
+	Relay     bool   `json:"relay"`
+	// Uploading is set while the content is still arriving.
+	Uploading bool `json:"uploading"`
+	// Collection is the collection an item belongs to.
+	Collection string `json:"collection,omitempty"`
+}
+
+type adminFileList struct {
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Files  []adminFile `json:"files"`
+}
+
+// adminLimits changes the limits of a file, absent fields are left alone.
+// TimeLimit counts seconds from now, a DownLimit of 0 lifts the limit.
+type adminLimits struct {
+	Down      *int `json:"dlimit"`
+	TimeLimit *int `json:"timeLimit"`
+}
+
+// auditRecord is one line of the audit log.
+type auditRecord struct {
+	Time   int64  `json:"time"`
+	Action string `json:"action"`
+	ID     string `json:"id"`
+	IP     string `json:"ip"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type blockedID struct {
+	ID   string `json:"id"`
+	Time int64  `json:"time"`
+}
+
+// blocklist holds the IDs taken down for good. Requests for them are
+// answered with 451 instead of 404.
+type blocklist struct {
+	sync.Mutex
+	// path is where the list is kept, empty keeps it in memory only.
+	path string
+	ids  map[string]int64
+}
+
+func newBlocklist(path string) (*blocklist, error) {
+	b := &blocklist{path: path, ids: make(map[string]int64)}
+	if path == "" || !isExist(path) {
+		return b, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ids []blockedID
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return nil, err
+	}
+	for _, blocked := range ids {
+		b.ids[blocked.ID] = blocked.Time
+	}
+	return b, nil
+}
+
+func (b *blocklist) has(id string) bool {
+	b.Lock()
+	defer b.Unlock()
+	_, ok := b.ids[id]
+	return ok
+}
+
+// set blocks id at the unix time at, or unblocks it for at 0.
+func (b *blocklist) set(id string, at int64) error {
+	b.Lock()
+	defer b.Unlock()
+	prev, had := b.ids[id]
+	if at == 0 {
+		delete(b.ids, id)
+	} else {
+		b.ids[id] = at
+	}
+	if err := b.save(); err != nil {
+		if had {
+			b.ids[id] = prev
+		} else {
+			delete(b.ids, id)
+		}
+		return err
+	}
+	return nil
+}
+
+// list returns the blocked IDs in order.
+func (b *blocklist) list() []blockedID {
+	b.Lock()
+	defer b.Unlock()
+	return b.sorted()
+}
+
+func (b *blocklist) sorted() []blockedID {
+	ids := make([]blockedID, 0, len(b.ids))
+	for id, at := range b.ids {
+		ids = append(ids, blockedID{id, at})
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].ID < ids[j].ID
+	})
+	return ids
+}
+
+func (b *blocklist) save() error {
+	if b.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(b.sorted())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(b.path), 0755); err != nil {
+		return err
+	}
+	tmp := b.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+// audit appends a record of an admin action to the audit log before it is
+// performed. Nothing may happen unrecorded, so the action is refused when
+// the record cannot be written.
+func (s *Server) audit(r *http.Request, action, id, detail string) error {
+	rec := auditRecord{
+		Time:   s.clock.Now().Unix(),
+		Action: action,
+		ID:     id,
+		IP:     s.clientIP(r),
+		Detail: detail,
+	}
+	line, _ := json.Marshal(rec)
+	log := s.reqLog(r)
+	log.Info("admin action", "action", action, "file", id, "detail", detail)
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(s.cfg.Admin.AuditLog), 0755); err != nil {
+		log.Err("create audit log directory", err)
+		return err
+	}
+	f, err := os.OpenFile(s.cfg.Admin.AuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Err("open audit log", err)
+		return err
+	}
+	if _, err = f.Write(append(line, '\n')); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	log.Err("write audit log", err)
+	return err
+}
+
+// adminAuthorized checks the admin token, given as a bearer token or as
+// the password of basic auth.
+func (s *Server) adminAuthorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if _, password, ok := r.BasicAuth(); ok {
+		token = password
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.Admin.Token)) == 1
+}
+
+// adminHandler serves the console and the API under /admin. Both are
+// hidden while no admin token is configured.
+func (s *Server) adminHandler(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.Admin.Token == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.adminAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"send admin\"")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if strings.HasPrefix(r.URL.Path, adminAPIPrefix+"/") {
+		s.adminAPI(w, r)
+		return
+	}
+	s.adminPage(w, r)
+}
+
+// adminAPI routes /admin/api/files[/<id>] and /admin/api/blocked[/<id>].
+func (s *Server) adminAPI(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, adminAPIPrefix+"/"), "/", 2)
+	id := ""
+	if len(parts) == 2 {
+		id = parts[1]
+	}
+	switch {
+	case parts[0] == "files" && id == "" && r.Method == http.MethodGet:
+		if s.audit(r, "list", "", r.URL.RawQuery) != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		offset, limit := pageParams(r)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(s.respBuilder(s.adminFiles(offset, limit)))
+	case parts[0] == "files" && id != "" && r.Method == http.MethodGet:
+		if s.audit(r, "view", id, "") != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		res := s.itemInfo(id)
+		if res == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(s.respBuilder(newAdminFile(id, *res)))
+	case parts[0] == "files" && id != "" && r.Method == http.MethodDelete:
+		w.WriteHeader(s.adminDelete(r, id))
+	case parts[0] == "files" && id != "" && r.Method == http.MethodPatch:
+		var limits adminLimits
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil || json.Unmarshal(body, &limits) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(s.adminUpdate(r, id, limits))
+	case parts[0] == "blocked" && id == "" && r.Method == http.MethodGet:
+		if s.audit(r, "list blocked", "", "") != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(s.respBuilder(s.blocked.list()))
+	case parts[0] == "blocked" && id != "" && r.Method == http.MethodPut:
+		w.WriteHeader(s.adminBlock(r, id))
+	case parts[0] == "blocked" && id != "" && r.Method == http.MethodDelete:
+		w.WriteHeader(s.adminUnblock(r, id))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func pageParams(r *http.Request) (int, int) {
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = adminPageSize
+	}
+	if limit > adminMaxPage {
+		limit = adminMaxPage
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return offset, limit
+}
+
+func newAdminFile(id string, item FileItem) adminFile {
+	return adminFile{
+		ID:         id,
+		Size:       item.Length,
+		Expire:     item.Expire,
+		DownLimit:  item.DownLimit,
+		DownCount:  item.DownCount,
+		Pwd:        item.Pwd,
+		Relay:      item.Relay,
+		Uploading:  item.Length == 0 && !item.Relay,
+		Collection: item.Parent,
+	}
+}
+
+// adminFiles returns a page of the files ordered by ID, so pages stay
+// stable while files come and go.
+func (s *Server) adminFiles(offset, limit int) adminFileList {
+	items := s.items()
+	ids := make([]string, 0, len(items))
+	for id := range items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	list := adminFileList{Total: len(ids), Offset: offset, Files: []adminFile{}}
+	for i := offset; i < len(ids) && i < offset+limit; i++ {
+		list.Files = append(list.Files, newAdminFile(ids[i], items[ids[i]]))
+	}
+	return list
+}
+
+// adminDelete takes a file down, a relayed one is cut off from its sender.
+func (s *Server) adminDelete(r *http.Request, id string) int {
+	item := s.itemInfo(id)
+	if item == nil {
+		return http.StatusNotFound
+	}
+	if s.audit(r, "delete", id, "") != nil {
+		return http.StatusInternalServerError
+	}
+	if err := s.takeDown(id); err != nil {
+		s.reqLog(r).Err("take down", err, "file", id)
+		return http.StatusInternalServerError
+	}
+	s.fileEvent(eventDeleted, id, *item, deletedByAdmin)
+	return http.StatusNoContent
+}
+
+func (s *Server) takeDown(id string) error {
+	if v, ok := s.relays.Get(id); ok {
+		s.dropRelay(v.(*relay))
+	}
+	return s.deleteFile(id)
+}
+
+func (s *Server) adminUpdate(r *http.Request, id string, limits adminLimits) int {
+	if limits.Down == nil && limits.TimeLimit == nil {
+		return http.StatusBadRequest
+	}
+	if (limits.Down != nil && *limits.Down < 0) || (limits.TimeLimit != nil && *limits.TimeLimit < 1) {
+		return http.StatusBadRequest
+	}
+	if s.itemInfo(id) == nil {
+		return http.StatusNotFound
+	}
+	detail, _ := json.Marshal(limits)
+	if s.audit(r, "update", id, string(detail)) != nil {
+		return http.StatusInternalServerError
+	}
+	now := s.clock.Now()
+	val, ok, err := s.updateItem(id, func(item *FileItem) {
+		if limits.Down != nil {
+			item.DownLimit = *limits.Down
+		}
+		if limits.TimeLimit != nil {
+			item.Expire = now.Add(time.Duration(*limits.TimeLimit) * time.Second).Unix()
+		}
+	})
+	if err != nil {
+		s.reqLog(r).Err("update item", err, "file", id)
+		return http.StatusInternalServerError
+	}
+	if !ok {
+		return http.StatusNotFound
+	}
+	if val.usedUp() {
+		s.scheduleExpiry(id, val)
+	}
+	if val.Collection {
+		s.syncCollection(id, val)
+	}
+	return http.StatusNoContent
+}
+
+// adminBlock takes id down if it exists and keeps it unavailable.
+func (s *Server) adminBlock(r *http.Request, id string) int {
+	if s.audit(r, "block", id, "") != nil {
+		return http.StatusInternalServerError
+	}
+	if err := s.blocked.set(id, s.clock.Now().Unix()); err != nil {
+		s.reqLog(r).Err("block", err, "file", id)
+		return http.StatusInternalServerError
+	}
+	if item := s.itemInfo(id); item != nil {
+		if err := s.takeDown(id); err != nil {
+			s.reqLog(r).Err("take down", err, "file", id)
+			return http.StatusInternalServerError
+		}
+		s.fileEvent(eventDeleted, id, *item, deletedBlocked)
+	}
+	return http.StatusNoContent
+}
+
+func (s *Server) adminUnblock(r *http.Request, id string) int {
+	if !s.blocked.has(id) {
+		return http.StatusNotFound
+	}
+	if s.audit(r, "unblock", id, "") != nil {
+		return http.StatusInternalServerError
+	}
+	if err := s.blocked.set(id, 0); err != nil {
+		s.reqLog(r).Err("unblock", err, "file", id)
+		return http.StatusInternalServerError
+	}
+	return http.StatusNoContent
+}
+
+// blockedFile answers 451 to requests for a blocked file, or for an item
+// of a blocked collection.
+func (s *Server) blockedFile(w http.ResponseWriter, r *http.Request) bool {
+	for _, prefix := range []string{"/api/download/", "/api/metadata/", "/api/exist/"} {
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			continue
+		}
+		for _, id := range strings.Split(strings.TrimPrefix(r.URL.Path, prefix), "/") {
+			blocked := s.blocked.has(id)
+			if item := s.itemInfo(id); !blocked && item != nil && item.Parent != "" {
+				blocked = s.blocked.has(item.Parent)
+			}
+			if blocked {
+				http.Error(w, "file is blocked", http.StatusUnavailableForLegalReasons)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// adminFormToken guards the console forms against cross-site requests, the
+// browser sends basic auth along with any of them.
+func (s *Server) adminFormToken() string {
+	mac := hmac.New(sha256.New, []byte(s.cfg.Admin.Token))
+	mac.Write([]byte("admin form"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
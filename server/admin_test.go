@@ -0,0 +1,90 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testAdminToken = "admin-token"
+
+func adminRequest(t *testing.T, base, method, path string) int {
+	t.Helper()
+	req, _ := http.NewRequest(method, base+path, nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestBlockedCollectionHidesItems(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	coll := addTestFile(t, s, []byte("manifest"), 0)
+	_, _, _ = s.updateItem(coll, func(item *FileItem) { item.Collection = true })
+	item := addTestFile(t, s, []byte("ciphertext"), 0)
+	_, _, _ = s.updateItem(item, func(it *FileItem) { it.Parent = coll })
+	if err := s.blocked.set(coll, s.clock.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := getDownload(t, ts.Client(), ts.URL, s, coll+"/"+item, "")
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusUnavailableForLegalReasons {
+		t.Fatalf("item of a blocked collection: status %d", resp.StatusCode)
+	}
+	resp, err := ts.Client().Get(ts.URL + "/api/exist/" + item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusUnavailableForLegalReasons {
+		t.Fatalf("existence of an item of a blocked collection: status %d", resp.StatusCode)
+	}
+}
+
+func TestAuditRecordsReads(t *testing.T) {
+	auditLog := filepath.Join(t.TempDir(), "audit.log")
+	_, ts := newTestServer(t, func(cfg *Config) {
+		cfg.Admin.Token = testAdminToken
+		cfg.Admin.AuditLog = auditLog
+	})
+	for _, path := range []string{"/admin/api/files", "/admin/api/files/0123456789abcdef", "/admin/api/blocked", "/admin"} {
+		adminRequest(t, ts.URL, http.MethodGet, path)
+	}
+	data, err := ioutil.ReadFile(auditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, action := range []string{`"list"`, `"view"`, `"list blocked"`, `"view console"`} {
+		if !strings.Contains(string(data), `"action":`+action) {
+			t.Errorf("no %s record in the audit log:\n%s", action, data)
+		}
+	}
+}
+
+func TestAuditFailureRefusesAction(t *testing.T) {
+	// a regular file where the directory of the audit log should be
+	parent := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(parent, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, ts := newTestServer(t, func(cfg *Config) {
+		cfg.Admin.Token = testAdminToken
+		cfg.Admin.AuditLog = filepath.Join(parent, "audit.log")
+	})
+	id := addTestFile(t, s, []byte("ciphertext"), 1)
+	if code := adminRequest(t, ts.URL, http.MethodDelete, "/admin/api/files/"+id); code != http.StatusInternalServerError {
+		t.Fatalf("delete without an audit log: status %d", code)
+	}
+	if s.itemInfo(id) == nil {
+		t.Fatal("file deleted although the action could not be audited")
+	}
+	if code := adminRequest(t, ts.URL, http.MethodGet, "/admin/api/files"); code != http.StatusInternalServerError {
+		t.Fatalf("list without an audit log: status %d", code)
+	}
+}
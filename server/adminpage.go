@@ -0,0 +1,170 @@
+package server
+
+import (
+	"crypto/subtle"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var adminTemplate = template.Must(template.New("admin").Funcs(template.FuncMap{
+	"time": func(unix int64) string {
+		return time.Unix(unix, 0).UTC().Format("2006-01-02 15:04 MST")
+	},
+	"size": func(n int64) string {
+		switch {
+		case n >= gigabyte:
+			return strconv.FormatFloat(float64(n)/gigabyte, 'f', 1, 64) + " GiB"
+		case n >= megabyte:
+			return strconv.FormatFloat(float64(n)/megabyte, 'f', 1, 64) + " MiB"
+		case n >= kilobyte:
+			return strconv.FormatFloat(float64(n)/kilobyte, 'f', 1, 64) + " KiB"
+		}
+		return strconv.FormatInt(n, 10) + " B"
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Send admin</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: .3em .6em; border-bottom: 1px solid #ddd; text-align: left; }
+form { display: inline; }
+input[type=number] { width: 6em; }
+.msg { color: #a00; }
+</style>
+</head>
+<body>
+<h1>Send admin</h1>
+{{if .Msg}}<p class="msg">{{.Msg}}</p>{{end}}
+<form method="post">
+<input type="hidden" name="csrf" value="{{.Form}}">
+<input type="hidden" name="offset" value="{{.List.Offset}}">
+<input name="id" placeholder="file ID" required>
+<button name="action" value="block">Block ID</button>
+<button name="action" value="unblock">Unblock ID</button>
+</form>
+<h2>Files ({{.List.Total}})</h2>
+<table>
+<tr><th>ID</th><th>Size</th><th>Expires</th><th>Downloads</th><th></th></tr>
+{{range .List.Files}}
+<tr>
+<td><code>{{.ID}}</code>{{if .Pwd}} 🔒{{end}}{{if .Relay}} relay{{end}}{{if .Uploading}} uploading{{end}}</td>
+<td>{{size .Size}}</td>
+<td>{{time .Expire}}</td>
+<td>{{.DownCount}} / {{if .DownLimit}}{{.DownLimit}}{{else}}∞{{end}}</td>
+<td>
+<form method="post">
+<input type="hidden" name="csrf" value="{{$.Form}}">
+<input type="hidden" name="offset" value="{{$.List.Offset}}">
+<input type="hidden" name="id" value="{{.ID}}">
+<input type="number" name="dlimit" min="0" placeholder="dlimit">
+<input type="number" name="hours" min="1" placeholder="hours">
+<button name="action" value="update">Set limits</button>
+<button name="action" value="delete">Delete</button>
+<button name="action" value="block">Block</button>
+</form>
+</td>
+</tr>
+{{end}}
+</table>
+<p>
+{{if .Prev}}<a href="?offset={{.PrevOffset}}">previous</a>{{end}}
+{{if .Next}}<a href="?offset={{.NextOffset}}">next</a>{{end}}
+</p>
+<h2>Blocked IDs</h2>
+<ul>
+{{range .Blocked}}<li><code>{{.ID}}</code> since {{time .Time}}</li>{{else}}<li>none</li>{{end}}
+</ul>
+</body>
+</html>
+`))
+
+type adminView struct {
+	Msg        string
+	Form       string
+	List       adminFileList
+	Blocked    []blockedID
+	Prev, Next bool
+	PrevOffset int
+	NextOffset int
+}
+
+// adminPage renders the console, its forms post back to it.
+func (s *Server) adminPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != adminPrefix {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		s.adminPageAction(w, r)
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if s.audit(r, "view console", "", r.URL.RawQuery) != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	offset, _ := pageParams(r)
+	list := s.adminFiles(offset, adminPageSize)
+	view := adminView{
+		Msg:        r.URL.Query().Get("msg"),
+		Form:       s.adminFormToken(),
+		List:       list,
+		Blocked:    s.blocked.list(),
+		Prev:       offset > 0,
+		Next:       offset+adminPageSize < list.Total,
+		PrevOffset: offset - adminPageSize,
+		NextOffset: offset + adminPageSize,
+	}
+	if view.PrevOffset < 0 {
+		view.PrevOffset = 0
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	s.reqLog(r).Err("render admin page", adminTemplate.Execute(w, view))
+}
+
+// adminPageAction performs a console form and redirects back to the page.
+func (s *Server) adminPageAction(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.PostForm.Get("csrf")), []byte(s.adminFormToken())) != 1 {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	id := r.PostForm.Get("id")
+	var status int
+	switch r.PostForm.Get("action") {
+	case "delete":
+		status = s.adminDelete(r, id)
+	case "block":
+		status = s.adminBlock(r, id)
+	case "unblock":
+		status = s.adminUnblock(r, id)
+	case "update":
+		var limits adminLimits
+		if v, err := strconv.Atoi(r.PostForm.Get("dlimit")); err == nil {
+			limits.Down = &v
+		}
+		if v, err := strconv.Atoi(r.PostForm.Get("hours")); err == nil {
+			secs := v * 3600
+			limits.TimeLimit = &secs
+		}
+		status = s.adminUpdate(r, id, limits)
+	default:
+		status = http.StatusBadRequest
+	}
+	q := url.Values{"offset": {r.PostForm.Get("offset")}}
+	q.Set("msg", r.PostForm.Get("action")+" "+id+": "+http.StatusText(status))
+	http.Redirect(w, r, adminPrefix+"?"+q.Encode(), http.StatusSeeOther)
+}
@@ -0,0 +1,42 @@
+// Command send runs a Send server configured by send.yaml, the environment
+// and flags, see server.LoadConfig.
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"send/server"
+)
+
+func main() {
+	cfg, err := server.LoadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv, err := server.New(*cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := srv.Start(); err != nil {
+		log.Fatal(err)
+	}
+	sig := waitSignal()
+	srv.Logger().Info("shutting down", "signal", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+	defer cancel()
+	srv.Logger().Err("shutdown", srv.Shutdown(ctx))
+}
+
+// waitSignal blocks until SIGINT or SIGTERM is received.
+func waitSignal() os.Signal {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-ch
+	signal.Stop(ch)
+	return sig
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const collectionPrefix = "/api/collection"
+
+// maxCollectionItems bounds the files one collection can hold.
+const maxCollectionItems = 1000
+
+var (
+	errCollectionGone  = errors.New("collection does not exist")
+	errCollectionOwner = errors.New("wrong owner token for the collection")
+	errCollectionFull  = errors.New("collection is full")
+	errCollectionKind  = errors.New("relayed uploads and uploads to a file request cannot go to a collection")
+)
+
+// A collection shares one link, owner token, expiry and download limit
+// between files that are encrypted and downloaded one by one. It is a
+// FileItem without content: its Meta is the manifest of the files, its
+// Auth and Nonce authenticate downloads of every one of them under
+// /api/download/<collection>/<item>, and its Length is their total. The
+// items copy its limits, each can be downloaded as often as the collection
+// allows, and the collection goes once all of them are used up.
+
+// joinCollection makes res, the new file fileID described by meta, an item
+// of the collection it is uploaded to.
+func (s *Server) joinCollection(fileID string, meta wsData, res *FileItem) error {
+	if meta.Relay || meta.Request != "" {
+		return errCollectionKind
+	}
+	root := s.itemInfo(meta.Collection)
+	if root == nil || !root.Collection || root.Expire < s.clock.Now().Unix() {
+		return errCollectionGone
+	}
+	if meta.OwnerToken == "" || subtle.ConstantTimeCompare([]byte(root.Token), []byte(meta.OwnerToken)) != 1 {
+		return errCollectionOwner
+	}
+	full := false
+	_, ok, err := s.updateItem(meta.Collection, func(item *FileItem) {
+		if len(item.Items) >= maxCollectionItems {
+			full = true
+			return
+		}
+		// copied, so that earlier copies of the entry keep their list
+		item.Items = append(item.Items[:len(item.Items):len(item.Items)], fileID)
+	})
+	switch {
+	case err != nil:
+		return err
+	case !ok:
+		return errCollectionGone
+	case full:
+		return errCollectionFull
+	}
+	res.Token = root.Token
+	res.Expire = root.Expire
+	res.DownLimit = root.DownLimit
+	res.Pwd = false
+	// an item is only served under its collection, which authenticates it
+	res.Auth = ""
+	res.Parent = meta.Collection
+	return nil
+}
+
+// leaveCollection takes the item id of length bytes out of the collection
+// parent.
+func (s *Server) leaveCollection(parent, id string, length int64) {
+	_, _, err := s.updateItem(parent, func(item *FileItem) {
+		items := make([]string, 0, len(item.Items))
+		for _, child := range item.Items {
+			if child != id {
+				items = append(items, child)
+			}
+		}
+		item.Items = items
+		item.Length -= length
+	})
+	s.log.Err("leave collection", err, "file", id, "collection", parent)
+}
+
+// growCollection counts an item of length bytes that completed in the
+// collection parent.
+func (s *Server) growCollection(parent string, length int64) {
+	_, _, err := s.updateItem(parent, func(item *FileItem) {
+		item.Length += length
+	})
+	s.log.Err("update collection", err, "collection", parent)
+}
+
+// syncCollection passes the limits of the collection id on to its items
+// after they changed.
+func (s *Server) syncCollection(id string, root FileItem) {
+	for _, child := range root.Items {
+		val, ok, err := s.updateItem(child, func(item *FileItem) {
+			item.Expire = root.Expire
+			item.DownLimit = root.DownLimit
+		})
+		s.log.Err("update item", err, "file", child, "collection", id)
+		if ok && val.usedUp() {
+			s.scheduleExpiry(child, val)
+		}
+	}
+}
+
+// dropItems deletes the items of a deleted collection, they share its fate
+// and are not reported one by one.
+func (s *Server) dropItems(id string, root FileItem) error {
+	var first error
+	for _, child := range root.Items {
+		item := s.itemInfo(child)
+		if item == nil {
+			continue
+		}
+		err := s.removeItem(child)
+		if err == nil {
+			s.downloads.drop(child)
+			err = s.blobs.Delete(child)
+		}
+		if err != nil {
+			s.log.Err("delete file", err, "file", child, "collection", id)
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		s.fileEvent(eventDeleted, child, *item, deletedWithCollection)
+	}
+	return first
+}
+
+// collectionUsedUp deletes the collection parent once the last of its items
+// is gone after its downloads were used up.
+func (s *Server) collectionUsedUp(parent string) {
+	root := s.itemInfo(parent)
+	if root == nil || len(root.Items) > 0 || root.Meta == "" {
+		return
+	}
+	if err := s.deleteFile(parent); err != nil {
+		s.log.Err("delete file", err, "file", parent)
+		return
+	}
+	s.fileEvent(eventDeleted, parent, *root, deletedUsedUp)
+}
+
+// downloadPath splits a download path into the file that authenticates it
+// and, for /api/download/<collection>/<item>, the item to send.
+func downloadPath(p string) (string, string) {
+	rest := strings.Trim(strings.TrimPrefix(p, "/api/download"), "/")
+	if i := strings.Index(rest, "/"); i >= 0 {
+		return rest[:i], path.Base(rest[i+1:])
+	}
+	return path.Base(p), ""
+}
+
+// collectionItem is what the listings show of an item.
+type collectionItem struct {
+	ID            string `json:"id"`
+	Size          int64  `json:"size"`
+	Complete      bool   `json:"complete"`
+	DownloadLimit int    `json:"dlimit"`
+	DownloadCount int    `json:"dtotal"`
+}
+
+// collectionItems lists the items of root, only the complete ones unless
+// all is set.
+func (s *Server) collectionItems(root FileItem, all bool) []collectionItem {
+	list := []collectionItem{}
+	for _, child := range root.Items {
+		item := s.itemInfo(child)
+		if item == nil || (!all && item.Length == 0) {
+			continue
+		}
+		list = append(list, collectionItem{
+			ID:            child,
+			Size:          item.Length,
+			Complete:      item.Length > 0,
+			DownloadLimit: item.DownLimit,
+			DownloadCount: item.DownCount,
+		})
+	}
+	return list
+}
+
+// collectionBody creates a collection, like the init frame of an upload.
+type collectionBody struct {
+	Authorization string `json:"authorization"`
+	Down          int    `json:"dlimit"`
+	TimeLimit     int    `json:"timeLimit"`
+	HasPassword   bool   `json:"has_password"`
+}
+
+// createdResponse answers the creation of a collection or a snippet.
+type createdResponse struct {
+	ID         string `json:"id"`
+	OwnerToken string `json:"ownerToken"`
+	URL        string `json:"url"`
+}
+
+type manifestBody struct {
+	Metadata string `json:"metadata"`
+}
+
+type collectionInfo struct {
+	DownloadLimit int              `json:"dlimit"`
+	Last          int64            `json:"ttl"`
+	Shared        bool             `json:"shared"`
+	Items         []collectionItem `json:"items"`
+}
+
+// collectionHandler serves /api/collection: POST creates a collection, the
+// owner lists its items with GET /<id> and shares it with POST
+// /<id>/manifest, setting the encrypted manifest of the items.
+func (s *Server) collectionHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, collectionPrefix), "/")
+	parts := strings.Split(rest, "/")
+	switch {
+	case rest == "" && r.Method == http.MethodPost:
+		s.createCollection(w, r)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		s.collectionStatus(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "manifest" && r.Method == http.MethodPost:
+		s.setManifest(w, r, parts[0])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) createCollection(w http.ResponseWriter, r *http.Request) {
+	var body collectionBody
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil || json.Unmarshal(data, &body) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if body.Down == 0 {
+		body.Down = 1
+	}
+	auth := strings.Split(body.Authorization, " ")
+	if len(auth) != 2 || auth[1] == "" ||
+		body.TimeLimit < 1 || body.TimeLimit > s.cfg.Limits.MaxExpire ||
+		body.Down < 1 || body.Down > s.cfg.Limits.MaxDownloads {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	id := randomHexStr(16)
+	root := FileItem{
+		Pwd:        body.HasPassword,
+		Auth:       auth[1],
+		Token:      randomHexStr(20),
+		Nonce:      randomByte(16),
+		Expire:     s.clock.Now().Add(time.Duration(body.TimeLimit) * time.Second).Unix(),
+		DownLimit:  body.Down,
+		Collection: true,
+	}
+	if err := s.setItem(id, root); err != nil {
+		s.reqLog(r).Err("create collection", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.reqLog(r).Info("collection created", "collection", id)
+	_, _ = w.Write(s.respBuilder(createdResponse{
+		ID:         id,
+		OwnerToken: root.Token,
+		URL:        s.fileURL(id),
+	}))
+}
+
+// ownCollection returns the collection id if r is made by its owner, and
+// answers the request otherwise.
+func (s *Server) ownCollection(w http.ResponseWriter, r *http.Request, id string) (*FileItem, bool) {
+	root := s.itemInfo(id)
+	if root == nil || !root.Collection {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	token := ownerToken(r)
+	if token == "" || subtle.ConstantTimeCompare([]byte(root.Token), []byte(token)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, false
+	}
+	return root, true
+}
+
+func (s *Server) collectionStatus(w http.ResponseWriter, r *http.Request, id string) {
+	root, ok := s.ownCollection(w, r, id)
+	if !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(s.respBuilder(collectionInfo{
+		DownloadLimit: root.DownLimit,
+		Last:          (root.Expire - s.clock.Now().Unix()) * 1000,
+		Shared:        root.Meta != "",
+		Items:         s.collectionItems(*root, true),
+	}))
+}
+
+// setManifest stores the encrypted manifest of a collection, downloaders
+// get it from /api/metadata. It can be replaced as items are added.
+func (s *Server) setManifest(w http.ResponseWriter, r *http.Request, id string) {
+	if _, ok := s.ownCollection(w, r, id); !ok {
+		return
+	}
+	var body manifestBody
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil || json.Unmarshal(data, &body) != nil || body.Metadata == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	_, ok, err := s.updateItem(id, func(item *FileItem) {
+		item.Meta = body.Metadata
+	})
+	if err != nil {
+		s.reqLog(r).Err("update item", err, "collection", id)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// addTestCollection makes a shared collection of one item and returns the
+// IDs of both.
+func addTestCollection(t *testing.T, s *Server) (string, string) {
+	t.Helper()
+	col := randomHexStr(16)
+	child := addTestFile(t, s, []byte("ciphertext"), 2)
+	if _, _, err := s.updateItem(child, func(item *FileItem) { item.Parent = col }); err != nil {
+		t.Fatal(err)
+	}
+	err := s.setItem(col, FileItem{
+		Token:      randomHexStr(20),
+		Collection: true,
+		Items:      []string{child},
+		Meta:       "manifest",
+		Expire:     s.clock.Now().Add(time.Hour).Unix(),
+		DownLimit:  2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return col, child
+}
+
+func TestDeletedCollectionReportsItems(t *testing.T) {
+	url, got := startReceiver(t, false)
+	s, ts := newTestServer(t, func(cfg *Config) {
+		cfg.Webhooks = []Webhook{{ID: "audit", URL: url, Secret: "secret"}}
+	})
+	col, child := addTestCollection(t, s)
+	events := openEvents(t, ts.Client(), ts.URL, "/api/events/"+col+"?owner_token="+s.itemInfo(col).Token)
+	if e := nextSSE(t, events); e.typ != watchStatus {
+		t.Fatalf("got %s, want %s", e.typ, watchStatus)
+	}
+
+	root := *s.itemInfo(col)
+	if err := s.deleteFile(col); err != nil {
+		t.Fatal(err)
+	}
+	s.fileEvent(eventDeleted, col, root, deletedByOwner)
+
+	e := nextSSE(t, events)
+	if e.typ != watchDeleted || e.ev.ID != col || e.ev.Item != child || e.ev.Reason != deletedWithCollection {
+		t.Fatalf("got %s of %s/%s (%s), want %s of %s/%s (%s)",
+			e.typ, e.ev.ID, e.ev.Item, e.ev.Reason, watchDeleted, col, child, deletedWithCollection)
+	}
+	e = nextSSE(t, events)
+	if e.typ != watchDeleted || e.ev.ID != col || e.ev.Item != "" {
+		t.Fatalf("got %s of %s/%s, want %s of %s", e.typ, e.ev.ID, e.ev.Item, watchDeleted, col)
+	}
+
+	// deliveries go out in parallel, so in no particular order
+	reasons := map[string]string{}
+	for i := 0; i < 2; i++ {
+		var ev Event
+		if err := json.Unmarshal(receive(t, got).body, &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.File == child && ev.Collection != col {
+			t.Fatalf("item event names collection %q, want %s", ev.Collection, col)
+		}
+		reasons[ev.File] = ev.Reason
+	}
+	if reasons[child] != deletedWithCollection || reasons[col] != deletedByOwner {
+		t.Fatalf("deleted reasons %v, want %s for the item and %s for the collection",
+			reasons, deletedWithCollection, deletedByOwner)
+	}
+}
+
+func TestCollectionItemsHaveNoAuth(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	col, _ := addTestCollection(t, s)
+	res := FileItem{Auth: testAuthKey}
+	err := s.joinCollection(randomHexStr(16), wsData{Collection: col, OwnerToken: s.itemInfo(col).Token}, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Auth != "" {
+		t.Fatalf("item auth %q, want none", res.Auth)
+	}
+}
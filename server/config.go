@@ -0,0 +1,342 @@
+package server
+
+import (
+	"flag"
+	"fmt"
+	"golang.org/x/crypto/acme/autocert"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds every tunable of the server. LoadConfig reads it from a YAML
+// file, then overrides it with environment variables and finally with
+// command-line flags. Embedders start from DefaultConfig instead.
+type Config struct {
+	Listen struct {
+		HTTP string `yaml:"http"`
+		TLS  string `yaml:"tls"`
+		// Metrics serves /metrics for Prometheus, empty disables it.
+		Metrics string `yaml:"metrics"`
+		// Challenge answers ACME HTTP-01 challenges in acme mode and
+		// redirects everything else to HTTPS, empty disables it.
+		Challenge string `yaml:"challenge"`
+	} `yaml:"listen"`
+
+	DataDir   string `yaml:"data_dir"`
+	ConfigDir string `yaml:"config_dir"`
+	DistDir   string `yaml:"dist_dir"`
+	// PublicURL is the externally visible base URL used for share links.
+	PublicURL string `yaml:"public_url"`
+
+	Limits struct {
+		UploadLimit    int64 `yaml:"upload_limit"`
+		MaxExpire      int   `yaml:"max_expire"`
+		MaxDownloads   int   `yaml:"max_downloads"`
+		MaxMessageSize int64 `yaml:"max_message_size"`
+		// SessionTimeout is how long an interrupted upload can be resumed.
+		SessionTimeout time.Duration `yaml:"session_timeout"`
+		// DailyQuota is how many bytes a client IP, and the owner of a
+		// collection or request, may receive in any 24 hours; 0 disables
+		// the quota.
+		DailyQuota int64 `yaml:"daily_quota"`
+		// MinFree is the free disk space uploads must leave, and Eviction
+		// what happens when one does not fit: "none" refuses it, "expiry"
+		// deletes the files closest to expiry to make room.
+		MinFree  int64  `yaml:"min_free"`
+		Eviction string `yaml:"eviction"`
+		// MaxSnippet bounds the ciphertext of a snippet, which is kept in
+		// the metadata journal. 0 disables snippets.
+		MaxSnippet int64 `yaml:"max_snippet"`
+		// Rate limits the requests of every client IP per route class. A
+		// zero rate disables the limit of a class.
+		Rate struct {
+			Upload   RateLimit `yaml:"upload"`
+			Download RateLimit `yaml:"download"`
+			API      RateLimit `yaml:"api"`
+		} `yaml:"rate"`
+	} `yaml:"limits"`
+
+	Pools struct {
+		Default int `yaml:"default"`
+		HTTP    int `yaml:"http"`
+	} `yaml:"pools"`
+
+	Storage struct {
+		Driver string   `yaml:"driver"`
+		S3     S3Config `yaml:"s3"`
+	} `yaml:"storage"`
+
+	TLS struct {
+		// Mode is one of cloudflare, static, acme or none.
+		Mode     string `yaml:"mode"`
+		CertFile string `yaml:"cert_file"`
+		KeyFile  string `yaml:"key_file"`
+		// ClientCA optionally requires client certificates in static mode.
+		ClientCA string `yaml:"client_ca"`
+		ACME     struct {
+			Directory string   `yaml:"directory"`
+			Email     string   `yaml:"email"`
+			Hosts     []string `yaml:"hosts"`
+			CacheDir  string   `yaml:"cache_dir"`
+			// CAFile is trusted when talking to a private ACME directory.
+			CAFile string `yaml:"ca_file"`
+		} `yaml:"acme"`
+	} `yaml:"tls"`
+
+	// Proxy restricts which peers may connect, typically to the ranges of a
+	// fronting proxy or CDN. An empty allowlist admits everybody.
+	// Forwarding headers naming the client are believed from the peers in
+	// the allowlist and in Trusted.
+	Proxy struct {
+		Allow      []string `yaml:"allow"`
+		Cloudflare bool     `yaml:"cloudflare"`
+		Trusted    []string `yaml:"trusted"`
+	} `yaml:"proxy"`
+
+	// Admin enables /admin and /admin/api for operators presenting Token.
+	// AuditLog receives one JSON line per admin action, it defaults to
+	// audit.log in the config directory.
+	Admin struct {
+		Token    string `yaml:"token"`
+		AuditLog string `yaml:"audit_log"`
+	} `yaml:"admin"`
+
+	// Webhooks receive signed JSON events about files. They are only set
+	// in the config file.
+	Webhooks []Webhook `yaml:"webhooks"`
+
+	Cloudflare struct {
+		Hostname   string `yaml:"hostname"`
+		ServiceKey string `yaml:"service_key"`
+	} `yaml:"cloudflare"`
+
+	// Log selects the level, debug, info, warn or error, and the format,
+	// logfmt or json, of the log lines.
+	Log struct {
+		Level  string `yaml:"level"`
+		Format string `yaml:"format"`
+	} `yaml:"log"`
+
+	// IndexBlock is the script block injected into index.html.
+	IndexBlock   string        `yaml:"index_block"`
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+
+	// Store, Meta and Clock replace the implementations picked from the
+	// settings above, when the server is embedded or under test. LogOutput
+	// receives the log, standard error by default.
+	Store     BlobStore `yaml:"-"`
+	Meta      MetaStore `yaml:"-"`
+	Clock     Clock     `yaml:"-"`
+	LogOutput io.Writer `yaml:"-"`
+}
+
+// DefaultConfig returns the configuration used when nothing is overridden.
+func DefaultConfig() *Config {
+	c := &Config{
+		DataDir:      "data",
+		ConfigDir:    "config",
+		DistDir:      filepath.Join(basePath, "dist"),
+		PublicURL:    "https://neko.nz",
+		DrainTimeout: 30 * time.Second,
+	}
+	c.Listen.HTTP = "127.0.0.1:32147"
+	c.Log.Level = "info"
+	c.Log.Format = "logfmt"
+	c.Listen.TLS = ":443"
+	c.Listen.Challenge = ":80"
+	c.Limits.UploadLimit = 10 * gigabyte
+	c.Limits.MaxExpire = 604800
+	c.Limits.MaxDownloads = 300
+	c.Limits.MaxMessageSize = 10 * megabyte
+	c.Limits.SessionTimeout = 30 * time.Minute
+	c.Limits.DailyQuota = 50 * gigabyte
+	c.Limits.MinFree = gigabyte
+	c.Limits.Eviction = evictNone
+	c.Limits.MaxSnippet = 64 * kilobyte
+	c.Limits.Rate.Upload = RateLimit{Rate: 0.2, Burst: 10}
+	c.Limits.Rate.Download = RateLimit{Rate: 2, Burst: 20}
+	c.Limits.Rate.API = RateLimit{Rate: 5, Burst: 50}
+	c.Pools.Default = 32768
+	c.Pools.HTTP = 10000
+	c.Storage.Driver = "fs"
+	c.TLS.Mode = tlsCloudflare
+	c.TLS.ACME.Directory = autocert.DefaultACMEDirectory
+	return c
+}
+
+// envPrefix namespaces the environment variables of the options, so that
+// unrelated variables of a host or container cannot change the config.
+const envPrefix = "SEND_"
+
+// option binds one config field to an environment variable and a flag.
+// The variable is the upper-case option name after envPrefix, the flag name
+// is the option name with dashes instead of underscores. legacy is the
+// variable read by earlier versions, used when the prefixed one is unset.
+type option struct {
+	name   string
+	legacy string
+	usage  string
+	value  interface{}
+}
+
+func (c *Config) options() []option {
+	return []option{
+		{"listen_http", "", "plain HTTP listen address", &c.Listen.HTTP},
+		{"listen_tls", "", "TLS listen address", &c.Listen.TLS},
+		{"listen_metrics", "", "Prometheus metrics listen address, empty disables", &c.Listen.Metrics},
+		{"listen_challenge", "", "ACME HTTP-01 challenge listen address in acme mode, empty disables", &c.Listen.Challenge},
+		{"data_dir", "", "directory for uploaded blobs", &c.DataDir},
+		{"config_dir", "", "directory for the metadata journal", &c.ConfigDir},
+		{"dist_dir", "", "directory of the built web client", &c.DistDir},
+		{"public_url", "", "public base URL of share links", &c.PublicURL},
+		{"upload_limit", "", "maximum upload size in bytes", &c.Limits.UploadLimit},
+		{"max_expire", "", "maximum expiry in seconds", &c.Limits.MaxExpire},
+		{"max_downloads", "", "maximum download limit", &c.Limits.MaxDownloads},
+		{"max_message_size", "", "maximum websocket message size in bytes", &c.Limits.MaxMessageSize},
+		{"session_timeout", "", "how long an interrupted upload can be resumed", &c.Limits.SessionTimeout},
+		{"daily_quota", "", "upload bytes per client IP and per owner in any 24 hours, 0 disables", &c.Limits.DailyQuota},
+		{"min_free", "", "free disk space in bytes uploads must leave", &c.Limits.MinFree},
+		{"eviction", "", "make room for uploads by deleting files: none or expiry", &c.Limits.Eviction},
+		{"max_snippet", "", "maximum ciphertext of a snippet in bytes, 0 disables snippets", &c.Limits.MaxSnippet},
+		{"rate_upload", "", "uploads started per second and client IP", &c.Limits.Rate.Upload.Rate},
+		{"rate_upload_burst", "", "burst of uploads started per client IP", &c.Limits.Rate.Upload.Burst},
+		{"rate_download", "", "download requests per second and client IP", &c.Limits.Rate.Download.Rate},
+		{"rate_download_burst", "", "burst of download requests per client IP", &c.Limits.Rate.Download.Burst},
+		{"rate_api", "", "other API requests per second and client IP", &c.Limits.Rate.API.Rate},
+		{"rate_api_burst", "", "burst of other API requests per client IP", &c.Limits.Rate.API.Burst},
+		{"pool_default", "", "size of the task pool", &c.Pools.Default},
+		{"pool_http", "", "size of the http worker pool", &c.Pools.HTTP},
+		{"storage", "", "blob storage driver: fs, memory or s3", &c.Storage.Driver},
+		{"s3_endpoint", "", "S3 endpoint URL", &c.Storage.S3.Endpoint},
+		{"s3_bucket", "", "S3 bucket", &c.Storage.S3.Bucket},
+		{"s3_region", "", "S3 region", &c.Storage.S3.Region},
+		{"s3_access_key", "", "S3 access key", &c.Storage.S3.AccessKey},
+		{"s3_secret_key", "", "S3 secret key", &c.Storage.S3.SecretKey},
+		{"s3_prefix", "", "S3 key prefix", &c.Storage.S3.Prefix},
+		{"s3_redirect", "", "redirect downloads of unlimited files to presigned S3 URLs", &c.Storage.S3.Redirect},
+		{"tls_mode", "", "tls mode: cloudflare, static, acme or none", &c.TLS.Mode},
+		{"tls_cert_file", "", "certificate file for static tls", &c.TLS.CertFile},
+		{"tls_key_file", "", "key file for static tls", &c.TLS.KeyFile},
+		{"tls_client_ca", "", "client CA bundle for static tls", &c.TLS.ClientCA},
+		{"acme_directory", "", "ACME directory URL", &c.TLS.ACME.Directory},
+		{"acme_email", "", "ACME account email", &c.TLS.ACME.Email},
+		{"acme_hosts", "", "comma separated hostnames for ACME", &c.TLS.ACME.Hosts},
+		{"acme_cache_dir", "", "directory for ACME accounts and certificates", &c.TLS.ACME.CacheDir},
+		{"acme_ca_file", "", "CA bundle trusted for the ACME directory", &c.TLS.ACME.CAFile},
+		{"proxy_allow", "", "comma separated CIDRs allowed to connect", &c.Proxy.Allow},
+		{"proxy_cloudflare", "", "also allow the published Cloudflare ranges", &c.Proxy.Cloudflare},
+		{"proxy_trusted", "", "comma separated CIDRs whose forwarding headers are believed", &c.Proxy.Trusted},
+		{"admin_token", "", "token for the admin console and API, empty disables them", &c.Admin.Token},
+		{"admin_audit_log", "", "file receiving a record of every admin action", &c.Admin.AuditLog},
+		{"cloudflare_hostname", "pub2", "hostname of the Cloudflare origin certificate", &c.Cloudflare.Hostname},
+		{"cloudflare_service_key", "service", "Cloudflare origin CA service key", &c.Cloudflare.ServiceKey},
+		{"log_level", "", "log level: debug, info, warn or error", &c.Log.Level},
+		{"log_format", "", "log format: logfmt or json", &c.Log.Format},
+		{"index_block", "pub", "script block injected into index.html", &c.IndexBlock},
+		{"drain_timeout", "", "how long to wait for downloads on shutdown", &c.DrainTimeout},
+	}
+}
+
+// LoadConfig builds the configuration from the config file, the environment
+// and the command-line arguments, in increasing order of precedence.
+func LoadConfig(args []string) (*Config, error) {
+	c := DefaultConfig()
+	opts := c.options()
+
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	file := fs.String("config", "send.yaml", "path of the YAML config file")
+	flags := make(map[string]string)
+	for _, opt := range opts {
+		fs.Var(flagRecorder{opt.name, flags}, strings.ReplaceAll(opt.name, "_", "-"), opt.usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	explicit := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			explicit = true
+		}
+	})
+	b, err := ioutil.ReadFile(*file)
+	switch {
+	case err == nil:
+		if err := yaml.UnmarshalStrict(b, c); err != nil {
+			return nil, fmt.Errorf("config %s: %v", *file, err)
+		}
+	case explicit || !os.IsNotExist(err):
+		return nil, err
+	}
+
+	for _, opt := range opts {
+		env := envPrefix + strings.ToUpper(opt.name)
+		v, ok := os.LookupEnv(env)
+		if !ok && opt.legacy != "" {
+			env = opt.legacy
+			v, ok = os.LookupEnv(env)
+		}
+		if ok {
+			if err := setOption(opt.value, v); err != nil {
+				return nil, fmt.Errorf("env %s: %v", env, err)
+			}
+		}
+	}
+	for _, opt := range opts {
+		if v, ok := flags[opt.name]; ok {
+			if err := setOption(opt.value, v); err != nil {
+				return nil, fmt.Errorf("flag -%s: %v", strings.ReplaceAll(opt.name, "_", "-"), err)
+			}
+		}
+	}
+	c.PublicURL = strings.TrimSuffix(c.PublicURL, "/")
+	return c, nil
+}
+
+// flagRecorder remembers a flag value so it can be applied after the
+// config file and the environment.
+type flagRecorder struct {
+	name  string
+	flags map[string]string
+}
+
+func (f flagRecorder) String() string { return "" }
+
+func (f flagRecorder) Set(v string) error {
+	f.flags[f.name] = v
+	return nil
+}
+
+func setOption(value interface{}, raw string) error {
+	var err error
+	switch v := value.(type) {
+	case *string:
+		*v = raw
+	case *int:
+		*v, err = strconv.Atoi(raw)
+	case *int64:
+		*v, err = strconv.ParseInt(raw, 10, 64)
+	case *float64:
+		*v, err = strconv.ParseFloat(raw, 64)
+	case *bool:
+		*v, err = strconv.ParseBool(raw)
+	case *time.Duration:
+		*v, err = time.ParseDuration(raw)
+	case *[]string:
+		*v = nil
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*v = append(*v, item)
+			}
+		}
+	default:
+		err = fmt.Errorf("unsupported option type %T", value)
+	}
+	return err
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"os"
+	"testing"
+)
+
+func setEnv(t *testing.T, key, value string) {
+	t.Helper()
+	old, had := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if had {
+			_ = os.Setenv(key, old)
+		} else {
+			_ = os.Unsetenv(key)
+		}
+	})
+}
+
+func TestEnvOverridesArePrefixed(t *testing.T) {
+	setEnv(t, "storage", "s3")
+	setEnv(t, "SEND_DATA_DIR", "/srv/send")
+	cfg, err := LoadConfig([]string{"-config", os.DevNull})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Storage.Driver != DefaultConfig().Storage.Driver {
+		t.Fatalf("bare $storage changed the driver to %q", cfg.Storage.Driver)
+	}
+	if cfg.DataDir != "/srv/send" {
+		t.Fatalf("data dir %q, want $SEND_DATA_DIR", cfg.DataDir)
+	}
+}
+
+func TestLegacyEnvStillApplies(t *testing.T) {
+	setEnv(t, "pub2", "legacy.example.com")
+	cfg, err := LoadConfig([]string{"-config", os.DevNull})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Cloudflare.Hostname != "legacy.example.com" {
+		t.Fatalf("hostname %q, want $pub2", cfg.Cloudflare.Hostname)
+	}
+	setEnv(t, "SEND_CLOUDFLARE_HOSTNAME", "new.example.com")
+	if cfg, _ = LoadConfig([]string{"-config", os.DevNull}); cfg.Cloudflare.Hostname != "new.example.com" {
+		t.Fatalf("hostname %q, want the prefixed variable to win", cfg.Cloudflare.Hostname)
+	}
+}
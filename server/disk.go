@@ -0,0 +1,181 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// Eviction policies applied when an upload does not fit above the watermark.
+const (
+	evictNone   = "none"
+	evictExpiry = "expiry"
+)
+
+var errDiskFull = errors.New("not enough free disk space")
+
+// diskState is the free space of the data directory as of the last statfs,
+// less what was written since. reserved is the space announced by uploads
+// in progress and not written yet.
+type diskState struct {
+	sync.Mutex
+	stat     tmpStat
+	known    bool
+	reserved int64
+	// evicting holds the files picked for eviction and not deleted yet,
+	// their space already counts as free.
+	evicting map[string]bool
+}
+
+func (d *diskState) update(stat tmpStat) {
+	d.Lock()
+	defer d.Unlock()
+	d.stat = stat
+	d.known = true
+}
+
+// free is the space left once every reservation is written.
+func (d *diskState) free() int64 {
+	return d.stat.Available - d.reserved
+}
+
+// reserveDisk sets aside size bytes for a new upload. It fails if that
+// would leave less than the watermark free, unless the eviction policy could
+// make room. Nothing is evicted for an announced size, only useDisk evicts
+// as the bytes are written, so an upload that is aborted costs no file.
+func (s *Server) reserveDisk(size int64) error {
+	d := &s.disk
+	d.Lock()
+	defer d.Unlock()
+	if !d.known {
+		return nil
+	}
+	need := s.cfg.Limits.MinFree + size - d.free()
+	if need > 0 && s.cfg.Limits.Eviction == evictExpiry {
+		for _, f := range s.evictionCandidates() {
+			need -= f.item.Length
+		}
+	}
+	if need > 0 {
+		return errDiskFull
+	}
+	d.reserved += size
+	return nil
+}
+
+// useDisk accounts for n written bytes, the first fromReserve of them were
+// reserved. Bytes beyond the reservation must not cross the watermark. When
+// the bytes do not fit on the disk the eviction policy makes room: victims
+// are picked under the lock and deleted after it is released, so deletions
+// do not hold up other uploads.
+func (s *Server) useDisk(n, fromReserve int64) error {
+	d := &s.disk
+	d.Lock()
+	if !d.known {
+		d.Unlock()
+		return nil
+	}
+	if extra := n - fromReserve; extra > 0 && d.free()-extra < s.cfg.Limits.MinFree {
+		d.Unlock()
+		return errDiskFull
+	}
+	need := s.cfg.Limits.MinFree + n - d.stat.Available
+	var victims []evictCandidate
+	if need > 0 && s.cfg.Limits.Eviction == evictExpiry {
+		victims = s.evictionVictims(need)
+		for _, v := range victims {
+			d.stat.Available += v.item.Length
+		}
+		need = s.cfg.Limits.MinFree + n - d.stat.Available
+	}
+	if need > 0 {
+		// not even evicting makes room, so keep the files
+		for _, v := range victims {
+			d.stat.Available -= v.item.Length
+			delete(d.evicting, v.id)
+		}
+		d.Unlock()
+		return errDiskFull
+	}
+	d.reserved -= fromReserve
+	d.stat.Available -= n
+	d.Unlock()
+	s.evict(victims)
+	return nil
+}
+
+// releaseDisk gives back the unwritten part of a reservation.
+func (s *Server) releaseDisk(size int64) {
+	d := &s.disk
+	d.Lock()
+	defer d.Unlock()
+	if d.known {
+		d.reserved -= size
+	}
+}
+
+type evictCandidate struct {
+	id   string
+	item FileItem
+}
+
+// evictionCandidates returns the complete files that can be evicted, those
+// closest to expiry first. It is called with the disk lock held.
+func (s *Server) evictionCandidates() []evictCandidate {
+	d := &s.disk
+	var files []evictCandidate
+	for id, item := range s.items() {
+		// items go with their collection, whose Length is their total, and
+		// snippets take no disk space
+		if item.Length > 0 && !item.Relay && item.Parent == "" && !item.snippet() && !d.evicting[id] {
+			files = append(files, evictCandidate{id, item})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].item.Expire < files[j].item.Expire
+	})
+	return files
+}
+
+// evictionVictims picks candidates until they add up to need bytes or none
+// are left. It is called with the disk lock held and marks them as being
+// evicted.
+func (s *Server) evictionVictims(need int64) []evictCandidate {
+	d := &s.disk
+	if d.evicting == nil {
+		d.evicting = make(map[string]bool)
+	}
+	var picked int64
+	var victims []evictCandidate
+	for _, f := range s.evictionCandidates() {
+		if picked >= need {
+			break
+		}
+		d.evicting[f.id] = true
+		picked += f.item.Length
+		victims = append(victims, f)
+	}
+	return victims
+}
+
+// evict deletes the files picked by evictionVictims. The space of those
+// that cannot be deleted no longer counts as free.
+func (s *Server) evict(victims []evictCandidate) {
+	d := &s.disk
+	for _, f := range victims {
+		err := s.deleteFile(f.id)
+		d.Lock()
+		delete(d.evicting, f.id)
+		if err != nil {
+			d.stat.Available -= f.item.Length
+		}
+		d.Unlock()
+		if err != nil {
+			s.log.Err("evict", err, "file", f.id)
+			continue
+		}
+		s.log.Info("file evicted", "file", f.id, "bytes", f.item.Length)
+		s.metrics.add(&s.metrics.evicted, 1)
+		s.fileEvent(eventDeleted, f.id, f.item, deletedEvicted)
+	}
+}
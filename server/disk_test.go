@@ -0,0 +1,99 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// slowDeleteStore holds every Delete until release is closed.
+type slowDeleteStore struct {
+	BlobStore
+	deleting chan string
+	release  chan struct{}
+}
+
+func (s *slowDeleteStore) Delete(id string) error {
+	s.deleting <- id
+	<-s.release
+	return s.BlobStore.Delete(id)
+}
+
+func newEvictionServer(t *testing.T, store BlobStore) *Server {
+	s, _ := newTestServer(t, func(cfg *Config) {
+		cfg.Store = store
+		cfg.Limits.MinFree = 100
+		cfg.Limits.Eviction = evictExpiry
+	})
+	return s
+}
+
+func TestEvictionPicksOldestFirst(t *testing.T) {
+	s := newEvictionServer(t, NewMemStore())
+	older := addTestFile(t, s, make([]byte, 50), 1)
+	newer := addTestFile(t, s, make([]byte, 50), 1)
+	_, _, _ = s.updateItem(older, func(item *FileItem) { item.Expire -= 60 })
+	s.disk.update(tmpStat{Available: 150})
+
+	if err := s.reserveDisk(100); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.useDisk(100, 100); err != nil {
+		t.Fatal(err)
+	}
+	if s.itemInfo(older) != nil || s.itemInfo(newer) == nil {
+		t.Fatal("eviction did not take the file closest to expiry")
+	}
+	// more than every file frees is refused without deleting any
+	if err := s.reserveDisk(1000); err != errDiskFull {
+		t.Fatalf("reserve beyond the disk: %v", err)
+	}
+	if s.itemInfo(newer) == nil {
+		t.Fatal("file evicted for an upload that still does not fit")
+	}
+}
+
+func TestEvictionDeletesOutsideTheLock(t *testing.T) {
+	store := &slowDeleteStore{BlobStore: NewMemStore(), deleting: make(chan string, 1), release: make(chan struct{})}
+	s := newEvictionServer(t, store)
+	id := addTestFile(t, s, make([]byte, 500), 1)
+	s.disk.update(tmpStat{Available: 1000})
+
+	if err := s.reserveDisk(1000); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.useDisk(1000, 1000) }()
+	if got := <-store.deleting; got != id {
+		t.Fatalf("deleting %s, want %s", got, id)
+	}
+	// while the victim is being deleted other uploads go on
+	small := make(chan error, 1)
+	go func() { small <- s.reserveDisk(1) }()
+	select {
+	case err := <-small:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("reservation blocked by an eviction in progress")
+	}
+	close(store.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAbortedReservationEvictsNothing(t *testing.T) {
+	s := newEvictionServer(t, NewMemStore())
+	id := addTestFile(t, s, make([]byte, 500), 1)
+	s.disk.update(tmpStat{Available: 600})
+
+	// an upload announcing more than is free, then given up unwritten
+	if err := s.reserveDisk(1000); err != nil {
+		t.Fatal(err)
+	}
+	s.releaseDisk(1000)
+	if s.itemInfo(id) == nil {
+		t.Fatal("file evicted for an upload that wrote nothing")
+	}
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// downloadSlot is a download taken from the limit of a file. It is good for
+// the size of the blob in bytes, however they are split into range requests,
+// so a download interrupted and resumed counts once and partial reads cannot
+// get around the limit. It completes once its bytes are sent.
+type downloadSlot struct {
+	val FileItem
+	// left is the number of bytes not sent or reserved by a running request.
+	left     int64
+	inflight int
+	// sent reports whether any byte of the blob went out.
+	sent bool
+	// open is false once a later request took another slot in its place.
+	open bool
+}
+
+// downloadSlots holds the open slot of every file being downloaded.
+type downloadSlots struct {
+	sync.Mutex
+	open map[string]*downloadSlot
+}
+
+// covers reports whether id has an open slot that still has bytes left, a
+// download resumed after the last one was taken.
+func (d *downloadSlots) covers(id string) bool {
+	d.Lock()
+	defer d.Unlock()
+	slot := d.open[id]
+	return slot != nil && slot.left > 0
+}
+
+// drop forgets the slot of id, whose file is gone.
+func (d *downloadSlots) drop(id string) {
+	d.Lock()
+	delete(d.open, id)
+	d.Unlock()
+}
+
+// reserveDownload sets aside need bytes of the open slot of id before they
+// are sent, taking a new slot from the limit when the open one does not have
+// them left; it fails once the downloads are used up. A nil slot means that
+// nothing needs to be counted. The bytes are settled with settleDownload.
+func (s *Server) reserveDownload(id string, size, need int64) (*downloadSlot, bool, error) {
+	d := &s.downloads
+	d.Lock()
+	slot := d.open[id]
+	if need == 0 || (slot != nil && slot.left >= need) {
+		if slot != nil {
+			slot.left -= need
+			slot.inflight++
+		}
+		d.Unlock()
+		return slot, true, nil
+	}
+	val, ok, err := s.takeDownload(id)
+	if err != nil || !ok {
+		d.Unlock()
+		return nil, false, err
+	}
+	if d.open == nil {
+		d.open = make(map[string]*downloadSlot)
+	}
+	old := slot
+	slot = &downloadSlot{val: val, left: size - need, inflight: 1, open: true}
+	d.open[id] = slot
+	ended := false
+	if old != nil {
+		old.open = false
+		ended = old.inflight == 0
+	}
+	d.Unlock()
+	if ended {
+		s.endDownload(id, old)
+	}
+	return slot, true, nil
+}
+
+// settleDownload gives back the part of the need bytes reserved in slot that
+// the response did not send, and ends the slot once it is used up or given
+// up with nothing running on it.
+func (s *Server) settleDownload(id string, slot *downloadSlot, need, sent int64) {
+	if slot == nil {
+		return
+	}
+	if sent > need {
+		sent = need
+	}
+	d := &s.downloads
+	d.Lock()
+	slot.inflight--
+	slot.left += need - sent
+	if sent > 0 {
+		slot.sent = true
+	}
+	ended := slot.inflight == 0 && (!slot.open || slot.left == 0 || !slot.sent)
+	if ended && d.open[id] == slot {
+		delete(d.open, id)
+	}
+	d.Unlock()
+	if ended {
+		s.endDownload(id, slot)
+	}
+}
+
+// endDownload reports the download of a slot, or gives it back to the
+// limit if none of its bytes were sent.
+func (s *Server) endDownload(id string, slot *downloadSlot) {
+	if !slot.sent {
+		s.releaseDownload(id)
+		return
+	}
+	s.downloaded(id, slot.val)
+}
+
+// servedLength returns how many bytes of a blob of the given size the
+// response to r sends: the single range it asks for, or the whole blob.
+func servedLength(r *http.Request, size int64) int64 {
+	rng := r.Header.Get("Range")
+	if !strings.HasPrefix(rng, "bytes=") {
+		return size
+	}
+	bounds := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(rng, "bytes=")), "-", 2)
+	if len(bounds) != 2 {
+		return size
+	}
+	first, last := strings.TrimSpace(bounds[0]), strings.TrimSpace(bounds[1])
+	if first == "" {
+		// a suffix range
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n > size {
+			return size
+		}
+		return n
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return size
+	}
+	if start >= size {
+		// answered with 416
+		return 0
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil {
+			return size
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+	if end < start {
+		return 0
+	}
+	return end - start + 1
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func downCount(t *testing.T, s *Server, id string) int {
+	t.Helper()
+	item := s.itemInfo(id)
+	if item == nil {
+		return -1
+	}
+	return item.DownCount
+}
+
+func TestMultiRangeDownloadCounts(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	data := []byte("0123456789")
+	id := addTestFile(t, s, data, 2)
+	resp := getDownload(t, ts.Client(), ts.URL, s, id, "bytes=0-0,1-")
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Fatalf("status %d, body %q, want the whole file", resp.StatusCode, body)
+	}
+	if n := downCount(t, s, id); n != 1 {
+		t.Fatalf("download count %d, want 1", n)
+	}
+}
+
+func TestRangedDownloadCountsOnce(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	id := addTestFile(t, s, []byte("0123456789"), 1)
+	for _, rng := range []string{"bytes=0-4", "bytes=5-7"} {
+		resp := getDownload(t, ts.Client(), ts.URL, s, id, rng)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent {
+			t.Fatalf("%s: status %d", rng, resp.StatusCode)
+		}
+		// taken with the first range, resuming does not take another
+		if n := downCount(t, s, id); n != 1 {
+			t.Fatalf("%s: download count %d, want 1", rng, n)
+		}
+	}
+	resp := getDownload(t, ts.Client(), ts.URL, s, id, "bytes=8-")
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("last range: status %d", resp.StatusCode)
+	}
+	if s.itemInfo(id) != nil {
+		t.Fatal("file kept after its last download")
+	}
+}
+
+func TestPartialReadsCount(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	data := []byte("0123456789")
+	id := addTestFile(t, s, data, 2)
+	rng := fmt.Sprintf("bytes=0-%d", len(data)-2)
+	for i := 0; i < 2; i++ {
+		resp := getDownload(t, ts.Client(), ts.URL, s, id, rng)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent {
+			t.Fatalf("read %d: status %d", i+1, resp.StatusCode)
+		}
+	}
+	if n := downCount(t, s, id); n != 2 {
+		t.Fatalf("download count %d after two reads of almost the whole file, want 2", n)
+	}
+	resp := getDownload(t, ts.Client(), ts.URL, s, id, rng)
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode == http.StatusPartialContent || len(body) > 1 {
+		t.Fatalf("third read past a limit of 2: status %d, %d bytes", resp.StatusCode, len(body))
+	}
+}
+
+func TestFailedDownloadIsReleased(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	id := addTestFile(t, s, []byte("0123456789"), 1)
+	resp := getDownload(t, ts.Client(), ts.URL, s, id, "bytes=20-")
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if n := downCount(t, s, id); n != 0 {
+		t.Fatalf("download count %d after a failed request", n)
+	}
+}
+
+// gatedStore holds back every Open until n of them are waiting, so that
+// concurrent downloads all pass the checks before any is sent.
+type gatedStore struct {
+	BlobStore
+	mu      sync.Mutex
+	n       int
+	arrived chan struct{}
+}
+
+func (g *gatedStore) Open(id string) (Blob, error) {
+	g.mu.Lock()
+	g.n--
+	if g.n == 0 {
+		close(g.arrived)
+	}
+	g.mu.Unlock()
+	select {
+	case <-g.arrived:
+	case <-time.After(5 * time.Second):
+	}
+	return g.BlobStore.Open(id)
+}
+
+func TestConcurrentDownloadsRespectLimit(t *testing.T) {
+	const n = 8
+	gate := &gatedStore{BlobStore: NewMemStore(), n: n, arrived: make(chan struct{})}
+	s, ts := newTestServer(t, func(cfg *Config) {
+		cfg.Store = gate
+	})
+	data := bytes.Repeat([]byte("ciphertext"), 1<<20)
+	id := addTestFile(t, s, data, 1)
+	item := s.itemInfo(id)
+	auth := "send-v1 " + b58encode(sign(item.Auth, item.Nonce))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	full := 0
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/download/"+id, nil)
+			req.Header.Set("Authorization", auth)
+			resp, err := ts.Client().Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if resp.StatusCode == http.StatusOK && len(body) == len(data) {
+				mu.Lock()
+				full++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if full != 1 {
+		t.Fatalf("%d full downloads of a file with a limit of 1", full)
+	}
+}
+
+func TestUnfinishedUploadIsNotServed(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	session, _, err := s.createUpload(wsData{
+		Authorization: "send-v1 " + testAuthKey,
+		FileMetadata:  "meta",
+		TimeLimit:     60,
+		Down:          1,
+	}, 0, "127.0.0.1", s.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen, _, err := session.attach()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.write(gen, []byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+	resp := getDownload(t, ts.Client(), ts.URL, s, session.id, "")
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status %d for an unfinished upload, want 404", resp.StatusCode)
+	}
+	if n := downCount(t, s, session.id); n != 0 {
+		t.Fatalf("download count %d, want 0", n)
+	}
+	if err := session.finish(gen); err != nil {
+		t.Fatalf("upload could not finish: %v", err)
+	}
+}
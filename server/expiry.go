@@ -0,0 +1,176 @@
+package server
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// expiryQueue orders files by the time they have to be checked, with one
+// entry per file; scheduling a file again moves its entry. Entries are only
+// hints, a file is checked against its metadata when its entry comes due.
+type expiryQueue struct {
+	sync.Mutex
+	entries expiryHeap
+	// wake interrupts the scheduler when an entry becomes the earliest.
+	wake chan struct{}
+}
+
+type expiryEntry struct {
+	id string
+	at int64
+}
+
+// expiryHeap keeps the position of every id in index, for heap.Fix.
+type expiryHeap struct {
+	list  []expiryEntry
+	index map[string]int
+}
+
+func (h expiryHeap) Len() int           { return len(h.list) }
+func (h expiryHeap) Less(i, j int) bool { return h.list[i].at < h.list[j].at }
+
+func (h expiryHeap) Swap(i, j int) {
+	h.list[i], h.list[j] = h.list[j], h.list[i]
+	h.index[h.list[i].id] = i
+	h.index[h.list[j].id] = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	e := x.(expiryEntry)
+	h.index[e.id] = len(h.list)
+	h.list = append(h.list, e)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	e := h.list[len(h.list)-1]
+	h.list = h.list[:len(h.list)-1]
+	delete(h.index, e.id)
+	return e
+}
+
+func newExpiryQueue() *expiryQueue {
+	return &expiryQueue{
+		entries: expiryHeap{index: make(map[string]int)},
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// push schedules id to be checked at the unix time at, in place of the time
+// it was scheduled for before.
+func (q *expiryQueue) push(id string, at int64) {
+	q.Lock()
+	if i, ok := q.entries.index[id]; ok {
+		q.entries.list[i].at = at
+		heap.Fix(&q.entries, i)
+	} else {
+		heap.Push(&q.entries, expiryEntry{id: id, at: at})
+	}
+	first := q.entries.list[0].id == id
+	q.Unlock()
+	if first {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// remove drops the entry of id, whose file is gone.
+func (q *expiryQueue) remove(id string) {
+	q.Lock()
+	if i, ok := q.entries.index[id]; ok {
+		heap.Remove(&q.entries, i)
+	}
+	q.Unlock()
+}
+
+// due pops every entry scheduled no later than now.
+func (q *expiryQueue) due(now int64) []string {
+	q.Lock()
+	defer q.Unlock()
+	var ids []string
+	for q.entries.Len() > 0 && q.entries.list[0].at <= now {
+		ids = append(ids, heap.Pop(&q.entries).(expiryEntry).id)
+	}
+	return ids
+}
+
+// next returns the time of the earliest entry.
+func (q *expiryQueue) next() (int64, bool) {
+	q.Lock()
+	defer q.Unlock()
+	if q.entries.Len() == 0 {
+		return 0, false
+	}
+	return q.entries.list[0].at, true
+}
+
+// usedUp reports whether every allowed download of the file happened.
+func (item FileItem) usedUp() bool {
+	return item.DownLimit != 0 && item.DownCount >= item.DownLimit
+}
+
+// scheduleExpiry queues id for deletion once item expires, or right away
+// if its downloads are used up.
+func (s *Server) scheduleExpiry(id string, item FileItem) {
+	if item.usedUp() {
+		s.expiry.push(id, s.clock.Now().Unix())
+		return
+	}
+	// a file expires once Expire lies in the past
+	s.expiry.push(id, item.Expire+1)
+}
+
+// expiryScheduler deletes files when their deadline comes. It waits with
+// the server's clock, see AfterClock.
+func (s *Server) expiryScheduler() {
+	for {
+		s.expireDue()
+		wait := time.Hour
+		if at, ok := s.expiry.next(); ok {
+			wait = time.Unix(at, 0).Sub(s.clock.Now())
+		}
+		fired, stop := s.after(wait)
+		select {
+		case <-s.done:
+			stop()
+			return
+		case <-s.expiry.wake:
+		case <-fired:
+		}
+		stop()
+	}
+}
+
+// expireDue deletes the files of every due entry that are still expired or
+// used up according to their metadata. A file still uploading is left to
+// its session, which schedules it again once the upload completes.
+func (s *Server) expireDue() {
+	now := s.clock.Now().Unix()
+	for _, id := range s.expiry.due(now) {
+		res := s.itemInfo(id)
+		if res == nil || (res.Expire >= now && !res.usedUp()) || s.uploading(id) {
+			continue
+		}
+		if res.Parent != "" && !res.usedUp() && s.files.Has(res.Parent) {
+			// it expires along with its collection
+			continue
+		}
+		if err := s.deleteFile(id); err != nil {
+			s.log.Err("expire", err, "file", id)
+			continue
+		}
+		s.log.Info("file expired", "file", id)
+		s.metrics.add(&s.metrics.expired, 1)
+		if res.usedUp() {
+			// its last download was redirected to the store
+			s.fileEvent(eventDeleted, id, *res, deletedUsedUp)
+			if res.Parent != "" {
+				s.collectionUsedUp(res.Parent)
+			}
+		} else {
+			s.fileEvent(eventExpired, id, *res, "")
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when advanced, firing the timers that came due.
+type fakeClock struct {
+	sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1600000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.Lock()
+	defer c.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), c: ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+	waiting := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiting = append(waiting, w)
+		} else {
+			w.c <- c.now
+		}
+	}
+	c.waiters = waiting
+}
+
+func TestExpiryQueueKeepsOneEntryPerFile(t *testing.T) {
+	q := newExpiryQueue()
+	for i := int64(0); i < 100; i++ {
+		q.push("a", 1000+i)
+	}
+	q.push("b", 500)
+	if n := q.entries.Len(); n != 2 {
+		t.Fatalf("%d entries for two files", n)
+	}
+	if at, _ := q.next(); at != 500 {
+		t.Fatalf("next at %d, want 500", at)
+	}
+	if ids := q.due(1098); len(ids) != 1 || ids[0] != "b" {
+		t.Fatalf("due %v, want the entry moved to 1099 to wait", ids)
+	}
+	q.push("a", 10)
+	if ids := q.due(10); len(ids) != 1 || ids[0] != "a" {
+		t.Fatalf("due %v after moving a forward", ids)
+	}
+	if q.entries.Len() != 0 || len(q.entries.index) != 0 {
+		t.Fatal("entries left after all came due")
+	}
+}
+
+func TestDeletedFileLeavesExpiryQueue(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	id := addTestFile(t, s, []byte("ciphertext"), 1)
+	other := addTestFile(t, s, []byte("ciphertext"), 1)
+	if err := s.deleteFile(id); err != nil {
+		t.Fatal(err)
+	}
+	s.expiry.Lock()
+	_, queued := s.expiry.entries.index[id]
+	_, kept := s.expiry.entries.index[other]
+	n := s.expiry.entries.Len()
+	s.expiry.Unlock()
+	if queued || !kept || n != 1 {
+		t.Fatalf("%d entries, deleted file queued %v, other file queued %v", n, queued, kept)
+	}
+}
+
+func TestExpiryFollowsClock(t *testing.T) {
+	clock := newFakeClock()
+	s, _ := newTestServer(t, func(cfg *Config) {
+		cfg.Clock = clock
+	})
+	id := addTestFile(t, s, []byte("ciphertext"), 1)
+	// the scheduler may set its timer only after a move, so keep moving
+	for i := 0; i < 100 && s.itemInfo(id) != nil; i++ {
+		clock.Advance(time.Hour)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.itemInfo(id) != nil {
+		t.Fatal("file not deleted after the clock passed its expiry")
+	}
+	if _, err := s.blobs.Stat(id); err != ErrBlobNotFound {
+		t.Fatalf("blob after expiry: %v", err)
+	}
+}
@@ -1,14 +1,17 @@
-package main
+package server
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
-	"os"
 	"path"
-	"strconv"
 	"strings"
 	"time"
 )
@@ -17,6 +20,10 @@ type metaResponse struct {
 	Metadata string `json:"metadata"`
 	Final    bool   `json:"finalDownload"`
 	TTL      int64  `json:"ttl"`
+	// Items are the complete files of a collection.
+	Items []collectionItem `json:"items,omitempty"`
+	// Data is the content of a snippet.
+	Data []byte `json:"data,omitempty"`
 }
 
 type infoResponse struct {
@@ -40,6 +47,18 @@ type authBody struct {
 	OwnerToken string `json:"owner_token"`
 }
 
+// paramsBody changes a file after upload, absent fields are left alone.
+// TimeLimit counts seconds from now. Auth replaces the authentication key:
+// it protects the file with a new password, or with HasPassword false it is
+// the key derived from the link alone and clears the password.
+type paramsBody struct {
+	OwnerToken  string  `json:"owner_token"`
+	Down        *int    `json:"dlimit"`
+	TimeLimit   *int    `json:"timeLimit"`
+	Auth        *string `json:"auth"`
+	HasPassword *bool   `json:"has_password"`
+}
+
 func ownerTokenExtractor(r *http.Request) ([]string, []string) {
 	var own ownerBody
 	body, err := ioutil.ReadAll(r.Body)
@@ -61,26 +80,32 @@ func authExtractor(r *http.Request) (string, string) {
 	if err := json.Unmarshal(body, &own); err != nil {
 		return "", ""
 	}
-	//log.Println(own)
 	return own.OwnerToken, own.Auth
 }
 
-func pwdHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) pwdHandler(w http.ResponseWriter, r *http.Request) {
 	id := path.Base(r.URL.Path)
 	token, auth := authExtractor(r)
 	if token == "" {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	if v, ok := fileMap.Get(id); ok {
-		res := v.(fileItem)
+	if v, ok := s.files.Get(id); ok {
+		res := v.(FileItem)
 		if res.Token != token {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
-		res.Auth = auth
-		res.Pwd = true
-		fileMap.Set(id, res)
+		val, _, err := s.updateItem(id, func(item *FileItem) {
+			item.Auth = auth
+			item.Pwd = true
+		})
+		if err != nil {
+			s.reqLog(r).Err("update item", err, "file", id)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		s.notify(id, watchPasswordChanged, val, 0, "")
 		w.WriteHeader(http.StatusOK)
 		return
 	} else {
@@ -88,7 +113,80 @@ func pwdHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func deleteHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) paramsHandler(w http.ResponseWriter, r *http.Request) {
+	id := path.Base(r.URL.Path)
+	var params paramsBody
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || json.Unmarshal(body, &params) != nil || params.OwnerToken == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !s.validParams(params) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	res := s.itemInfo(id)
+	if res == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if res.Token != params.OwnerToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	now := s.clock.Now()
+	val, ok, err := s.updateItem(id, func(item *FileItem) {
+		if params.Down != nil {
+			item.DownLimit = *params.Down
+		}
+		if params.TimeLimit != nil {
+			item.Expire = now.Add(time.Duration(*params.TimeLimit) * time.Second).Unix()
+		}
+		if params.Auth != nil {
+			item.Auth = *params.Auth
+			item.Pwd = params.HasPassword == nil || *params.HasPassword
+		}
+	})
+	if err != nil {
+		s.reqLog(r).Err("update item", err, "file", id)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if val.usedUp() {
+		s.scheduleExpiry(id, val)
+	}
+	if val.Collection {
+		s.syncCollection(id, val)
+	}
+	if params.Auth != nil {
+		s.notify(id, watchPasswordChanged, val, 0, "")
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// validParams checks a change against the limits uploads are held to.
+func (s *Server) validParams(params paramsBody) bool {
+	if params.Down == nil && params.TimeLimit == nil && params.Auth == nil {
+		return false
+	}
+	if params.Down != nil && (*params.Down < 1 || *params.Down > s.cfg.Limits.MaxDownloads) {
+		return false
+	}
+	if params.TimeLimit != nil && (*params.TimeLimit < 1 || *params.TimeLimit > s.cfg.Limits.MaxExpire) {
+		return false
+	}
+	if params.Auth != nil && *params.Auth == "" {
+		return false
+	}
+	// clearing the password needs the key that replaces it
+	return params.HasPassword == nil || params.Auth != nil
+}
+
+func (s *Server) deleteHandler(w http.ResponseWriter, r *http.Request) {
 	//id := path.Base(r.URL.Path)
 	id, token := ownerTokenExtractor(r)
 	if token == nil {
@@ -97,27 +195,30 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for e, item := range id {
-		if res := itemInfo(item); res != nil {
+		if res := s.itemInfo(item); res != nil {
 			if res.Token != token[e] {
 				continue
 			}
-			fileMap.Remove(item)
-			_ = os.Remove(path.Join("data", item+".bin"))
+			if err := s.deleteFile(item); err != nil {
+				s.reqLog(r).Err("delete file", err, "file", item)
+				continue
+			}
+			s.fileEvent(eventDeleted, item, *res, deletedByOwner)
 		}
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func itemInfo(id string) *fileItem {
-	if v, ok := fileMap.Get(id); ok {
-		res := v.(fileItem)
+func (s *Server) itemInfo(id string) *FileItem {
+	if v, ok := s.files.Get(id); ok {
+		res := v.(FileItem)
 		return &res
 	}
 	return nil
 }
 
-func infoHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) infoHandler(w http.ResponseWriter, r *http.Request) {
 	id, token := ownerTokenExtractor(r)
 	if token == nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -125,7 +226,7 @@ func infoHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	var result []infoResponse
 	for e, item := range id {
-		if res := itemInfo(item); res != nil {
+		if res := s.itemInfo(item); res != nil {
 			if res.Token != token[e] {
 				result = append(result, infoResponse{})
 				continue
@@ -133,7 +234,7 @@ func infoHandler(w http.ResponseWriter, r *http.Request) {
 			result = append(result, infoResponse{
 				DownloadLimit: res.DownLimit,
 				DownloadCount: res.DownCount,
-				Last:          (res.Expire - time.Now().Unix()) * 1000,
+				Last:          (res.Expire - s.clock.Now().Unix()) * 1000,
 				Exist:         true,
 			})
 		} else {
@@ -144,10 +245,10 @@ func infoHandler(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(resp)
 }
 
-func existHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) existHandler(w http.ResponseWriter, r *http.Request) {
 	id := path.Base(r.URL.Path)
-	if v, ok := fileMap.Get(id); ok {
-		res := v.(fileItem)
+	if v, ok := s.files.Get(id); ok && v.(FileItem).Parent == "" {
+		res := v.(FileItem)
 		resp, _ := json.Marshal(existResponse{false})
 		w.Header().Set("WWW-Authenticate", "send-v1 "+b58encode(res.Nonce))
 		_, _ = w.Write(resp)
@@ -157,7 +258,7 @@ func existHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func metaHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) metaHandler(w http.ResponseWriter, r *http.Request) {
 	id := path.Base(r.URL.Path)
 	authHeader := r.Header.Get("Authorization")
 	if !strings.Contains(authHeader, " ") {
@@ -165,29 +266,59 @@ func metaHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	authBlock := strings.Split(authHeader, " ")[1]
-	if v, ok := fileMap.Get(id); ok {
-		res := v.(fileItem)
+	if v, ok := s.files.Get(id); ok && v.(FileItem).Parent == "" {
+		res := v.(FileItem)
 
 		if !bytes.Equal(sign(res.Auth, res.Nonce), b58decode(authBlock)) {
-			//log.Println(res.auth, b58encode(res.nonce))
+			s.metrics.add(&s.metrics.authMetadata, 1)
 			w.Header().Set("WWW-Authenticate", "send-v1 "+b58encode(res.Nonce))
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
+		if !readsRequestFile(r, res) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
 
-		nonce := fileMap.rotateNonce(id)
+		nonce := s.rotateNonce(id)
 		w.Header().Set("WWW-Authenticate", "send-v1 "+b58encode(nonce))
-		exp := res.Expire - time.Now().Unix()
-		if exp < 0 && res.DownLimit != 0 {
+		exp := res.Expire - s.clock.Now().Unix()
+		if (exp < 0 && res.DownLimit != 0) || (res.Collection && res.Meta == "") {
+			// a collection is shared once it has a manifest
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
 		rs := metaResponse{
 			Metadata: res.Meta,
-			Final:    res.DownCount >= res.DownLimit && res.DownLimit != 0,
+			Final:    res.usedUp(),
 			TTL:      exp * 1000,
 		}
+		if res.Collection {
+			rs.Items = s.collectionItems(res, false)
+		}
+		if res.snippet() {
+			// reading a snippet is downloading it, counted before it is
+			// sent so that concurrent reads cannot exceed the limit
+			cw := &countingWriter{ResponseWriter: w}
+			defer s.metrics.download(cw)
+			w = cw
+			val, ok, err := s.takeDownload(id)
+			if err != nil {
+				s.reqLog(r).Err("count download", err, "file", id)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			s.notify(id, watchDownloadStarted, val, 0, "")
+			w.Header().Set("Cache-Control", "no-store")
+			rs.Data = val.Inline
+			rs.Final = val.usedUp()
+			defer s.downloaded(id, val)
+		}
 		resp, _ := json.Marshal(rs)
 		_, _ = w.Write(resp)
 		return
@@ -196,60 +327,251 @@ func metaHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func downloadHandler(w http.ResponseWriter, r *http.Request) {
-	id := path.Base(r.URL.Path)
+// downloadHandler sends the content of a file, or of an item of a
+// collection authenticated by the collection.
+func (s *Server) downloadHandler(w http.ResponseWriter, r *http.Request) {
+	id, itemID := downloadPath(r.URL.Path)
 	authHeader := r.Header.Get("Authorization")
 	if !strings.Contains(authHeader, " ") {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 	authBlock := strings.Split(authHeader, " ")[1]
-	if v, ok := fileMap.Get(id); ok {
-		res := v.(fileItem)
+	if v, ok := s.files.Get(id); ok && v.(FileItem).Parent == "" {
+		res := v.(FileItem)
 		if !bytes.Equal(sign(res.Auth, res.Nonce), b58decode(authBlock)) {
-			//log.Println(res.auth, b58encode(res.nonce))
+			s.metrics.add(&s.metrics.authDownload, 1)
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
-		if res.DownCount > res.DownLimit && res.DownLimit != 0 {
+		if !readsRequestFile(r, res) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		// snippets come with their metadata
+		if res.Collection != (itemID != "") || res.snippet() {
+			http.NotFound(w, r)
+			return
+		}
+		// the nonce stays the collection's, the rest is the item's
+		blobID := id
+		if res.Collection {
+			item := s.itemInfo(itemID)
+			if item == nil || item.Parent != id || item.Length == 0 {
+				http.NotFound(w, r)
+				return
+			}
+			blobID, res = itemID, *item
+		}
+		// like an item, a file is served once its upload completed, a
+		// relay has no blob to wait for
+		if res.Length == 0 && !res.Relay {
+			http.NotFound(w, r)
+			return
+		}
+		// a download taken before the last one was may still be resumed
+		if res.usedUp() && !s.downloads.covers(blobID) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		if r.Method != http.MethodHead && downloadStarts(r) {
+			s.notify(blobID, watchDownloadStarted, res, 0, "")
+		}
+		if res.Relay {
+			s.relayDownload(w, r, id)
+			return
+		}
 
-		fileMap.addDown(id)
-		fileMap.rotateNonce(id)
-		w.Header().Set("WWW-Authenticate", "send-v1 "+b58encode(res.Nonce))
+		// a presigned URL can be fetched again until it expires, so only
+		// files without a download limit leave the proxy
+		if rd, ok := s.blobs.(blobRedirector); ok && res.DownLimit == 0 {
+			if target, ok := rd.redirectURL(blobID); ok {
+				s.addDown(blobID)
+				nonce := s.rotateNonce(id)
+				w.Header().Set("WWW-Authenticate", "send-v1 "+b58encode(nonce))
+				http.Redirect(w, r, target, http.StatusFound)
+				return
+			}
+		}
+
+		info, err := s.blobs.Stat(blobID)
+		if err != nil {
+			s.reqLog(r).Err("stat blob", err, "file", blobID)
+			http.NotFound(w, r)
+			return
+		}
+		blob, err := s.blobs.Open(blobID)
+		if err != nil {
+			s.reqLog(r).Err("open blob", err, "file", blobID)
+			http.NotFound(w, r)
+			return
+		}
+		defer func() {
+			_ = blob.Close()
+		}()
+
+		// every request is charged the bytes it asks for, a multipart reply
+		// or one whose If-Range does not match gets the whole file instead
+		etag := blobETag(blobID, info)
+		if strings.Contains(r.Header.Get("Range"), ",") ||
+			(r.Header.Get("If-Range") != "" && r.Header.Get("If-Range") != etag) {
+			r.Header.Del("Range")
+		}
+		// the bytes are reserved before anything is sent, so that concurrent
+		// requests cannot exceed the limit, and given back unless sent
+		var need int64
+		if r.Method != http.MethodHead {
+			need = servedLength(r, info.Size)
+		}
+		slot, ok, err := s.reserveDownload(blobID, info.Size, need)
+		if err != nil {
+			s.reqLog(r).Err("count download", err, "file", blobID)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// every response carries the next nonce, so a client can sign the
+		// range request that resumes an interrupted download
+		nonce := s.rotateNonce(id)
+		w.Header().Set("WWW-Authenticate", "send-v1 "+b58encode(nonce))
 		w.Header().Set("Content-Type", "application/octet-stream")
-		w.Header().Set("Content-Length", strconv.FormatInt(res.Length, 10))
-		http.ServeFile(w, r, path.Join("data", id+".bin"))
+		w.Header().Set("ETag", etag)
+		cw := &countingWriter{ResponseWriter: w}
+		http.ServeContent(cw, r, "", info.ModTime, blob)
+		var sent int64
+		if cw.status == http.StatusOK || cw.status == http.StatusPartialContent {
+			sent = cw.written
+		}
+		s.settleDownload(blobID, slot, need, sent)
 		return
 	} else {
 		http.NotFound(w, r)
 	}
 }
 
-func (m *ConcurrentMap) rotateNonce(id string) []byte {
-	shard := m.GetShard(id)
-	newNonce := randomByte(16)
-	shard.Lock()
-	if v, ok := shard.items[id]; ok {
-		val := v.(fileItem)
-		val.Nonce = newNonce
-		shard.items[id] = val
+// downloadStarts reports whether r fetches a file from its beginning, the
+// requests resuming a download do not count as new ones.
+func downloadStarts(r *http.Request) bool {
+	rng := r.Header.Get("Range")
+	return rng == "" || strings.HasPrefix(rng, "bytes=0-")
+}
+
+// blobETag is a strong validator for a blob, its content never changes once
+// the upload finished.
+func blobETag(id string, info BlobInfo) string {
+	return fmt.Sprintf("\"%s-%x\"", id, info.Size)
+}
+
+// countingWriter records the status and the number of body bytes written.
+type countingWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *countingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// Hijack passes on to the underlying writer for WebSocket upgrades.
+func (w *countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// ReadFrom passes on to the underlying writer, so that ServeContent can
+// still send files with sendfile.
+func (w *countingWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(w.ResponseWriter, src)
 	}
-	shard.Unlock()
-	return newNonce
+	w.written += n
+	return n, err
 }
 
-func (m *ConcurrentMap) addDown(id string) {
-	shard := m.GetShard(id)
-	shard.Lock()
-	if v, ok := shard.items[id]; ok {
-		val := v.(fileItem)
-		val.DownCount++
-		shard.items[id] = val
+// Flush passes on to the underlying writer, relayed downloads need it.
+func (w *countingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// addDown counts a download of id, see downloaded.
+func (s *Server) addDown(id string) {
+	val, ok, err := s.updateItem(id, func(item *FileItem) {
+		item.DownCount++
+	})
+	s.log.Err("count download", err, "file", id)
+	if err != nil || !ok {
+		return
+	}
+	s.downloaded(id, val)
+}
+
+// takeDownload counts a download of id before it is sent, it fails once the
+// downloads are used up. A download that does not complete is given back
+// with releaseDownload, one that does is reported with downloaded.
+func (s *Server) takeDownload(id string) (FileItem, bool, error) {
+	taken := false
+	val, ok, err := s.updateItem(id, func(item *FileItem) {
+		if !item.usedUp() {
+			item.DownCount++
+			taken = true
+		}
+	})
+	return val, ok && taken, err
+}
+
+// releaseDownload gives back a download taken by takeDownload.
+func (s *Server) releaseDownload(id string) {
+	_, _, err := s.updateItem(id, func(item *FileItem) {
+		if item.DownCount > 0 {
+			item.DownCount--
+		}
+	})
+	s.log.Err("release download", err, "file", id)
+}
+
+// downloaded reports the download of id counted in val and deletes the
+// file after its last allowed one.
+func (s *Server) downloaded(id string, val FileItem) {
+	s.fileEvent(eventDownloaded, id, val, "")
+	if !val.usedUp() {
+		return
+	}
+	if err := s.deleteFile(id); err != nil {
+		s.log.Err("delete file", err, "file", id)
+		return
+	}
+	s.fileEvent(eventDeleted, id, val, deletedUsedUp)
+	if val.Parent != "" {
+		s.collectionUsedUp(val.Parent)
 	}
-	shard.Unlock()
 }
 
 func b58encode(a []byte) string {
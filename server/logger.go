@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level orders log lines by severity.
+type Level int
+
+// Log levels, lines below the configured one are dropped.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level called name.
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// secretFields never reach the log with their value, whatever is passed.
+var secretFields = map[string]bool{
+	"auth":          true,
+	"authorization": true,
+	"key":           true,
+	"owner_token":   true,
+	"password":      true,
+	"secret":        true,
+	"session":       true,
+	"token":         true,
+}
+
+// Logger writes one line per event: time, level, message and key/value
+// fields, as logfmt or as a JSON object. Loggers derived with With share the
+// output of their parent.
+type Logger struct {
+	out    *lockedWriter
+	json   bool
+	level  Level
+	fields []interface{}
+}
+
+type lockedWriter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+// NewLogger returns a logger writing lines of at least level to w, format
+// is logfmt or json.
+func NewLogger(w io.Writer, format string, level Level) *Logger {
+	return &Logger{out: &lockedWriter{w: w}, json: format == "json", level: level}
+}
+
+// With returns a logger adding the key/value pairs kv to every line.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(append(fields, l.fields...), kv...)
+	return &Logger{out: l.out, json: l.json, level: l.level, fields: fields}
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+// Err logs err as a failure of op, if there is one.
+func (l *Logger) Err(op string, err error, kv ...interface{}) {
+	if err == nil {
+		return
+	}
+	l.log(LevelError, op+" failed", append([]interface{}{"err", err}, kv...))
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if level < l.level {
+		return
+	}
+	var buf bytes.Buffer
+	if l.json {
+		buf.WriteByte('{')
+	}
+	l.field(&buf, "time", time.Now().UTC().Format(time.RFC3339Nano), true)
+	l.field(&buf, "level", level.String(), false)
+	l.field(&buf, "msg", msg, false)
+	for _, fields := range [][]interface{}{l.fields, kv} {
+		for i := 0; i < len(fields); i += 2 {
+			key := fmt.Sprint(fields[i])
+			var value interface{} = "!MISSING"
+			if i+1 < len(fields) {
+				value = fields[i+1]
+			}
+			if secretFields[strings.ToLower(key)] {
+				value = "[redacted]"
+			}
+			l.field(&buf, key, value, false)
+		}
+	}
+	if l.json {
+		buf.WriteByte('}')
+	}
+	buf.WriteByte('\n')
+	l.out.Lock()
+	_, _ = l.out.w.Write(buf.Bytes())
+	l.out.Unlock()
+}
+
+func (l *Logger) field(buf *bytes.Buffer, key string, value interface{}, first bool) {
+	if !first {
+		if l.json {
+			buf.WriteByte(',')
+		} else {
+			buf.WriteByte(' ')
+		}
+	}
+	if l.json {
+		buf.WriteString(strconv.Quote(key))
+		buf.WriteByte(':')
+		buf.WriteString(jsonValue(value))
+		return
+	}
+	buf.WriteString(key)
+	buf.WriteByte('=')
+	buf.WriteString(logfmtValue(value))
+}
+
+func jsonValue(value interface{}) string {
+	switch v := value.(type) {
+	case int, int64, int32, uint, uint64, uint32, float64, bool:
+		return fmt.Sprint(v)
+	case time.Duration:
+		return strconv.FormatInt(v.Milliseconds(), 10)
+	}
+	b, _ := json.Marshal(text(value))
+	return string(b)
+}
+
+func logfmtValue(value interface{}) string {
+	if d, ok := value.(time.Duration); ok {
+		return strconv.FormatInt(d.Milliseconds(), 10) + "ms"
+	}
+	s := text(value)
+	if s == "" || strings.ContainsAny(s, " =\"\\\n\t") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func text(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	}
+	return fmt.Sprint(value)
+}
+
+type logKey struct{}
+
+// withLog returns r carrying the request scoped logger l.
+func withLog(r *http.Request, l *Logger) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), logKey{}, l))
+}
+
+// reqLog returns the logger of r, it names the request and its client.
+func (s *Server) reqLog(r *http.Request) *Logger {
+	if l, ok := r.Context().Value(logKey{}).(*Logger); ok {
+		return l
+	}
+	return s.log
+}
+
+// logPath is the path of r as it may be logged, tus session tokens are
+// left out.
+func logPath(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, tusPrefix+"/") {
+		return tusPrefix + "/[redacted]"
+	}
+	return r.URL.Path
+}
@@ -0,0 +1,360 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	opSet    = "set"
+	opRemove = "del"
+
+	// compactMinRecords is the journal size below which compaction is skipped.
+	compactMinRecords = 1024
+)
+
+// MetaStore persists the file entries of a Server. Put and Delete must be
+// durable when they return, the server applies a change only afterwards.
+// Calls are serialized by the server.
+type MetaStore interface {
+	// Load calls fn for every stored entry.
+	Load(fn func(id string, item FileItem)) error
+	Put(id string, item FileItem) error
+	Delete(id string) error
+	// Compact may rewrite the store from the live entries returned by items.
+	Compact(items func() map[string]FileItem) error
+	Close() error
+}
+
+// metaStore is an append-only journal of file entry changes. Every change is
+// written and fsynced before it becomes visible, and the journal is
+// periodically rewritten as a snapshot of the live entries.
+type metaStore struct {
+	sync.Mutex
+	path    string
+	file    *os.File
+	records int
+	log     *Logger
+}
+
+type metaRecord struct {
+	Op   string    `json:"op"`
+	ID   string    `json:"id"`
+	Item *FileItem `json:"item,omitempty"`
+}
+
+// NewFileMetaStore returns a MetaStore journaling to the file at path.
+func NewFileMetaStore(path string) MetaStore {
+	return &metaStore{path: path, log: NewLogger(os.Stderr, "logfmt", LevelInfo)}
+}
+
+// setLogger makes the store log through the server's logger.
+func (s *metaStore) setLogger(log *Logger) {
+	s.log = log
+}
+
+// Load replays the journal. A torn record at the tail, left by a crash in the
+// middle of a write, is truncated away. On first start the legacy data.json
+// dump next to the journal is imported.
+func (s *metaStore) Load(fn func(id string, item FileItem)) error {
+	s.Lock()
+	defer s.Unlock()
+	dir := filepath.Dir(s.path)
+	if !isExist(dir) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	items := make(map[string]FileItem)
+	legacy := filepath.Join(dir, "data.json")
+	if !isExist(s.path) && isExist(legacy) {
+		b, err := ioutil.ReadFile(legacy)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, &items); err != nil {
+			return err
+		}
+		s.log.Info("imported legacy metadata", "entries", len(items), "path", legacy)
+		if err := s.snapshot(items); err != nil {
+			return err
+		}
+	} else {
+		file, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		valid, err := s.replay(file, items)
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+		if err := file.Truncate(valid); err != nil {
+			_ = file.Close()
+			return err
+		}
+		if _, err := file.Seek(valid, io.SeekStart); err != nil {
+			_ = file.Close()
+			return err
+		}
+		s.file = file
+	}
+	for id, item := range items {
+		fn(id, item)
+	}
+	return nil
+}
+
+// replay applies every complete record and returns the offset after the
+// last one, see replayJournal.
+func (s *metaStore) replay(r io.Reader, items map[string]FileItem) (int64, error) {
+	return replayJournal(r, "metadata", s.path, s.log, func(line []byte) error {
+		var rec metaRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return err
+		}
+		switch {
+		case rec.Op == opSet && rec.Item != nil:
+			items[rec.ID] = *rec.Item
+		case rec.Op == opRemove:
+			delete(items, rec.ID)
+		}
+		s.records++
+		return nil
+	})
+}
+
+// replayJournal hands every line of the journal at path to apply and returns
+// the offset after the last one applied. Only an unreadable last record is a
+// torn write, it is left out of the offset to be truncated away. A corrupt
+// record followed by others fails the replay: skipping it could bring back
+// something deleted, dropping the rest would lose later changes, so it is
+// left to the operator. name tells the journal apart in logs and errors.
+func replayJournal(r io.Reader, name, path string, log *Logger, apply func(line []byte) error) (int64, error) {
+	reader := bufio.NewReader(r)
+	valid := int64(0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Warn("dropped torn "+name+" record", "path", path, "offset", valid)
+			}
+			return valid, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if err := apply(line); err != nil {
+			if _, peek := reader.Peek(1); peek == io.EOF {
+				log.Warn("dropped torn "+name+" record", "path", path, "offset", valid, "err", err)
+				return valid, nil
+			}
+			return 0, fmt.Errorf("%s journal: corrupt record at offset %d of %s: %v", name, valid, path, err)
+		}
+		valid += int64(len(line))
+	}
+}
+
+func (s *metaStore) Put(id string, item FileItem) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.append(metaRecord{Op: opSet, ID: id, Item: &item})
+}
+
+func (s *metaStore) Delete(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.append(metaRecord{Op: opRemove, ID: id})
+}
+
+func (s *metaStore) append(rec metaRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.write(append(b, '\n'), 1)
+}
+
+// write appends n encoded records and syncs the journal.
+func (s *metaStore) write(b []byte, n int) error {
+	if s.file == nil {
+		return errors.New("metaStore: journal is not open")
+	}
+	if _, err := s.file.Write(b); err != nil {
+		return err
+	}
+	s.records += n
+	return s.file.Sync()
+}
+
+// Compact rewrites the journal as a snapshot of the live entries once it has
+// grown to more than twice their number.
+func (s *metaStore) Compact(items func() map[string]FileItem) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.records < compactMinRecords {
+		return nil
+	}
+	live := items()
+	if s.records < 2*len(live) {
+		return nil
+	}
+	return s.snapshot(live)
+}
+
+// snapshot atomically replaces the journal with one set record per entry.
+func (s *metaStore) snapshot(items map[string]FileItem) error {
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	records := 0
+	for id, item := range items {
+		item := item
+		b, err := json.Marshal(metaRecord{Op: opSet, ID: id, Item: &item})
+		if err == nil {
+			_, err = w.Write(append(b, '\n'))
+		}
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+		records++
+	}
+	if err := w.Flush(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		_ = file.Close()
+		return err
+	}
+	_ = syncDir(filepath.Dir(s.path))
+	if s.file != nil {
+		_ = s.file.Close()
+	}
+	s.file = file
+	s.records = records
+	return nil
+}
+
+func (s *metaStore) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// syncDir makes the entries renamed into dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// nopMetaStore keeps nothing, the entries live as long as the process.
+type nopMetaStore struct{}
+
+// NewNopMetaStore returns a MetaStore that does not persist anything, for
+// ephemeral instances and tests.
+func NewNopMetaStore() MetaStore {
+	return nopMetaStore{}
+}
+
+func (nopMetaStore) Load(func(string, FileItem)) error        { return nil }
+func (nopMetaStore) Put(string, FileItem) error               { return nil }
+func (nopMetaStore) Delete(string) error                      { return nil }
+func (nopMetaStore) Compact(func() map[string]FileItem) error { return nil }
+func (nopMetaStore) Close() error                             { return nil }
+
+// metaLogger is implemented by stores that log, the server hands them its
+// logger before Load.
+type metaLogger interface {
+	setLogger(log *Logger)
+}
+
+// setItem persists item under id and then stores it in s.files. metaMu
+// keeps the entries from changing while the journal is written, the lock of
+// the shard is only taken to store the result so reads do not wait on disk.
+func (s *Server) setItem(id string, item FileItem) error {
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	if err := s.meta.Put(id, item); err != nil {
+		return err
+	}
+	s.files.Set(id, item)
+	s.scheduleExpiry(id, item)
+	return nil
+}
+
+// updateItem applies fn to the entry under id, persists and stores the result.
+// It reports false if there is no such entry.
+func (s *Server) updateItem(id string, fn func(item *FileItem)) (FileItem, bool, error) {
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	v, ok := s.files.Get(id)
+	if !ok {
+		return FileItem{}, false, nil
+	}
+	val := v.(FileItem)
+	fn(&val)
+	if err := s.meta.Put(id, val); err != nil {
+		return v.(FileItem), true, err
+	}
+	s.files.Set(id, val)
+	if val.Expire != v.(FileItem).Expire {
+		s.scheduleExpiry(id, val)
+	}
+	return val, true, nil
+}
+
+// removeItem persists the removal of id and then drops it from s.files and
+// from the expiry queue.
+func (s *Server) removeItem(id string) error {
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	if !s.files.Has(id) {
+		return nil
+	}
+	if err := s.meta.Delete(id); err != nil {
+		return err
+	}
+	s.files.Remove(id)
+	s.expiry.remove(id)
+	return nil
+}
+
+// rotateNonce gives id a new download nonce and returns it. The nonce is
+// journaled before it is handed out, a client never holds a nonce a restart
+// would forget. It returns the old nonce if the journal fails, nil if there
+// is no such file.
+func (s *Server) rotateNonce(id string) []byte {
+	val, _, err := s.updateItem(id, func(item *FileItem) {
+		item.Nonce = randomByte(16)
+	})
+	s.log.Err("rotate nonce", err, "file", id)
+	return val.Nonce
+}
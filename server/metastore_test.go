@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func loadJournal(t *testing.T, path string) map[string]FileItem {
+	t.Helper()
+	store := NewFileMetaStore(path)
+	items := make(map[string]FileItem)
+	if err := store.Load(func(id string, item FileItem) { items[id] = item }); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return items
+}
+
+func writeJournal(t *testing.T, path string, records ...FileItem) {
+	t.Helper()
+	store := NewFileMetaStore(path)
+	if err := store.Load(func(string, FileItem) {}); err != nil {
+		t.Fatal(err)
+	}
+	for i, item := range records {
+		if err := store.Put(string(rune('a'+i)), item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func appendRaw(t *testing.T, path, raw string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(raw); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+}
+
+func TestJournalTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.log")
+	writeJournal(t, path, FileItem{Meta: "a"}, FileItem{Meta: "b"})
+	appendRaw(t, path, `{"op":"set","id":"c","item":{"me`)
+	items := loadJournal(t, path)
+	if len(items) != 2 {
+		t.Fatalf("loaded %d entries, want 2", len(items))
+	}
+	data, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(data), `"id":"c"`) {
+		t.Fatal("torn record was not truncated")
+	}
+}
+
+func TestJournalCorruptRecordFailsLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.log")
+	writeJournal(t, path, FileItem{Meta: "a"})
+	appendRaw(t, path, "{garbage\n")
+	appendRaw(t, path, `{"op":"del","id":"a"}`+"\n")
+	before, _ := ioutil.ReadFile(path)
+	store := NewFileMetaStore(path)
+	if err := store.Load(func(string, FileItem) {}); err == nil {
+		t.Fatal("journal with a corrupt record loaded")
+	}
+	_ = store.Close()
+	// the journal is left as it was for the operator
+	if after, _ := ioutil.ReadFile(path); !bytes.Equal(before, after) {
+		t.Fatal("failed load changed the journal")
+	}
+}
+
+func TestJournalLogsThroughServer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.log")
+	writeJournal(t, path, FileItem{Meta: "a"})
+	appendRaw(t, path, `{"op":"set","id":"b","item":{"me`)
+	var out syncBuffer
+	newTestServer(t, func(cfg *Config) {
+		cfg.Meta = NewFileMetaStore(path)
+		cfg.LogOutput = &out
+	})
+	if !strings.Contains(out.String(), "dropped torn metadata record") {
+		t.Fatalf("journal warning not in the server's log output: %q", out.String())
+	}
+}
+
+func TestNonceRotationIsJournaled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.log")
+	meta := NewFileMetaStore(path)
+	s, _ := newTestServer(t, func(cfg *Config) {
+		cfg.Meta = meta
+	})
+	id := addTestFile(t, s, []byte("ciphertext"), 5)
+	nonce := s.rotateNonce(id)
+	// no shutdown: the nonce must be on disk when it is handed out
+	_ = meta.Close()
+	if items := loadJournal(t, path); !bytes.Equal(items[id].Nonce, nonce) {
+		t.Fatal("journal does not hold the nonce handed out")
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// metrics counts the events exported in the Prometheus text format. Gauges,
+// like the number of files, are read from the server on every scrape.
+type metrics struct {
+	uploadsStarted    int64
+	uploadsCompleted  int64
+	uploadsAborted    int64
+	bytesIn           int64
+	bytesOut          int64
+	wsConns           int64
+	expired           int64
+	evicted           int64
+	authMetadata      int64
+	authDownload      int64
+	webhooksDelivered int64
+	webhooksFailed    int64
+
+	mu sync.Mutex
+	// downloads counts download responses by status code.
+	downloads map[int]int64
+}
+
+type sample struct {
+	labels string
+	value  int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{downloads: make(map[int]int64)}
+}
+
+func (m *metrics) add(counter *int64, n int64) {
+	atomic.AddInt64(counter, n)
+}
+
+func (m *metrics) get(counter *int64) int64 {
+	return atomic.LoadInt64(counter)
+}
+
+// download records a finished download response.
+func (m *metrics) download(w *countingWriter) {
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	m.add(&m.bytesOut, w.written)
+	m.mu.Lock()
+	m.downloads[status]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) downloadSamples() []sample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	codes := make([]int, 0, len(m.downloads))
+	for code := range m.downloads {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	samples := make([]sample, len(codes))
+	for i, code := range codes {
+		samples[i] = sample{fmt.Sprintf("code=\"%d\"", code), m.downloads[code]}
+	}
+	return samples
+}
+
+// MetricsHandler serves the metrics of the server in the Prometheus text
+// format. Start serves it on cfg.Listen.Metrics when that is set.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.writeMetrics(w)
+	})
+}
+
+func (s *Server) writeMetrics(w io.Writer) {
+	m := s.metrics
+	family(w, "send_uploads_started_total", "counter", "Uploads started, stored or relayed.",
+		sample{"", m.get(&m.uploadsStarted)})
+	family(w, "send_uploads_completed_total", "counter", "Uploads that delivered all of their content.",
+		sample{"", m.get(&m.uploadsCompleted)})
+	family(w, "send_uploads_aborted_total", "counter", "Uploads given up before completion.",
+		sample{"", m.get(&m.uploadsAborted)})
+	family(w, "send_upload_bytes_total", "counter", "Ciphertext bytes received from uploaders.",
+		sample{"", m.get(&m.bytesIn)})
+	family(w, "send_download_bytes_total", "counter", "Ciphertext bytes sent to downloaders.",
+		sample{"", m.get(&m.bytesOut)})
+	family(w, "send_downloads_total", "counter", "Download responses by status code.",
+		m.downloadSamples()...)
+	family(w, "send_websocket_connections", "gauge", "Open upload WebSocket connections.",
+		sample{"", m.get(&m.wsConns)})
+	family(w, "send_upload_sessions", "gauge", "Unfinished uploads that can be resumed.",
+		sample{"", int64(s.sessions.Count())})
+	family(w, "send_files", "gauge", "Files in the metadata store.",
+		sample{"", int64(s.files.Count())})
+
+	s.disk.Lock()
+	stat, known := s.disk.stat, s.disk.known
+	s.disk.Unlock()
+	if known {
+		family(w, "send_disk_total_bytes", "gauge", "Size of the filesystem holding the data directory.",
+			sample{"", stat.Total})
+		family(w, "send_disk_available_bytes", "gauge", "Free space of the filesystem holding the data directory.",
+			sample{"", stat.Available})
+	}
+
+	family(w, "send_pool_running_workers", "gauge", "Busy workers per pool.",
+		sample{"pool=\"default\"", int64(s.pool.Running())},
+		sample{"pool=\"http\"", int64(s.httpPool.Running())})
+	family(w, "send_pool_free_workers", "gauge", "Idle worker capacity per pool.",
+		sample{"pool=\"default\"", int64(s.pool.Free())},
+		sample{"pool=\"http\"", int64(s.httpPool.Free())})
+	family(w, "send_expired_files_total", "counter", "Files deleted by the expiry scheduler.",
+		sample{"", m.get(&m.expired)})
+	family(w, "send_evicted_files_total", "counter", "Files deleted to make room for uploads.",
+		sample{"", m.get(&m.evicted)})
+	family(w, "send_auth_failures_total", "counter", "Requests with a wrong download signature.",
+		sample{"handler=\"metadata\"", m.get(&m.authMetadata)},
+		sample{"handler=\"download\"", m.get(&m.authDownload)})
+	family(w, "send_webhook_deliveries_total", "counter", "Webhook delivery attempts by outcome.",
+		sample{"outcome=\"delivered\"", m.get(&m.webhooksDelivered)},
+		sample{"outcome=\"failed\"", m.get(&m.webhooksFailed)})
+	s.outbox.Lock()
+	pending := len(s.outbox.pending)
+	s.outbox.Unlock()
+	family(w, "send_webhook_pending", "gauge", "Webhook deliveries waiting in the outbox.",
+		sample{"", int64(pending)})
+}
+
+// family writes one metric with its help and type lines.
+func family(w io.Writer, name, kind, help string, samples ...sample) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, smp := range samples {
+		if smp.labels == "" {
+			_, _ = fmt.Fprintf(w, "%s %d\n", name, smp.value)
+		} else {
+			_, _ = fmt.Fprintf(w, "%s{%s} %d\n", name, smp.labels, smp.value)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Route classes limited separately for every client.
+const (
+	routeUpload   = "upload"
+	routeDownload = "download"
+	routeAPI      = "api"
+)
+
+// quotaSlots is the resolution of the rolling daily quota, one slot per hour.
+const quotaSlots = 24
+
+var errQuota = errors.New("daily upload quota exceeded")
+
+// RateLimit is a token bucket: Rate requests per second, up to Burst at once.
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+type bucket struct {
+	sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token, or returns how long until one is available.
+func (b *bucket) take(limit RateLimit, now time.Time) (bool, time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	b.refill(limit, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+func (b *bucket) refill(limit RateLimit, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = float64(limit.Burst)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+	}
+	b.tokens = math.Min(b.tokens, float64(limit.Burst))
+	b.last = now
+}
+
+// full reports whether the bucket refilled completely, so dropping it
+// loses nothing.
+func (b *bucket) full(limit RateLimit, now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	b.refill(limit, now)
+	return b.tokens >= float64(limit.Burst)
+}
+
+// quota counts the upload bytes of one client or owner in hourly slots.
+type quota struct {
+	sync.Mutex
+	slots [quotaSlots]struct {
+		hour  int64
+		bytes int64
+	}
+}
+
+// used returns the bytes of the last 24 hours and when the oldest of them
+// stop counting.
+func (q *quota) used(now time.Time) (int64, time.Time) {
+	q.Lock()
+	defer q.Unlock()
+	return q.usedLocked(now)
+}
+
+func (q *quota) usedLocked(now time.Time) (int64, time.Time) {
+	hour := now.Unix() / 3600
+	var total int64
+	oldest := int64(math.MaxInt64)
+	for _, slot := range q.slots {
+		if slot.bytes > 0 && slot.hour > hour-quotaSlots {
+			total += slot.bytes
+			if slot.hour < oldest {
+				oldest = slot.hour
+			}
+		}
+	}
+	if total == 0 {
+		return 0, now.Add(quotaSlots * time.Hour)
+	}
+	return total, time.Unix((oldest+quotaSlots)*3600, 0)
+}
+
+// take counts n bytes if they fit into limit, checking and counting at once
+// so that concurrent uploads cannot overshoot.
+func (q *quota) take(n, limit int64, now time.Time) bool {
+	q.Lock()
+	defer q.Unlock()
+	if used, _ := q.usedLocked(now); used+n > limit {
+		return false
+	}
+	hour := now.Unix() / 3600
+	slot := &q.slots[hour%quotaSlots]
+	if slot.hour != hour {
+		slot.hour, slot.bytes = hour, 0
+	}
+	slot.bytes += n
+	return true
+}
+
+// give takes back n bytes counted at the time at, unless their slot was
+// reused since.
+func (q *quota) give(n int64, at time.Time) {
+	q.Lock()
+	defer q.Unlock()
+	hour := at.Unix() / 3600
+	slot := &q.slots[hour%quotaSlots]
+	if slot.hour != hour {
+		return
+	}
+	slot.bytes -= n
+	if slot.bytes < 0 {
+		slot.bytes = 0
+	}
+}
+
+// routeClass returns the rate limit class of an API request, or "" for
+// requests that are not limited.
+func routeClass(r *http.Request) string {
+	p := r.URL.Path
+	switch {
+	case p == "/api/ws", strings.TrimSuffix(p, "/") == tusPrefix && r.Method == http.MethodPost,
+		p == snippetPrefix && r.Method == http.MethodPost:
+		return routeUpload
+	case strings.HasPrefix(p, "/api/download"), strings.HasPrefix(p, "/api/metadata"):
+		return routeDownload
+	case strings.HasPrefix(p, "/api"), p == adminPrefix, strings.HasPrefix(p, adminPrefix+"/"):
+		return routeAPI
+	}
+	return ""
+}
+
+func (s *Server) rateLimit(class string) RateLimit {
+	switch class {
+	case routeUpload:
+		return s.cfg.Limits.Rate.Upload
+	case routeDownload:
+		return s.cfg.Limits.Rate.Download
+	case routeAPI:
+		return s.cfg.Limits.Rate.API
+	}
+	return RateLimit{}
+}
+
+// allowRequest takes a token for the client of r, and one for the owner
+// whose token r carries. When either is out of tokens it answers 429 and
+// reports false.
+func (s *Server) allowRequest(w http.ResponseWriter, r *http.Request) bool {
+	class := routeClass(r)
+	limit := s.rateLimit(class)
+	if limit.Rate <= 0 {
+		return true
+	}
+	keys := []string{class + " " + s.clientIP(r)}
+	if owner := requestOwner(r); owner != "" {
+		keys = append(keys, class+" owner "+owner)
+	}
+	now := s.clock.Now()
+	for _, key := range keys {
+		v := s.buckets.Upsert(key, nil, func(exist bool, valueInMap interface{}, newValue interface{}) interface{} {
+			if exist {
+				return valueInMap
+			}
+			return &bucket{}
+		})
+		if ok, wait := v.(*bucket).take(limit, now); !ok {
+			tooMany(w, wait, "rate limit exceeded")
+			return false
+		}
+	}
+	return true
+}
+
+// maxOwnerBody bounds the request bodies searched for an owner token.
+const maxOwnerBody = 64 * kilobyte
+
+// requestOwner identifies the owner whose token r carries, as a Bearer
+// token, in the query or in the owner_token field of a small JSON body. The
+// token is not checked, an owner's bucket only limits further. "" if there
+// is none.
+func requestOwner(r *http.Request) string {
+	token := r.URL.Query().Get("owner_token")
+	if auth := r.Header.Get("Authorization"); token == "" && strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token == "" && r.Method == http.MethodPost && r.ContentLength > 0 && r.ContentLength <= maxOwnerBody {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxOwnerBody))
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err == nil {
+			field := json.Get(body, "owner_token")
+			if field.ValueType() == jsoniter.ArrayValue {
+				field = field.Get(0)
+			}
+			token = field.ToString()
+		}
+	}
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// uploadOwner is the file whose owner an upload described by meta goes to,
+// a collection or a request, or "".
+func uploadOwner(meta wsData) string {
+	if meta.Collection != "" {
+		return meta.Collection
+	}
+	return meta.Request
+}
+
+// quotaKeys names the quotas an upload of ip counts against: the client's,
+// and the owner's when it goes into the collection or request owner.
+func quotaKeys(ip, owner string) []string {
+	keys := []string{ip}
+	if owner != "" {
+		keys = append(keys, "owner "+owner)
+	}
+	return keys
+}
+
+// checkQuota answers 429 and reports false if the quotas of keys cannot
+// take size more bytes today. It does not count them, see takeQuota.
+func (s *Server) checkQuota(w http.ResponseWriter, keys []string, size int64) bool {
+	if s.cfg.Limits.DailyQuota <= 0 {
+		return true
+	}
+	if size > s.cfg.Limits.DailyQuota {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return false
+	}
+	now := s.clock.Now()
+	for _, key := range keys {
+		used, _ := s.quota(key).used(now)
+		if used+size > s.cfg.Limits.DailyQuota || used >= s.cfg.Limits.DailyQuota {
+			s.quotaExceeded(w, keys)
+			return false
+		}
+	}
+	return true
+}
+
+// quotaExceeded answers 429 with the time until part of the quotas of keys
+// frees up.
+func (s *Server) quotaExceeded(w http.ResponseWriter, keys []string) {
+	now := s.clock.Now()
+	var wait time.Duration
+	for _, key := range keys {
+		if _, until := s.quota(key).used(now); until.Sub(now) > wait {
+			wait = until.Sub(now)
+		}
+	}
+	tooMany(w, wait, errQuota.Error())
+}
+
+// takeQuota counts n uploaded bytes against every quota of keys, or against
+// none if one of them is used up. It returns the time they were counted at,
+// for releaseQuota.
+func (s *Server) takeQuota(keys []string, n int64) (time.Time, error) {
+	now := s.clock.Now()
+	if s.cfg.Limits.DailyQuota <= 0 || n <= 0 {
+		return now, nil
+	}
+	for i, key := range keys {
+		if key == "" {
+			continue
+		}
+		if !s.quota(key).take(n, s.cfg.Limits.DailyQuota, now) {
+			s.releaseQuota(keys[:i], n, now)
+			return now, errQuota
+		}
+	}
+	return now, nil
+}
+
+// releaseQuota gives back n bytes taken at the time at, e.g. the unused
+// part of the size an aborted upload announced.
+func (s *Server) releaseQuota(keys []string, n int64, at time.Time) {
+	if s.cfg.Limits.DailyQuota <= 0 || n <= 0 {
+		return
+	}
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		s.quota(key).give(n, at)
+	}
+}
+
+func (s *Server) quota(key string) *quota {
+	v := s.quotas.Upsert(key, nil, func(exist bool, valueInMap interface{}, newValue interface{}) interface{} {
+		if exist {
+			return valueInMap
+		}
+		return &quota{}
+	})
+	return v.(*quota)
+}
+
+func tooMany(w http.ResponseWriter, wait time.Duration, msg string) {
+	secs := int64(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	http.Error(w, msg, http.StatusTooManyRequests)
+}
+
+// limiterSweeper drops the buckets and quotas of clients that went quiet.
+func (s *Server) limiterSweeper() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			now := s.clock.Now()
+			for _, key := range s.buckets.Keys() {
+				s.buckets.RemoveCb(key, func(key string, v interface{}, exists bool) bool {
+					return exists && v.(*bucket).full(s.rateLimit(strings.SplitN(key, " ", 2)[0]), now)
+				})
+			}
+			for _, key := range s.quotas.Keys() {
+				s.quotas.RemoveCb(key, func(key string, v interface{}, exists bool) bool {
+					used, _ := v.(*quota).used(now)
+					return exists && used == 0
+				})
+			}
+		}
+	}
+}
+
+// clientIP returns the address of the client behind r. Forwarding headers
+// are only believed from trusted proxies: CF-Connecting-IP, otherwise the
+// last X-Forwarded-For entry that is not a trusted proxy itself.
+func (s *Server) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !s.trustedProxy(net.ParseIP(host)) {
+		return host
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("CF-Connecting-IP"))); ip != nil {
+		return ip.String()
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		host = ip.String()
+		if !s.trustedProxy(ip) {
+			break
+		}
+	}
+	return host
+}
+
+// trustedProxy reports whether ip is in the allowlist or proxy.trusted.
+func (s *Server) trustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, set := range [][]*net.IPNet{s.allow, s.trusted} {
+		for _, network := range set {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
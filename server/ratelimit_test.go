@@ -0,0 +1,158 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQuotaTakeIsAtomic(t *testing.T) {
+	var q quota
+	now := time.Now()
+	var taken int32
+	var wg sync.WaitGroup
+	for i := 0; i < 500; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if q.take(1, 100, now) {
+				atomic.AddInt32(&taken, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if taken != 100 {
+		t.Fatalf("%d bytes taken from a quota of 100", taken)
+	}
+}
+
+func TestOwnerQuota(t *testing.T) {
+	s, _ := newTestServer(t, func(cfg *Config) {
+		cfg.Limits.DailyQuota = 1000
+	})
+	if _, err := s.takeQuota(quotaKeys("192.0.2.1", "owner"), 600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.takeQuota(quotaKeys("192.0.2.2", "owner"), 600); err != errQuota {
+		t.Fatalf("second client of the owner: %v, want errQuota", err)
+	}
+	// the refused upload left nothing on the quota of its client
+	if used, _ := s.quota("192.0.2.2").used(s.clock.Now()); used != 0 {
+		t.Fatalf("%d bytes counted for a refused upload", used)
+	}
+	if _, err := s.takeQuota(quotaKeys("192.0.2.2", ""), 600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAbortReleasesQuota(t *testing.T) {
+	s, _ := newTestServer(t, func(cfg *Config) {
+		cfg.Limits.DailyQuota = 1000
+	})
+	meta := wsData{
+		Authorization: "send-v1 key",
+		FileMetadata:  "meta",
+		TimeLimit:     60,
+		Down:          1,
+	}
+	session, _, err := s.createUpload(meta, 600, "192.0.2.1", s.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.createUpload(meta, 600, "192.0.2.1", s.log); err != errQuota {
+		t.Fatalf("upload over the quota: %v, want errQuota", err)
+	}
+	gen, _, _ := session.attach()
+	if err := session.write(gen, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	session.abort()
+	if used, _ := s.quota("192.0.2.1").used(s.clock.Now()); used != 100 {
+		t.Fatalf("%d bytes counted after the abort, want the 100 written", used)
+	}
+	if _, _, err := s.createUpload(meta, 600, "192.0.2.1", s.log); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOwnerRateLimit(t *testing.T) {
+	_, ts := newTestServer(t, func(cfg *Config) {
+		cfg.Proxy.Trusted = []string{"127.0.0.1/32"}
+		cfg.Limits.Rate.API = RateLimit{Rate: 0.001, Burst: 2}
+	})
+	get := func(ip, token string) int {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/exists/0123456789abcdef", nil)
+		req.Header.Set("X-Forwarded-For", ip)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	for i := 1; i <= 3; i++ {
+		if code := get("192.0.2."+strings.Repeat("1", i), ""); code == http.StatusTooManyRequests {
+			t.Fatalf("client %d without an owner token limited", i)
+		}
+	}
+	for i := 1; i <= 2; i++ {
+		if code := get("198.51.100."+strings.Repeat("1", i), "token"); code == http.StatusTooManyRequests {
+			t.Fatalf("request %d of the owner limited", i)
+		}
+	}
+	if code := get("198.51.100.111", "token"); code != http.StatusTooManyRequests {
+		t.Fatalf("third request of the owner from a new client: %d, want 429", code)
+	}
+}
+
+func TestRequestOwnerFromBody(t *testing.T) {
+	for body, want := range map[string]bool{
+		`{"owner_token": "abc"}`:                true,
+		`{"id": ["x"], "owner_token": ["abc"]}`: true,
+		`{"auth": "x"}`:                         false,
+		`not json`:                              false,
+	} {
+		r, _ := http.NewRequest(http.MethodPost, "/api/params/x", strings.NewReader(body))
+		if got := requestOwner(r) != ""; got != want {
+			t.Errorf("%s: owner found %v", body, got)
+		}
+		rest := make([]byte, len(body))
+		if n, _ := r.Body.Read(rest); string(rest[:n]) != body {
+			t.Errorf("%s: body not restored, read %q", body, rest[:n])
+		}
+	}
+	r, _ := http.NewRequest(http.MethodGet, "/api/download/x", nil)
+	r.Header.Set("Authorization", "send-v1 sig")
+	if requestOwner(r) != "" {
+		t.Error("download authentication taken for an owner token")
+	}
+}
+
+func TestCloudflareModeTrustsEdges(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	r := httptest.NewRequest(http.MethodGet, "/api/info/x", nil)
+	r.RemoteAddr = "162.158.1.2:443"
+	r.Header.Set("CF-Connecting-IP", "203.0.113.7")
+	if ip := s.clientIP(r); ip != "203.0.113.7" {
+		t.Fatalf("client %s behind a Cloudflare edge, want 203.0.113.7", ip)
+	}
+	r.RemoteAddr = "198.51.100.1:443"
+	if ip := s.clientIP(r); ip != "198.51.100.1" {
+		t.Fatalf("client %s from an untrusted peer, want the peer", ip)
+	}
+
+	s, _ = newTestServer(t, func(cfg *Config) {
+		cfg.TLS.Mode = tlsNone
+	})
+	r.RemoteAddr = "162.158.1.2:443"
+	if ip := s.clientIP(r); ip != "162.158.1.2" {
+		t.Fatalf("client %s without cloudflare mode, want the peer", ip)
+	}
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// relayBuffer bounds the bytes of a relayed transfer buffered between
+// sender and receiver. Once it is full the sender's socket is no longer
+// read, so a slow receiver slows the sender down. Frames of a relay are
+// limited to relayMessageSize, which also bounds what waits in the read
+// channel of the sender's connection.
+const (
+	relayBuffer      = 4 * megabyte
+	relayMessageSize = megabyte
+	relayFrames      = 64
+)
+
+var (
+	errRelayReceiver = errors.New("receiver disconnected")
+	errRelaySender   = errors.New("sender disconnected")
+)
+
+// relay connects the sender of a relayed file to its one receiver.
+type relay struct {
+	id     string
+	frames chan []byte
+	// attached is closed when the receiver claims the transfer, gone when
+	// the sender is no longer feeding it.
+	attached chan struct{}
+	gone     chan struct{}
+	claimed  sync.Once
+	canceled sync.Once
+	// done carries the outcome of the receiving side.
+	done chan error
+
+	// buffered counts the bytes in frames, drained signals that the
+	// receiver took some.
+	mu       sync.Mutex
+	buffered int
+	drained  chan struct{}
+}
+
+func newRelay(id string) *relay {
+	return &relay{
+		id:       id,
+		frames:   make(chan []byte, relayFrames),
+		attached: make(chan struct{}),
+		gone:     make(chan struct{}),
+		done:     make(chan error, 1),
+		drained:  make(chan struct{}, 1),
+	}
+}
+
+// reserve makes room for a frame of n bytes in the buffer, it reports false
+// while the buffer is too full. A frame always fits into an empty buffer.
+func (r *relay) reserve(n int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.buffered > 0 && r.buffered+n > relayBuffer {
+		return false
+	}
+	r.buffered += n
+	return true
+}
+
+// release frees the room of a frame the receiver took.
+func (r *relay) release(n int) {
+	r.mu.Lock()
+	r.buffered -= n
+	r.mu.Unlock()
+	select {
+	case r.drained <- struct{}{}:
+	default:
+	}
+}
+
+// attach claims the transfer for a receiver, it reports false if there
+// already is one.
+func (r *relay) attach() bool {
+	ok := false
+	r.claimed.Do(func() {
+		close(r.attached)
+		ok = true
+	})
+	return ok
+}
+
+func (r *relay) cancel() {
+	r.canceled.Do(func() {
+		close(r.gone)
+	})
+}
+
+// startRelay registers a relayed file and starts forwarding the frames the
+// client sends to its receiver. It reports false if the relay could not be
+// set up; the client got an error response then.
+func (c *wsClient) startRelay(meta wsData) bool {
+	s := c.srv
+	id, res, err := s.createFile(meta)
+	if err != nil {
+		c.log.Warn("relay refused", "err", err)
+		c.channel.write <- c.srv.respBuilder(errorResponse{Error: err.Error()})
+		return false
+	}
+	r := newRelay(id)
+	s.relays.Set(id, r)
+	s.metrics.add(&s.metrics.uploadsStarted, 1)
+	c.channel.write <- c.srv.respBuilder(initResponse{
+		ID:         id,
+		OwnerToken: res.Token,
+		URL:        s.fileURL(id),
+	})
+	log := c.log.With("file", id)
+	log.Info("relay started")
+	if err := s.pool.Submit(func() { c.relayHandler(r, log) }); err != nil {
+		log.Err("submit relay handler", err)
+		s.dropRelay(r)
+		return false
+	}
+	return true
+}
+
+func (s *Server) dropRelay(r *relay) {
+	r.cancel()
+	s.relays.Remove(r.id)
+	s.log.Err("remove item", s.removeItem(r.id), "file", r.id)
+}
+
+// relayHandler passes the frames of the sender on to the receiver. The
+// sender is told {"attached": true} once a receiver connected and
+// {"ok": true} after the receiver got the end of the transfer.
+func (c *wsClient) relayHandler(r *relay, log *Logger) {
+	s := c.srv
+	finished := false
+	var received int64
+	defer func() {
+		if finished {
+			s.metrics.add(&s.metrics.uploadsCompleted, 1)
+			log.Info("relay finished", "bytes", received)
+			if item := s.itemInfo(r.id); item != nil {
+				item.Length = received
+				s.fileEvent(eventUploaded, r.id, *item, "")
+				s.fileEvent(eventDownloaded, r.id, *item, "")
+			}
+		} else {
+			s.metrics.add(&s.metrics.uploadsAborted, 1)
+			log.Warn("relay aborted", "bytes", received)
+		}
+		s.dropRelay(r)
+		c.channel.close <- struct{}{}
+		s.uploads.done()
+	}()
+	attached := r.attached
+	var pending []byte
+	reserved := false
+	for {
+		var frames chan []byte
+		var drained chan struct{}
+		read := c.channel.read
+		if pending != nil {
+			// hold back further frames until this one is buffered
+			read = nil
+			if !reserved {
+				reserved = r.reserve(len(pending))
+			}
+			if reserved {
+				frames = r.frames
+			} else {
+				drained = r.drained
+			}
+		}
+		select {
+		case <-c.channel.close:
+			return
+		case <-s.abortUploads:
+			c.channel.write <- c.srv.respBuilder(errorResponse{Error: "server is shutting down"})
+			return
+		case <-attached:
+			attached = nil
+			log.Debug("relay receiver attached")
+			c.channel.write <- []byte("{\"attached\": true}")
+		case err := <-r.done:
+			// the receiver can only finish early by failing
+			c.channel.write <- c.srv.respBuilder(errorResponse{Error: err.Error()})
+			return
+		case <-drained:
+		case frames <- pending:
+			pending, reserved = nil, false
+			// time blocked on the receiver does not count against the peer
+			log.Err("ws set read deadline", c.conn.SetReadDeadline(time.Now().Add(pongWait)))
+		case msg, ok := <-read:
+			if !ok {
+				return
+			}
+			if msg[0] == 0 && len(msg) == 1 {
+				close(r.frames)
+				finished = c.finishRelay(r)
+				return
+			}
+			pending = msg
+			received += int64(len(msg))
+			s.metrics.add(&s.metrics.bytesIn, int64(len(msg)))
+		}
+	}
+}
+
+// finishRelay waits until the receiver got every frame and reports
+// whether it did.
+func (c *wsClient) finishRelay(r *relay) bool {
+	select {
+	case <-c.channel.close:
+	case <-c.srv.abortUploads:
+	case err := <-r.done:
+		if err != nil {
+			c.channel.write <- c.srv.respBuilder(errorResponse{Error: err.Error()})
+			return false
+		}
+		c.channel.write <- []byte("{\"ok\": true}")
+		return true
+	}
+	return false
+}
+
+// relayDownload streams a relayed file to its receiver as the sender
+// uploads it. There is no length and no range support, the response is
+// aborted if the sender goes away.
+func (s *Server) relayDownload(w http.ResponseWriter, r *http.Request, id string) {
+	v, ok := s.relays.Get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	rl := v.(*relay)
+	nonce := s.rotateNonce(id)
+	w.Header().Set("WWW-Authenticate", "send-v1 "+b58encode(nonce))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if !rl.attach() {
+		http.Error(w, "transfer already has a receiver", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	for {
+		select {
+		case p, ok := <-rl.frames:
+			if !ok {
+				rl.done <- nil
+				return
+			}
+			_, err := w.Write(p)
+			rl.release(len(p))
+			if err != nil {
+				rl.done <- errRelayReceiver
+				return
+			}
+			if flusher != nil && len(rl.frames) == 0 {
+				flusher.Flush()
+			}
+		case <-rl.gone:
+			rl.done <- errRelaySender
+			// cut the response so the receiver does not take it as complete
+			panic(http.ErrAbortHandler)
+		case <-r.Context().Done():
+			rl.done <- errRelayReceiver
+			return
+		}
+	}
+}
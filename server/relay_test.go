@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func startTestRelay(t *testing.T, base string) (*websocket.Conn, string) {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/api/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	err = conn.WriteJSON(wsData{
+		Authorization: "send-v1 " + testAuthKey,
+		FileMetadata:  "meta",
+		TimeLimit:     60,
+		Down:          1,
+		Relay:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res initResponse
+	if err := conn.ReadJSON(&res); err != nil || res.ID == "" {
+		t.Fatalf("relay not started: %v", err)
+	}
+	return conn, res.ID
+}
+
+func TestRelayBuffersBoundedBytes(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	conn, id := startTestRelay(t, ts.URL)
+	v, _ := s.relays.Get(id)
+	r := v.(*relay)
+
+	frame := bytes.Repeat([]byte{7}, relayMessageSize)
+	const frames = 32
+	sent := make(chan error, 1)
+	go func() {
+		for i := 0; i < frames; i++ {
+			if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+				sent <- err
+				return
+			}
+		}
+		sent <- conn.WriteMessage(websocket.BinaryMessage, []byte{0})
+	}()
+
+	resp := getDownload(t, ts.Client(), ts.URL, s, id, "")
+	defer resp.Body.Close()
+	// the receiver does not read for a while, the sender fills the buffer
+	most := 0
+	for i := 0; i < 50; i++ {
+		r.mu.Lock()
+		if r.buffered > most {
+			most = r.buffered
+		}
+		r.mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+	if most > relayBuffer {
+		t.Fatalf("%d bytes buffered, the limit is %d", most, relayBuffer)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body) != frames*len(frame) {
+		t.Fatalf("received %d bytes, want %d", len(body), frames*len(frame))
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRelayRefusesLargeFrames(t *testing.T) {
+	_, ts := newTestServer(t, nil)
+	conn, _ := startTestRelay(t, ts.URL)
+	_ = conn.WriteMessage(websocket.BinaryMessage, make([]byte, relayMessageSize+1))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if ne, ok := err.(interface{ Timeout() bool }); ok && ne.Timeout() {
+				t.Fatal("connection not closed for a frame over the limit")
+			}
+			return
+		}
+	}
+}
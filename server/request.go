@@ -0,0 +1,560 @@
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const requestPrefix = "/api/request"
+
+// maxRequestFiles bounds the files one request can collect.
+const maxRequestFiles = 1000
+
+var (
+	errRequestClosed = errors.New("file request is closed or full")
+	errRequestSize   = errors.New("uploads to a file request must announce their size")
+	errRequestSealed = errors.New("uploads to a file request must seal their key")
+	errRequestRelay  = errors.New("relayed uploads cannot go to a file request")
+)
+
+// fileRequest collects uploads from anybody holding its link. The files
+// belong to the owner of the request: they carry its owner token, expiry
+// and download limit, and only the owner can list them.
+type fileRequest struct {
+	ID        string        `json:"id"`
+	Token     string        `json:"token"`
+	Expire    int64         `json:"expire"`
+	MaxFiles  int           `json:"max_files"`
+	MaxBytes  int64         `json:"max_bytes"`
+	DownLimit int           `json:"down_limit"`
+	Files     []requestSlot `json:"files"`
+}
+
+// requestSlot is a file received by a request, or on its way. Size is the
+// announced length, counted against the byte limit from the start.
+type requestSlot struct {
+	ID   string `json:"id"`
+	Size int64  `json:"size"`
+}
+
+func (q *fileRequest) bytes() int64 {
+	var n int64
+	for _, slot := range q.Files {
+		n += slot.Size
+	}
+	return n
+}
+
+// Operations of the request journal.
+const (
+	opClaim   = "claim"
+	opRelease = "release"
+)
+
+// requestStore holds the file requests. Every change is appended to a
+// journal and fsynced before it is applied, the journal is rewritten as a
+// snapshot of the live requests once it is mostly stale.
+type requestStore struct {
+	sync.Mutex
+	// path is the journal, empty keeps the requests in memory only.
+	path    string
+	file    *os.File
+	records int
+	reqs    map[string]*fileRequest
+	log     *Logger
+}
+
+// requestRecord is a line of the journal: set stores Request, claim and
+// release add and remove the slot of File, del forgets the request.
+type requestRecord struct {
+	Op      string       `json:"op"`
+	ID      string       `json:"id"`
+	Request *fileRequest `json:"request,omitempty"`
+	File    string       `json:"file,omitempty"`
+	Size    int64        `json:"size,omitempty"`
+}
+
+// newRequestStore replays the journal at path, logging to log. On first
+// start the legacy requests.json next to it is imported.
+func newRequestStore(path string, log *Logger) (*requestStore, error) {
+	st := &requestStore{path: path, reqs: make(map[string]*fileRequest), log: log}
+	if path == "" {
+		return st, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	legacy := filepath.Join(filepath.Dir(path), "requests.json")
+	if !isExist(path) && isExist(legacy) {
+		data, err := ioutil.ReadFile(legacy)
+		if err != nil {
+			return nil, err
+		}
+		var list []*fileRequest
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+		for _, q := range list {
+			st.reqs[q.ID] = q
+		}
+		if err := st.snapshot(); err != nil {
+			return nil, err
+		}
+		return st, nil
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	valid, err := st.replay(file)
+	if err == nil {
+		err = file.Truncate(valid)
+	}
+	if err == nil {
+		_, err = file.Seek(valid, io.SeekStart)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	st.file = file
+	return st, nil
+}
+
+// replay applies the records of r and returns the offset after the last
+// complete one, see replayJournal.
+func (st *requestStore) replay(r io.Reader) (int64, error) {
+	return replayJournal(r, "request", st.path, st.log, func(line []byte) error {
+		var rec requestRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return err
+		}
+		st.records++
+		st.apply(rec)
+		return nil
+	})
+}
+
+func (st *requestStore) apply(rec requestRecord) {
+	switch rec.Op {
+	case opSet:
+		if rec.Request != nil {
+			st.reqs[rec.ID] = rec.Request
+		}
+	case opClaim:
+		if q, ok := st.reqs[rec.ID]; ok {
+			q.Files = append(q.Files, requestSlot{rec.File, rec.Size})
+		}
+	case opRelease:
+		if q, ok := st.reqs[rec.ID]; ok {
+			for i, slot := range q.Files {
+				if slot.ID == rec.File {
+					q.Files = append(q.Files[:i:i], q.Files[i+1:]...)
+					break
+				}
+			}
+		}
+	case opRemove:
+		delete(st.reqs, rec.ID)
+	}
+}
+
+// append journals rec, it is durable when append returns.
+func (st *requestStore) append(rec requestRecord) error {
+	if st.path == "" {
+		return nil
+	}
+	if st.file == nil {
+		return errors.New("request journal is closed")
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := st.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err := st.file.Sync(); err != nil {
+		return err
+	}
+	st.records++
+	return nil
+}
+
+// compact rewrites the journal once it holds far more records than there
+// are requests and slots.
+func (st *requestStore) compact() error {
+	st.Lock()
+	defer st.Unlock()
+	live := len(st.reqs)
+	for _, q := range st.reqs {
+		live += len(q.Files)
+	}
+	if st.path == "" || st.records < compactMinRecords || st.records < 2*live {
+		return nil
+	}
+	return st.snapshot()
+}
+
+// snapshot replaces the journal with one set record per request.
+func (st *requestStore) snapshot() error {
+	ids := make([]string, 0, len(st.reqs))
+	for id := range st.reqs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	tmp := st.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for _, id := range ids {
+		b, err := json.Marshal(requestRecord{Op: opSet, ID: id, Request: st.reqs[id]})
+		if err == nil {
+			_, err = w.Write(append(b, '\n'))
+		}
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, st.path)
+	}
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	_ = syncDir(filepath.Dir(st.path))
+	if st.file != nil {
+		_ = st.file.Close()
+	}
+	st.file = file
+	st.records = len(ids)
+	return nil
+}
+
+func (st *requestStore) close() error {
+	st.Lock()
+	defer st.Unlock()
+	if st.file == nil {
+		return nil
+	}
+	err := st.file.Close()
+	st.file = nil
+	return err
+}
+
+// get returns a copy of the request id.
+func (st *requestStore) get(id string) (fileRequest, bool) {
+	st.Lock()
+	defer st.Unlock()
+	q, ok := st.reqs[id]
+	if !ok {
+		return fileRequest{}, false
+	}
+	c := *q
+	c.Files = append([]requestSlot(nil), q.Files...)
+	return c, true
+}
+
+func (st *requestStore) put(q fileRequest) error {
+	st.Lock()
+	defer st.Unlock()
+	if err := st.append(requestRecord{Op: opSet, ID: q.ID, Request: &q}); err != nil {
+		return err
+	}
+	st.reqs[q.ID] = &q
+	return nil
+}
+
+// claim takes a slot of size bytes in the request id for the file fileID.
+func (st *requestStore) claim(id, fileID string, size, now int64) (fileRequest, error) {
+	st.Lock()
+	defer st.Unlock()
+	q, ok := st.reqs[id]
+	if !ok || q.Expire < now || len(q.Files) >= q.MaxFiles || q.bytes()+size > q.MaxBytes {
+		return fileRequest{}, errRequestClosed
+	}
+	if err := st.append(requestRecord{Op: opClaim, ID: id, File: fileID, Size: size}); err != nil {
+		return fileRequest{}, err
+	}
+	q.Files = append(q.Files, requestSlot{fileID, size})
+	return *q, nil
+}
+
+// release gives the slot of fileID back to the request id.
+func (st *requestStore) release(id, fileID string) error {
+	st.Lock()
+	defer st.Unlock()
+	q, ok := st.reqs[id]
+	if !ok {
+		return nil
+	}
+	for i, slot := range q.Files {
+		if slot.ID == fileID {
+			if err := st.append(requestRecord{Op: opRelease, ID: id, File: fileID}); err != nil {
+				return err
+			}
+			q.Files = append(q.Files[:i:i], q.Files[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (st *requestStore) remove(id string) error {
+	st.Lock()
+	defer st.Unlock()
+	if _, ok := st.reqs[id]; !ok {
+		return nil
+	}
+	if err := st.append(requestRecord{Op: opRemove, ID: id}); err != nil {
+		return err
+	}
+	delete(st.reqs, id)
+	return nil
+}
+
+// expired returns the requests that expired before now.
+func (st *requestStore) expired(now int64) []string {
+	st.Lock()
+	defer st.Unlock()
+	var ids []string
+	for id, q := range st.reqs {
+		if q.Expire < now {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// ownerTokenHeader carries the owner token of a request along with the
+// signed download of one of its files.
+const ownerTokenHeader = "X-Owner-Token"
+
+// readsRequestFile tells whether r may read res. The uploader of a file sent to
+// a request knows its key too, so such files also need the owner token.
+func readsRequestFile(r *http.Request, res FileItem) bool {
+	if res.Request == "" {
+		return true
+	}
+	token := r.Header.Get(ownerTokenHeader)
+	return token != "" && subtle.ConstantTimeCompare([]byte(res.Token), []byte(token)) == 1
+}
+
+// claimRequest makes res, the new file fileID described by meta, part of
+// the request it is uploaded to.
+func (s *Server) claimRequest(fileID string, meta wsData, res *FileItem) error {
+	if meta.Relay {
+		return errRequestRelay
+	}
+	if meta.Sealed == "" {
+		return errRequestSealed
+	}
+	q, err := s.requests.claim(meta.Request, fileID, meta.Size, s.clock.Now().Unix())
+	if err != nil {
+		return err
+	}
+	res.Token = q.Token
+	res.Expire = q.Expire
+	res.DownLimit = q.DownLimit
+	res.Pwd = false
+	res.Request = q.ID
+	res.Sealed = meta.Sealed
+	return nil
+}
+
+// expireRequests forgets the expired requests, their files expire with
+// them, and compacts the journal.
+func (s *Server) expireRequests() {
+	for _, id := range s.requests.expired(s.clock.Now().Unix()) {
+		s.log.Err("remove request", s.requests.remove(id), "file_request", id)
+	}
+	s.log.Err("compact requests", s.requests.compact())
+}
+
+type requestBody struct {
+	MaxFiles  int   `json:"maxFiles"`
+	MaxBytes  int64 `json:"maxBytes"`
+	TimeLimit int   `json:"timeLimit"`
+	Down      int   `json:"dlimit"`
+}
+
+type requestResponse struct {
+	ID         string `json:"id"`
+	OwnerToken string `json:"ownerToken"`
+	URL        string `json:"url"`
+}
+
+// requestInfo is what uploaders see of a request, its owner gets the files
+// too.
+type requestInfo struct {
+	MaxFiles int               `json:"maxFiles"`
+	MaxBytes int64             `json:"maxBytes"`
+	Files    int               `json:"files"`
+	Bytes    int64             `json:"bytes"`
+	Last     int64             `json:"ttl"`
+	List     []requestFileInfo `json:"list,omitempty"`
+}
+
+type requestFileInfo struct {
+	ID            string `json:"id"`
+	Size          int64  `json:"size"`
+	Complete      bool   `json:"complete"`
+	Sealed        string `json:"sealed"`
+	Metadata      string `json:"metadata"`
+	DownloadLimit int    `json:"dlimit"`
+	DownloadCount int    `json:"dtotal"`
+}
+
+// fileRequestHandler serves /api/request: POST creates a request, GET
+// /<id> shows its limits and GET /<id>/files lists its files to the owner,
+// who can DELETE /<id> along with the files.
+func (s *Server) fileRequestHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, requestPrefix), "/")
+	parts := strings.Split(rest, "/")
+	switch {
+	case rest == "" && r.Method == http.MethodPost:
+		s.createRequest(w, r)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		s.requestStatus(w, r, parts[0], false)
+	case len(parts) == 2 && parts[1] == "files" && r.Method == http.MethodGet:
+		s.requestStatus(w, r, parts[0], true)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		s.deleteRequest(w, r, parts[0])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) createRequest(w http.ResponseWriter, r *http.Request) {
+	var body requestBody
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil || json.Unmarshal(data, &body) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if body.Down == 0 {
+		body.Down = 1
+	}
+	if body.MaxFiles < 1 || body.MaxFiles > maxRequestFiles || body.MaxBytes < 1 ||
+		body.TimeLimit < 1 || body.TimeLimit > s.cfg.Limits.MaxExpire ||
+		body.Down < 1 || body.Down > s.cfg.Limits.MaxDownloads {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	q := fileRequest{
+		ID:        randomHexStr(16),
+		Token:     randomHexStr(20),
+		Expire:    s.clock.Now().Add(time.Duration(body.TimeLimit) * time.Second).Unix(),
+		MaxFiles:  body.MaxFiles,
+		MaxBytes:  body.MaxBytes,
+		DownLimit: body.Down,
+	}
+	if err := s.requests.put(q); err != nil {
+		s.reqLog(r).Err("create request", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.reqLog(r).Info("request created", "file_request", q.ID, "files", q.MaxFiles, "bytes", q.MaxBytes)
+	_, _ = w.Write(s.respBuilder(requestResponse{
+		ID:         q.ID,
+		OwnerToken: q.Token,
+		URL:        fmt.Sprintf("%s/request/%s", s.cfg.PublicURL, q.ID),
+	}))
+}
+
+// ownRequest returns the request id if r is made by its owner, and
+// answers the request otherwise.
+func (s *Server) ownRequest(w http.ResponseWriter, r *http.Request, id string) (fileRequest, bool) {
+	q, ok := s.requests.get(id)
+	if !ok || q.Expire < s.clock.Now().Unix() {
+		http.NotFound(w, r)
+		return q, false
+	}
+	token := ownerToken(r)
+	if token == "" || subtle.ConstantTimeCompare([]byte(q.Token), []byte(token)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return q, false
+	}
+	return q, true
+}
+
+func (s *Server) requestStatus(w http.ResponseWriter, r *http.Request, id string, files bool) {
+	q, ok := s.requests.get(id)
+	if files {
+		if q, ok = s.ownRequest(w, r, id); !ok {
+			return
+		}
+	} else if !ok || q.Expire < s.clock.Now().Unix() {
+		http.NotFound(w, r)
+		return
+	}
+	info := requestInfo{
+		MaxFiles: q.MaxFiles,
+		MaxBytes: q.MaxBytes,
+		Files:    len(q.Files),
+		Bytes:    q.bytes(),
+		Last:     (q.Expire - s.clock.Now().Unix()) * 1000,
+	}
+	if files {
+		info.List = []requestFileInfo{}
+		for _, slot := range q.Files {
+			item := s.itemInfo(slot.ID)
+			if item == nil {
+				continue
+			}
+			info.List = append(info.List, requestFileInfo{
+				ID:            slot.ID,
+				Size:          slot.Size,
+				Complete:      item.Length > 0,
+				Sealed:        item.Sealed,
+				Metadata:      item.Meta,
+				DownloadLimit: item.DownLimit,
+				DownloadCount: item.DownCount,
+			})
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(s.respBuilder(info))
+}
+
+func (s *Server) deleteRequest(w http.ResponseWriter, r *http.Request, id string) {
+	q, ok := s.ownRequest(w, r, id)
+	if !ok {
+		return
+	}
+	if err := s.requests.remove(id); err != nil {
+		s.reqLog(r).Err("remove request", err, "file_request", id)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for _, slot := range q.Files {
+		if item := s.itemInfo(slot.ID); item != nil {
+			if err := s.deleteFile(slot.ID); err != nil {
+				s.reqLog(r).Err("delete file", err, "file", slot.ID)
+				continue
+			}
+			s.fileEvent(eventDeleted, slot.ID, *item, deletedByOwner)
+		}
+	}
+	s.reqLog(r).Info("request deleted", "file_request", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestFilesNeedTheOwnerToken(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	q := fileRequest{
+		ID:        randomHexStr(16),
+		Token:     randomHexStr(20),
+		Expire:    s.clock.Now().Add(time.Hour).Unix(),
+		MaxFiles:  1,
+		MaxBytes:  100,
+		DownLimit: 1,
+	}
+	if err := s.requests.put(q); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("ciphertext")
+	id := addTestFile(t, s, data, 1)
+	if _, _, err := s.updateItem(id, func(item *FileItem) {
+		item.Request = q.ID
+		item.Token = q.Token
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/api/metadata/", "/api/download/"} {
+		item := s.itemInfo(id)
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path+id, nil)
+		req.Header.Set("Authorization", "send-v1 "+b58encode(sign(item.Auth, item.Nonce)))
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("%s without the owner token: status %d", path, resp.StatusCode)
+		}
+	}
+
+	item := s.itemInfo(id)
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/download/"+id, nil)
+	req.Header.Set("Authorization", "send-v1 "+b58encode(sign(item.Auth, item.Nonce)))
+	req.Header.Set(ownerTokenHeader, q.Token)
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Fatalf("owner download: status %d, body %q", resp.StatusCode, body)
+	}
+}
+
+func TestRequestJournalAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.log")
+	st, err := newRequestStore(path, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := fileRequest{ID: "q", Token: "t", Expire: 100, MaxFiles: 3, MaxBytes: 30, DownLimit: 1}
+	if err := st.put(q); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.put(fileRequest{ID: "gone", Expire: 100, MaxFiles: 1, MaxBytes: 1}); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := ioutil.ReadFile(path)
+	for _, f := range []string{"a", "b", "c"} {
+		if _, err := st.claim("q", f, 10, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := st.claim("q", "d", 1, 0); err != errRequestClosed {
+		t.Fatalf("claim past the limits: %v", err)
+	}
+	if err := st.release("q", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.remove("gone"); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := ioutil.ReadFile(path)
+	if !bytes.HasPrefix(after, before) {
+		t.Fatal("journal rewritten instead of appended to")
+	}
+	if n := strings.Count(string(after), "\n"); n != 7 {
+		t.Fatalf("%d records, want 7", n)
+	}
+	if err := st.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a torn record at the tail is dropped
+	appendRaw(t, path, `{"op":"claim","id":"q","fi`)
+	st, err = newRequestStore(path, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.close()
+	got, ok := st.get("q")
+	if !ok || len(got.Files) != 2 || got.Files[0].ID != "a" || got.Files[1].ID != "c" || got.bytes() != 20 {
+		t.Fatalf("replayed %+v", got)
+	}
+	if _, ok := st.get("gone"); ok {
+		t.Fatal("removed request replayed")
+	}
+	if _, err := st.claim("q", "e", 10, 0); err != nil {
+		t.Fatalf("claim after the torn record: %v", err)
+	}
+}
+
+func TestRequestJournalCorruptRecordFailsLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.log")
+	st, err := newRequestStore(path, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.put(fileRequest{ID: "q", Expire: 100, MaxFiles: 1, MaxBytes: 1}); err != nil {
+		t.Fatal(err)
+	}
+	_ = st.close()
+	appendRaw(t, path, "{garbage\n")
+	appendRaw(t, path, `{"op":"del","id":"q"}`+"\n")
+	if st, err := newRequestStore(path, testLogger()); err == nil {
+		_ = st.close()
+		t.Fatal("request journal with a corrupt record loaded")
+	}
+}
+
+func TestRequestJournalLogsTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.log")
+	if err := ioutil.WriteFile(path, []byte(`{"op":"set","id":"q","requ`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var out syncBuffer
+	st, err := newRequestStore(path, NewLogger(&out, "logfmt", LevelInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = st.close()
+	if !strings.Contains(out.String(), "dropped torn request record") {
+		t.Fatalf("torn record not logged: %q", out.String())
+	}
+}
+
+func TestRequestJournalImportsLegacyFile(t *testing.T) {
+	dir := t.TempDir()
+	legacy := `[{"id":"q","token":"t","expire":100,"max_files":2,"max_bytes":20,"down_limit":1,"files":[{"id":"a","size":5}]}]`
+	if err := ioutil.WriteFile(filepath.Join(dir, "requests.json"), []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	st, err := newRequestStore(filepath.Join(dir, "requests.log"), testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.close()
+	if q, ok := st.get("q"); !ok || len(q.Files) != 1 || q.bytes() != 5 {
+		t.Fatalf("imported %+v", q)
+	}
+	if _, err := st.claim("q", "b", 5, 0); err != nil {
+		t.Fatal(err)
+	}
+}
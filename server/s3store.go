@@ -0,0 +1,450 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3PartSize      = 8 * megabyte
+	s3PresignTTL    = 5 * time.Minute
+	s3UnsignedBody  = "UNSIGNED-PAYLOAD"
+	s3TimeFormat    = "20060102T150405Z"
+	s3DateFormat    = "20060102"
+	s3SignAlgorithm = "AWS4-HMAC-SHA256"
+)
+
+// S3Config addresses a bucket of an S3-compatible service.
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint"`
+	Bucket    string `yaml:"bucket"`
+	Region    string `yaml:"region"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	Prefix    string `yaml:"prefix"`
+	// Redirect makes downloads of files without a download limit answer
+	// with a presigned GET instead of proxying the object through this
+	// server. Limited files are always proxied, a presigned URL could be
+	// replayed past the limit.
+	Redirect bool `yaml:"redirect"`
+}
+
+// s3Store keeps blobs in an S3-compatible bucket using path-style requests,
+// so it works with AWS as well as MinIO-like stand-ins.
+type s3Store struct {
+	cfg    S3Config
+	client *http.Client
+}
+
+// NewS3Store returns a BlobStore keeping blobs in the bucket described by cfg.
+func NewS3Store(cfg S3Config) BlobStore {
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	return &s3Store{cfg: cfg, client: &http.Client{}}
+}
+
+func (s *s3Store) key(id string) string {
+	return s.cfg.Prefix + id + ".bin"
+}
+
+func (s *s3Store) objectURL(key string, query url.Values) *url.URL {
+	u, _ := url.Parse(s.cfg.Endpoint)
+	u.Path = "/" + s.cfg.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawQuery = canonicalQuery(query)
+	return u
+}
+
+func (s *s3Store) do(method, key string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+	s.sign(req, hashHex(body))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		_ = resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return resp, ErrBlobNotFound
+		}
+		return resp, fmt.Errorf("s3 %s %s: %s %s", method, key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+func (s *s3Store) sign(req *http.Request, payloadHash string) {
+	now := time.Now().UTC()
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + now.Format(s3TimeFormat),
+		"",
+		signed,
+		payloadHash,
+	}, "\n")
+	scope, signature := s.signature(now, canonical)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3SignAlgorithm, s.cfg.AccessKey, scope, signed, signature))
+}
+
+func (s *s3Store) signature(t time.Time, canonical string) (string, string) {
+	date := t.Format(s3DateFormat)
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	toSign := strings.Join([]string{s3SignAlgorithm, t.Format(s3TimeFormat), scope, hashHex([]byte(canonical))}, "\n")
+	k := hmacSum([]byte("AWS4"+s.cfg.SecretKey), date)
+	k = hmacSum(k, s.cfg.Region)
+	k = hmacSum(k, "s3")
+	k = hmacSum(k, "aws4_request")
+	return scope, hex.EncodeToString(hmacSum(k, toSign))
+}
+
+// presign returns a query-signed URL for a GET of the blob, valid for ttl.
+func (s *s3Store) presign(id string, ttl time.Duration) string {
+	now := time.Now().UTC()
+	scope := now.Format(s3DateFormat) + "/" + s.cfg.Region + "/s3/aws4_request"
+	query := url.Values{
+		"X-Amz-Algorithm":     {s3SignAlgorithm},
+		"X-Amz-Credential":    {s.cfg.AccessKey + "/" + scope},
+		"X-Amz-Date":          {now.Format(s3TimeFormat)},
+		"X-Amz-Expires":       {strconv.Itoa(int(ttl.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	u := s.objectURL(s.key(id), query)
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host,
+		"",
+		"host",
+		s3UnsignedBody,
+	}, "\n")
+	_, signature := s.signature(now, canonical)
+	u.RawQuery += "&X-Amz-Signature=" + signature
+	return u.String()
+}
+
+func (s *s3Store) redirectURL(id string) (string, bool) {
+	if !s.cfg.Redirect {
+		return "", false
+	}
+	return s.presign(id, s3PresignTTL), true
+}
+
+func (s *s3Store) Create(id string) (io.WriteCloser, error) {
+	return &s3Writer{store: s, key: s.key(id)}, nil
+}
+
+func (s *s3Store) Open(id string) (Blob, error) {
+	info, err := s.Stat(id)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Reader{store: s, key: s.key(id), size: info.Size}, nil
+}
+
+func (s *s3Store) Stat(id string) (BlobInfo, error) {
+	resp, err := s.do(http.MethodHead, s.key(id), nil, nil, nil)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	_ = resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return BlobInfo{Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *s3Store) Delete(id string) error {
+	resp, err := s.do(http.MethodDelete, s.key(id), nil, nil, nil)
+	if err == ErrBlobNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3Store) List() ([]string, error) {
+	var ids []string
+	query := url.Values{"list-type": {"2"}, "prefix": {s.cfg.Prefix}}
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var res s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range res.Contents {
+			key := strings.TrimPrefix(item.Key, s.cfg.Prefix)
+			if strings.HasSuffix(key, ".bin") && !strings.Contains(key, "/") {
+				ids = append(ids, strings.TrimSuffix(key, ".bin"))
+			}
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return ids, nil
+		}
+		query.Set("continuation-token", res.NextContinuationToken)
+	}
+}
+
+// s3Writer buffers the stream into parts of s3PartSize. Small blobs are sent
+// with a single PUT, anything bigger becomes a multipart upload.
+type s3Writer struct {
+	store    *s3Store
+	key      string
+	buf      bytes.Buffer
+	uploadID string
+	parts    []s3Part
+	err      error
+	// done is set once the object was created or discarded, later calls
+	// to Close or Abort change nothing.
+	done bool
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3InitResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompleteRequest struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []s3Part `xml:"Part"`
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, _ := w.buf.Write(p)
+	for w.buf.Len() >= s3PartSize {
+		if w.err = w.flushPart(w.buf.Next(s3PartSize)); w.err != nil {
+			return n, w.err
+		}
+	}
+	return n, nil
+}
+
+func (w *s3Writer) flushPart(part []byte) error {
+	if w.uploadID == "" {
+		resp, err := w.store.do(http.MethodPost, w.key, url.Values{"uploads": {""}}, nil, nil)
+		if err != nil {
+			return err
+		}
+		var res s3InitResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		_ = resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		w.uploadID = res.UploadID
+	}
+	number := len(w.parts) + 1
+	resp, err := w.store.do(http.MethodPut, w.key, url.Values{
+		"partNumber": {strconv.Itoa(number)},
+		"uploadId":   {w.uploadID},
+	}, part, nil)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	w.parts = append(w.parts, s3Part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	return nil
+}
+
+func (w *s3Writer) Close() error {
+	if w.done {
+		return w.err
+	}
+	if w.err != nil {
+		_ = w.Abort()
+		return w.err
+	}
+	w.done = true
+	if w.uploadID == "" {
+		resp, err := w.store.do(http.MethodPut, w.key, nil, w.buf.Bytes(), nil)
+		w.buf.Reset()
+		if err != nil {
+			w.err = err
+			return err
+		}
+		return resp.Body.Close()
+	}
+	if w.buf.Len() > 0 {
+		if err := w.flushPart(w.buf.Bytes()); err != nil {
+			w.err = err
+			_ = w.abortParts()
+			return err
+		}
+		w.buf.Reset()
+	}
+	body, _ := xml.Marshal(s3CompleteRequest{Parts: w.parts})
+	resp, err := w.store.do(http.MethodPost, w.key, url.Values{"uploadId": {w.uploadID}}, body, nil)
+	if err != nil {
+		w.err = err
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Abort drops the parts uploaded so far without creating the object.
+func (w *s3Writer) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	w.buf.Reset()
+	return w.abortParts()
+}
+
+// abortParts deletes the multipart upload, if one was started.
+func (w *s3Writer) abortParts() error {
+	if w.uploadID == "" {
+		return nil
+	}
+	resp, err := w.store.do(http.MethodDelete, w.key, url.Values{"uploadId": {w.uploadID}}, nil, nil)
+	w.uploadID = ""
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// s3Reader reads an object with ranged GETs, reopening the stream after seeks.
+type s3Reader struct {
+	store  *s3Store
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		resp, err := r.store.do(http.MethodGet, r.key, nil, nil, http.Header{
+			"Range": {fmt.Sprintf("bytes=%d-", r.offset)},
+		})
+		if err != nil {
+			return 0, err
+		}
+		r.body = resp.Body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("s3Reader.Seek: negative position")
+	}
+	if offset != r.offset {
+		_ = r.Close()
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k)+"="+uriEncode(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hashHex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSum(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a MinIO-like stand-in serving one bucket with path-style
+// requests: object PUT, GET with ranges, HEAD and DELETE, multipart uploads
+// and ListObjectsV2.
+type fakeS3 struct {
+	sync.Mutex
+	t       *testing.T
+	bucket  string
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	// puts counts the single-request PUTs of objects.
+	puts int
+}
+
+func newFakeS3(t *testing.T, bucket string) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{
+		t:       t,
+		bucket:  bucket,
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+	}
+	ts := httptest.NewServer(f)
+	t.Cleanup(ts.Close)
+	return f, ts
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if !strings.HasPrefix(r.Header.Get("Authorization"), s3SignAlgorithm+" Credential=") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Header.Get("X-Amz-Content-Sha256") != hashHex(body) {
+		f.t.Errorf("%s %s: payload hash does not match the body", r.Method, r.URL)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path == f.bucket && r.Method == http.MethodGet {
+		f.list(w, r)
+		return
+	}
+	if !strings.HasPrefix(path, f.bucket+"/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(path, f.bucket+"/")
+	q := r.URL.Query()
+	_, initiate := q["uploads"]
+	f.Lock()
+	defer f.Unlock()
+	switch {
+	case r.Method == http.MethodPost && initiate:
+		id := randomHexStr(16)
+		f.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPut && q.Get("uploadId") != "":
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		parts[n] = body
+		w.Header().Set("ETag", fmt.Sprintf("\"%s\"", hashHex(body)[:16]))
+	case r.Method == http.MethodPost && q.Get("uploadId") != "":
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var req s3CompleteRequest
+		if err := xml.Unmarshal(body, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var obj []byte
+		for _, p := range req.Parts {
+			obj = append(obj, parts[p.PartNumber]...)
+		}
+		f.objects[key] = obj
+		delete(f.uploads, q.Get("uploadId"))
+	case r.Method == http.MethodDelete && q.Get("uploadId") != "":
+		delete(f.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.puts++
+		f.objects[key] = body
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		obj, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, "", time.Unix(0, 0), bytes.NewReader(obj))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	fmt.Fprint(w, "<ListBucketResult>")
+	for _, k := range keys {
+		fmt.Fprintf(w, "<Contents><Key>%s</Key></Contents>", k)
+	}
+	fmt.Fprint(w, "<IsTruncated>false</IsTruncated></ListBucketResult>")
+}
+
+func (f *fakeS3) object(key string) ([]byte, bool) {
+	f.Lock()
+	defer f.Unlock()
+	obj, ok := f.objects[key]
+	return obj, ok
+}
+
+func newTestS3Store(t *testing.T) (*fakeS3, BlobStore) {
+	f, ts := newFakeS3(t, "send")
+	return f, NewS3Store(S3Config{
+		Endpoint:  ts.URL,
+		Bucket:    "send",
+		AccessKey: "access",
+		SecretKey: "secret",
+		Prefix:    "blobs/",
+	})
+}
+
+func TestS3Store(t *testing.T) {
+	_, store := newTestS3Store(t)
+	testBlobStore(t, store)
+}
+
+func TestS3StoreMultipart(t *testing.T) {
+	f, store := newTestS3Store(t)
+	data := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7}, (2*s3PartSize+1000)/7)
+	writeBlob(t, store, "big", data)
+	if f.puts != 0 {
+		t.Fatalf("%d single PUTs for a multipart blob", f.puts)
+	}
+	if got := readBlob(t, store, "big"); !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, want %d", len(got), len(data))
+	}
+	if len(f.uploads) != 0 {
+		t.Fatalf("%d multipart uploads left open", len(f.uploads))
+	}
+}
+
+func TestS3StoreAbortMultipart(t *testing.T) {
+	f, store := newTestS3Store(t)
+	w, err := store.Create("aborted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, s3PartSize+1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := abortBlob(store, w, "aborted"); err != nil {
+		t.Fatal(err)
+	}
+	_ = w.Close()
+	if _, ok := f.object("blobs/aborted.bin"); ok {
+		t.Fatal("aborted blob was created")
+	}
+	if len(f.uploads) != 0 {
+		t.Fatalf("%d multipart uploads left open", len(f.uploads))
+	}
+}
+
+func TestS3StoreCloseKeepsSmallBlob(t *testing.T) {
+	f, store := newTestS3Store(t)
+	w, err := store.Create("small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte("ciphertext"))
+	for i := 0; i < 3; i++ {
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if obj, _ := f.object("blobs/small.bin"); string(obj) != "ciphertext" {
+		t.Fatalf("object is %q after repeated Close", obj)
+	}
+	if f.puts != 1 {
+		t.Fatalf("%d PUTs, want 1", f.puts)
+	}
+}
+
+func TestS3RedirectOnlyUnlimited(t *testing.T) {
+	_, store := newTestS3Store(t)
+	store.(*s3Store).cfg.Redirect = true
+	s, ts := newTestServer(t, func(cfg *Config) {
+		cfg.Store = store
+	})
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	for _, limit := range []int{0, 2} {
+		id := addTestFile(t, s, []byte("ciphertext"), limit)
+		resp := getDownload(t, client, ts.URL, s, id, "")
+		_ = resp.Body.Close()
+		redirected := resp.StatusCode == http.StatusFound
+		if redirected != (limit == 0) {
+			t.Errorf("dlimit %d: status %d", limit, resp.StatusCode)
+		}
+	}
+}
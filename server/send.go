@@ -0,0 +1,323 @@
+// Package server implements the Send service: encrypted uploads over
+// WebSocket and tus, authenticated downloads and the web client around them.
+// A Server can run its own listeners with Start or be mounted on another mux
+// through Handler.
+package server
+
+import (
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/panjf2000/ants/v2"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	basePath, _ = filepath.Abs("/")
+	bs58        = NewAlphabet("123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz")
+	json        = jsoniter.ConfigCompatibleWithStandardLibrary
+	//captcha, _     = recaptcha.NewReCAPTCHA(os.Getenv("captcha"), recaptcha.V3, 10 * time.Second)
+)
+
+// Clock tells the current time. Expiry, download TTLs and upload sessions
+// are computed with it, so tests can move time forward.
+type Clock interface {
+	Now() time.Time
+}
+
+// AfterClock is a Clock that also drives timers. When cfg.Clock is one, the
+// expiry scheduler waits with After, so moving the clock forward deletes
+// the files that came due.
+type AfterClock interface {
+	Clock
+	// After sends the time once the clock advanced by d.
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// after waits for d on the server's clock. stop releases the timer of the
+// system clock early.
+func (s *Server) after(d time.Duration) (<-chan time.Time, func()) {
+	if c, ok := s.clock.(AfterClock); ok {
+		return c.After(d), func() {}
+	}
+	timer := time.NewTimer(d)
+	return timer.C, func() { timer.Stop() }
+}
+
+// Server is one Send instance with its own files, uploads and worker pools.
+type Server struct {
+	cfg   *Config
+	blobs BlobStore
+	meta  MetaStore
+	clock Clock
+	log   *Logger
+
+	// metaMu serializes journal writes with the changes of files, every
+	// change of files is journaled and made under it.
+	metaMu   sync.Mutex
+	files    ConcurrentMap
+	sessions ConcurrentMap
+	relays   ConcurrentMap
+	expiry   *expiryQueue
+	buckets  ConcurrentMap
+	quotas   ConcurrentMap
+	metrics  *metrics
+	blocked  *blocklist
+	outbox   *outbox
+	watchers *watchers
+	requests *requestStore
+	auditMu  sync.Mutex
+	// downloads holds the downloads taken and not sent in full yet.
+	downloads downloadSlots
+
+	pool        *ants.Pool
+	httpPool    *ants.PoolWithFunc
+	handler     http.Handler
+	fileHandler http.Handler
+	indexBlock  string
+	allow       []*net.IPNet
+	trusted     []*net.IPNet
+	disk        diskState
+
+	// abortUploads is closed once in-flight uploads have to be given up.
+	abortUploads chan struct{}
+	uploads      uploadTracker
+	servers      struct {
+		sync.Mutex
+		list []*http.Server
+	}
+	// done stops the background tasks.
+	done chan struct{}
+	// shutdown runs Shutdown once, shutdownErr is its result.
+	shutdown    sync.Once
+	shutdownErr error
+}
+
+// New sets up a server from cfg and loads its metadata. Storage, metadata
+// and clock come from cfg.Store, cfg.Meta and cfg.Clock when set, otherwise
+// from the storage settings.
+func New(cfg Config) (*Server, error) {
+	s := &Server{
+		cfg:          &cfg,
+		blobs:        cfg.Store,
+		meta:         cfg.Meta,
+		clock:        cfg.Clock,
+		files:        NewCMap(),
+		watchers:     newWatchers(),
+		sessions:     NewCMap(),
+		relays:       NewCMap(),
+		buckets:      NewCMap(),
+		quotas:       NewCMap(),
+		metrics:      newMetrics(),
+		expiry:       newExpiryQueue(),
+		abortUploads: make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	if s.clock == nil {
+		s.clock = systemClock{}
+	}
+	var err error
+	level := LevelInfo
+	if cfg.Log.Level != "" {
+		if level, err = ParseLevel(cfg.Log.Level); err != nil {
+			return nil, err
+		}
+	}
+	switch cfg.Log.Format {
+	case "", "logfmt", "json":
+	default:
+		return nil, fmt.Errorf("unknown log format %q", cfg.Log.Format)
+	}
+	if cfg.LogOutput == nil {
+		cfg.LogOutput = os.Stderr
+	}
+	s.log = NewLogger(cfg.LogOutput, cfg.Log.Format, level)
+	trustedList := cfg.Proxy.Trusted
+	if cfg.TLS.Mode == tlsCloudflare {
+		// clients would otherwise share the buckets and quota of an edge
+		trustedList = append(append([]string(nil), trustedList...), cloudflareRanges...)
+	}
+	trusted, err := parseNetworks(trustedList)
+	if err != nil {
+		return nil, err
+	}
+	s.trusted = trusted
+	switch cfg.Limits.Eviction {
+	case "", evictNone, evictExpiry:
+	default:
+		return nil, fmt.Errorf("unknown eviction policy %q", cfg.Limits.Eviction)
+	}
+	if s.blobs == nil {
+		switch cfg.Storage.Driver {
+		case "fs":
+			s.blobs = NewFSStore(cfg.DataDir)
+		case "memory":
+			s.blobs = NewMemStore()
+		case "s3":
+			s.blobs = NewS3Store(cfg.Storage.S3)
+		default:
+			return nil, fmt.Errorf("unknown storage driver %q", cfg.Storage.Driver)
+		}
+	}
+	if s.meta == nil {
+		if cfg.Storage.Driver == "memory" {
+			// metadata would outlive the blobs it describes
+			s.meta = NewNopMetaStore()
+		} else {
+			s.meta = NewFileMetaStore(filepath.Join(cfg.ConfigDir, "data.log"))
+		}
+	}
+	if l, ok := s.meta.(metaLogger); ok {
+		l.setLogger(s.log)
+	}
+	blockPath := ""
+	if _, ephemeral := s.meta.(nopMetaStore); !ephemeral {
+		blockPath = filepath.Join(cfg.ConfigDir, "blocked.json")
+	}
+	s.blocked, err = newBlocklist(blockPath)
+	if err != nil {
+		return nil, err
+	}
+	hooks := make(map[string]bool)
+	for _, h := range cfg.Webhooks {
+		if err := h.validate(); err != nil {
+			return nil, err
+		}
+		if hooks[h.ID] {
+			return nil, fmt.Errorf("webhook %s: duplicate id %q", h.URL, h.ID)
+		}
+		hooks[h.ID] = true
+	}
+	outboxDir, requestPath := "", ""
+	if _, ephemeral := s.meta.(nopMetaStore); !ephemeral {
+		outboxDir = filepath.Join(cfg.ConfigDir, "outbox")
+		requestPath = filepath.Join(cfg.ConfigDir, "requests.log")
+	}
+	s.outbox, err = newOutbox(outboxDir, s.log)
+	if err != nil {
+		return nil, err
+	}
+	s.requests, err = newRequestStore(requestPath, s.log)
+	if err != nil {
+		return nil, err
+	}
+	if s.cfg.Admin.AuditLog == "" {
+		s.cfg.Admin.AuditLog = filepath.Join(cfg.ConfigDir, "audit.log")
+	}
+	err = s.meta.Load(func(id string, item FileItem) {
+		if item.Relay {
+			// its sender is gone with the previous process
+			return
+		}
+		s.files.Set(id, item)
+		s.scheduleExpiry(id, item)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.pool, err = ants.NewPool(cfg.Pools.Default)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.buildHandler(); err != nil {
+		s.pool.Release()
+		return nil, err
+	}
+	s.submit(s.configSync)
+	s.submit(s.diskUsageUpdater)
+	s.submit(s.cleanHandler)
+	s.submit(s.expiryScheduler)
+	s.submit(s.limiterSweeper)
+	s.submit(s.sessionCollector)
+	s.submit(s.webhookSender)
+	return s, nil
+}
+
+// Handler serves the API and the web client. It works without Start, for
+// embedding the server in another http.Server.
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// Logger returns the logger of the server, configured by cfg.Log.
+func (s *Server) Logger() *Logger {
+	return s.log
+}
+
+// items returns a copy of every file entry.
+func (s *Server) items() map[string]FileItem {
+	tmp := make(map[string]FileItem)
+	for item := range s.files.IterBuffered() {
+		tmp[item.Key] = item.Val.(FileItem)
+	}
+	return tmp
+}
+
+// configSync keeps the metadata journal compact.
+func (s *Server) configSync() {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.metaMu.Lock()
+			err := s.meta.Compact(s.items)
+			s.metaMu.Unlock()
+			s.log.Err("compact metadata", err)
+		}
+	}
+}
+
+// cleanHandler drops blobs left behind without any metadata, e.g. by a
+// crash between deleting the metadata and the blob of a file, and expired
+// file requests.
+func (s *Server) cleanHandler() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.expireRequests()
+			ids, err := s.blobs.List()
+			s.log.Err("list blobs", err)
+			for _, id := range ids {
+				if !s.files.Has(id) {
+					s.log.Err("delete orphan blob", s.blobs.Delete(id), "file", id)
+				}
+			}
+		}
+	}
+}
+
+// deleteFile drops the metadata of id and then its blob. A collection takes
+// its items along, an item leaves its collection, a snippet has no blob.
+func (s *Server) deleteFile(id string) error {
+	item := s.itemInfo(id)
+	if err := s.removeItem(id); err != nil {
+		return err
+	}
+	s.downloads.drop(id)
+	switch {
+	case item == nil:
+	case item.Collection:
+		return s.dropItems(id, *item)
+	case item.snippet():
+		return nil
+	case item.Parent != "":
+		s.leaveCollection(item.Parent, id, item.Length)
+	}
+	return s.blobs.Delete(id)
+}
@@ -1,17 +1,14 @@
-package main
+package server
 
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/panjf2000/ants/v2"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
-	"os"
 	"path"
 	"path/filepath"
 	"strconv"
@@ -19,144 +16,214 @@ import (
 	"time"
 )
 
-var (
-	cidrSet     []*net.IPNet
-	fileHandler = http.FileServer(http.Dir(filepath.Join(basePath, "dist")))
-	wsInit      = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-	}
-	preDefBlock = os.Getenv("pub")
-	preDefName  = os.Getenv("pub2")
-)
+var wsInit = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
 
 type request struct {
 	r *http.Request
 	c chan struct{}
 	w *http.ResponseWriter
+	// aborted is set when the handler panicked with http.ErrAbortHandler,
+	// it is raised again on the connection's goroutine.
+	aborted bool
 }
 
-func init() {
-	preDefBlock = strings.ReplaceAll(preDefBlock, "</script>", ";var downloadMetadata = %s;</script>")
-	v := ipGet("https://www.cloudflare.com/ips-v4")
-	for _, item := range v {
-		_, network, _ := net.ParseCIDR(item)
-		cidrSet = append(cidrSet, network)
-	}
-
-	v = ipGet("https://www.cloudflare.com/ips-v6")
-	for _, item := range v {
-		_, network, _ := net.ParseCIDR(item)
-		cidrSet = append(cidrSet, network)
-	}
-	log.Println(cidrSet)
-}
-
-func getIndex() string {
-	base, _ := ioutil.ReadFile(filepath.Join(basePath, "dist", "index.html"))
+func (s *Server) getIndex() string {
+	base, _ := ioutil.ReadFile(filepath.Join(s.cfg.DistDir, "index.html"))
 	return string(base)
 }
 
-func ipGet(url string) []string {
+func ipGet(url string) ([]string, error) {
 	v, err := http.Get(url)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	content, err := ioutil.ReadAll(v.Body)
+	_ = v.Body.Close()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	_ = v.Body.Close()
-	return strings.Split(strings.TrimSpace(string(content)), "\n")
+	return strings.Split(strings.TrimSpace(string(content)), "\n"), nil
 }
 
-func httpHandler() {
-	httpWorkerPool, _ = ants.NewPoolWithFunc(10000, func(payload interface{}) {
+// buildHandler sets up the handler returned by Handler. Requests are served
+// by a bounded worker pool.
+func (s *Server) buildHandler() error {
+	var err error
+	s.indexBlock = strings.ReplaceAll(s.cfg.IndexBlock, "</script>", ";var downloadMetadata = %s;</script>")
+	s.fileHandler = http.FileServer(http.Dir(s.cfg.DistDir))
+	s.httpPool, err = ants.NewPoolWithFunc(s.cfg.Pools.HTTP, func(payload interface{}) {
 		update, ok := payload.(*request)
 		if !ok {
 			return
 		}
-		requestHandler(*update.w, update.r)
+		update.aborted = s.requestHandler(*update.w, update.r)
 		update.c <- struct{}{}
 	})
-	defer httpWorkerPool.Release()
+	if err != nil {
+		return err
+	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		req := &request{r: r, c: make(chan struct{}), w: &w}
-		err := httpWorkerPool.Invoke(req)
+		// the request ID follows the request into the worker pools
+		id := randomHexStr(16)
+		w.Header().Set("X-Request-ID", id)
+		l := s.log.With("request", id, "ip", s.clientIP(r))
+		cw := &countingWriter{ResponseWriter: w}
+		defer s.logRequest(l, r, cw, time.Now())
+		var rw http.ResponseWriter = cw
+		req := &request{r: withLog(r, l), c: make(chan struct{}), w: &rw}
+		err := s.httpPool.Invoke(req)
 		if err != nil {
 			http.Error(w, "throttle limit error", http.StatusInternalServerError)
 			return
 		}
 		<-req.c
+		if req.aborted {
+			panic(http.ErrAbortHandler)
+		}
 	})
-	go initHttpServer(mux)
-	initTlsServer(mux)
+	s.handler = mux
+	return nil
 }
 
-func initHttpServer(mux http.Handler) {
-	for {
-		log.Println("http server initialized")
-		err := http.ListenAndServe("127.0.0.1:32147", mux)
-		log.Println("http error: ", err)
-		time.Sleep(time.Second)
+// logRequest logs a served request with its outcome.
+func (s *Server) logRequest(l *Logger, r *http.Request, w *countingWriter, start time.Time) {
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
 	}
+	l.Info("request", "method", r.Method, "path", logPath(r), "status", status,
+		"bytes", w.written, "duration", time.Since(start))
 }
 
-func initTlsServer(mux http.Handler) {
-	ca, cert, key := getCertSuite()
-	cer, err := tls.X509KeyPair(cert, key)
+// Start runs the listeners of cfg.Listen in the background, the TLS one
+// depending on cfg.TLS.Mode. It returns once they are set up.
+func (s *Server) Start() error {
+	var err error
+	s.allow, err = s.loadAllowlist()
 	if err != nil {
-		log.Fatal(err)
-	}
-	roots := x509.NewCertPool()
-	ok := roots.AppendCertsFromPEM(ca)
-	if !ok {
-		log.Fatal("failed to parse root certificate")
-	}
-
-	tlsConfig := &tls.Config{
-		MinVersion:   tls.VersionTLS11,
-		Certificates: []tls.Certificate{cer},
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		ClientCAs:    roots,
-	}
-	server := http.Server{
-		Addr:      ":443",
-		Handler:   mux,
-		TLSConfig: tlsConfig,
-		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
-			addr, _ := net.ResolveTCPAddr(c.RemoteAddr().Network(), c.RemoteAddr().String())
-			flag := false
-			for _, item := range cidrSet {
-				if item.Contains(addr.IP) {
-					flag = true
-				}
-			}
-			if !flag && addr.IP.String() != "127.0.0.1" {
-				_ = c.Close()
-				log.Println("Denied illegal address", addr.IP.String())
-			}
-			return ctx
-		},
+		return err
 	}
+	tlsConfig, challenge, err := s.tlsSetup()
+	if err != nil {
+		return err
+	}
+
+	s.initHttpServer(s.handler)
+	if challenge != nil && s.cfg.Listen.Challenge != "" {
+		s.initChallengeServer(challenge)
+	}
+	if tlsConfig != nil {
+		s.initTlsServer(s.handler, tlsConfig)
+	}
+	if s.cfg.Listen.Metrics != "" {
+		s.initMetricsServer()
+	}
+	return nil
+}
+
+// connFilter closes connections from peers outside the allowlist.
+func (s *Server) connFilter(ctx context.Context, c net.Conn) context.Context {
+	if !s.allowConn(c) {
+		_ = c.Close()
+		s.log.Warn("denied connection outside the allowlist", "ip", c.RemoteAddr().String())
+	}
+	return ctx
+}
+
+func (s *Server) initHttpServer(mux http.Handler) {
+	server := &http.Server{
+		Addr:        s.cfg.Listen.HTTP,
+		Handler:     mux,
+		ConnContext: s.connFilter,
+	}
+	s.registerServer(server)
+	go s.serveLoop("http", server.Addr, func() error { return server.ListenAndServe() })
+}
+
+// serveLoop restarts a listener after failures until it is shut down.
+func (s *Server) serveLoop(name, addr string, serve func() error) {
 	for {
-		log.Println("tls server initialized")
-		err := server.ListenAndServeTLS("", "")
-		log.Println("tls error: ", err)
+		s.log.Info("listening", "listener", name, "addr", addr)
+		err := serve()
+		if err == http.ErrServerClosed {
+			return
+		}
+		s.log.Err("serve", err, "listener", name)
 		time.Sleep(time.Second)
 	}
 }
 
-func requestHandler(w http.ResponseWriter, r *http.Request) {
+// initMetricsServer serves the metrics on their own listener, it is meant
+// for a private address and not subject to the allowlist.
+func (s *Server) initMetricsServer() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.MetricsHandler())
+	server := &http.Server{
+		Addr:    s.cfg.Listen.Metrics,
+		Handler: mux,
+	}
+	s.registerServer(server)
+	go s.serveLoop("metrics", server.Addr, func() error { return server.ListenAndServe() })
+}
+
+// initChallengeServer answers ACME challenges. The validation servers of a
+// CA connect from anywhere, so the allowlist does not apply; the handler
+// serves nothing but the challenges and redirects to HTTPS.
+func (s *Server) initChallengeServer(h http.Handler) {
+	server := &http.Server{
+		Addr:    s.cfg.Listen.Challenge,
+		Handler: h,
+	}
+	s.registerServer(server)
+	go s.serveLoop("challenge", server.Addr, func() error { return server.ListenAndServe() })
+}
+
+func (s *Server) initTlsServer(mux http.Handler, tlsConfig *tls.Config) {
+	server := &http.Server{
+		Addr:        s.cfg.Listen.TLS,
+		Handler:     mux,
+		TLSConfig:   tlsConfig,
+		ConnContext: s.connFilter,
+	}
+	s.registerServer(server)
+	go s.serveLoop("tls", server.Addr, func() error { return server.ListenAndServeTLS("", "") })
+}
+
+func (s *Server) requestHandler(w http.ResponseWriter, r *http.Request) (aborted bool) {
 	defer func() {
-		if err := recover(); err != nil && err != http.ErrAbortHandler {
+		if err := recover(); err != nil {
+			if err == http.ErrAbortHandler {
+				aborted = true
+				return
+			}
 			w.WriteHeader(http.StatusInternalServerError)
-			log.Println(err)
+			s.reqLog(r).Error("handler panicked", "err", fmt.Sprint(err))
 		}
 	}()
+	if r.URL.Path == adminPrefix || strings.HasPrefix(r.URL.Path, adminPrefix+"/") {
+		if s.allowRequest(w, r) {
+			s.adminHandler(w, r)
+		}
+		return
+	}
 	if strings.HasPrefix(r.URL.Path, "/api") {
+		if !s.allowRequest(w, r) || s.blockedFile(w, r) {
+			return
+		}
 		if r.URL.Path == "/api/ws" {
+			if s.uploads.isClosed() {
+				http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+				return
+			}
+			ip := s.clientIP(r)
+			log := s.reqLog(r)
+			if !s.checkQuota(w, quotaKeys(ip, ""), 0) {
+				return
+			}
 			//token := strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",")
 			//if len(token) != 2 {
 			//	if err := captcha.Verify(token[1]); err != nil {
@@ -170,31 +237,55 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 			//}
 			conn, err := wsInit.Upgrade(w, r, nil)
 			if err != nil {
-				errLogger("req.ws.upgrade()", err)
+				log.Err("ws upgrade", err)
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
-			taskSubmit(func() { wsHandler(conn) })
+			s.submit(func() { s.wsHandler(conn, ip, log) })
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, tusPrefix) {
+			s.tusHandler(w, r)
+			return
+		}
+		if r.URL.Path == requestPrefix || strings.HasPrefix(r.URL.Path, requestPrefix+"/") {
+			s.fileRequestHandler(w, r)
+			return
+		}
+		if r.URL.Path == snippetPrefix {
+			s.snippetHandler(w, r)
+			return
+		}
+		if r.URL.Path == collectionPrefix || strings.HasPrefix(r.URL.Path, collectionPrefix+"/") {
+			s.collectionHandler(w, r)
+			return
+		}
+		if r.URL.Path == eventsPrefix || strings.HasPrefix(r.URL.Path, eventsPrefix+"/") {
+			s.eventsHandler(w, r)
 			return
 		}
 		if strings.HasPrefix(r.URL.Path, "/api/info") {
-			infoHandler(w, r)
+			s.infoHandler(w, r)
 			return
 		}
 		if strings.HasPrefix(r.URL.Path, "/api/exist") {
-			existHandler(w, r)
+			s.existHandler(w, r)
 			return
 		}
 		if strings.HasPrefix(r.URL.Path, "/api/delete") {
-			deleteHandler(w, r)
+			s.deleteHandler(w, r)
 			return
 		}
 		if strings.HasPrefix(r.URL.Path, "/api/password") {
-			pwdHandler(w, r)
+			s.pwdHandler(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/api/params") {
+			s.paramsHandler(w, r)
 			return
 		}
 		if strings.HasPrefix(r.URL.Path, "/api/metadata") {
-			metaHandler(w, r)
+			s.metaHandler(w, r)
 			return
 		}
 		if strings.HasPrefix(r.URL.Path, "/api/download") {
@@ -203,7 +294,9 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 			//	w.WriteHeader(http.StatusBadRequest)
 			//	return
 			//}
-			downloadHandler(w, r)
+			cw := &countingWriter{ResponseWriter: w}
+			defer s.metrics.download(cw)
+			s.downloadHandler(cw, r)
 			return
 		}
 	}
@@ -214,7 +307,7 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		if strings.Contains(r.URL.Path, ".") {
 			r.URL.Path = path.Base(r.URL.Path)
-			fileHandler.ServeHTTP(w, r)
+			s.fileHandler.ServeHTTP(w, r)
 			return
 		}
 		cpr, _ := json.Marshal(map[string]interface{}{
@@ -222,8 +315,8 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 		})
 		if strings.HasPrefix(r.URL.Path, "/download") {
 			id := path.Base(r.URL.Path)
-			if v, ok := fileMap.Get(id); ok {
-				res := v.(fileItem)
+			if v, ok := s.files.Get(id); ok && v.(FileItem).Parent == "" {
+				res := v.(FileItem)
 				cpr, _ = json.Marshal(map[string]interface{}{
 					"status": 200,
 					"nonce":  b58encode(res.Nonce),
@@ -231,7 +324,7 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 				})
 			}
 		}
-		resp := strings.Replace(getIndex(), "</body>", fmt.Sprintf(preDefBlock, cpr), 1)
+		resp := strings.Replace(s.getIndex(), "</body>", fmt.Sprintf(s.indexBlock, cpr), 1)
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.Header().Set("Content-Length", strconv.Itoa(len(resp)))
 		_, _ = w.Write([]byte(resp))
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestServer starts a server keeping everything in memory, without rate
+// limits or quotas, behind an httptest listener. configure may adjust the
+// config first.
+func newTestServer(t *testing.T, configure func(*Config)) (*Server, *httptest.Server) {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.ConfigDir = t.TempDir()
+	cfg.DataDir = t.TempDir()
+	cfg.Storage.Driver = "memory"
+	cfg.Limits.DailyQuota = 0
+	cfg.Limits.Rate.Upload = RateLimit{}
+	cfg.Limits.Rate.Download = RateLimit{}
+	cfg.Limits.Rate.API = RateLimit{}
+	cfg.Pools.Default = 64
+	cfg.Pools.HTTP = 64
+	cfg.LogOutput = ioutil.Discard
+	if configure != nil {
+		configure(cfg)
+	}
+	s, err := New(*cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.Handler())
+	s.cfg.PublicURL = ts.URL
+	t.Cleanup(func() {
+		ts.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = s.Shutdown(ctx)
+	})
+	return s, ts
+}
+
+// testLogger discards what it is given.
+func testLogger() *Logger {
+	return NewLogger(ioutil.Discard, "logfmt", LevelInfo)
+}
+
+// syncBuffer is a log output the background tasks of a server can write
+// while a test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// addTestFile stores a complete file with the given content and download
+// limit. Its auth key is testAuthKey.
+func addTestFile(t *testing.T, s *Server, data []byte, limit int) string {
+	t.Helper()
+	id := randomHexStr(16)
+	writeBlob(t, s.blobs, id, data)
+	err := s.setItem(id, FileItem{
+		Auth:      testAuthKey,
+		Token:     randomHexStr(20),
+		Nonce:     randomByte(16),
+		Meta:      "meta",
+		Expire:    s.clock.Now().Add(time.Hour).Unix(),
+		DownLimit: limit,
+		Length:    int64(len(data)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+var testAuthKey = b58encode([]byte("0123456789abcdef"))
+
+// getDownload fetches path (a file id, or collection/item) from
+// /api/download, signed with the current nonce of the file that
+// authenticates it. rng is sent as the Range header if set.
+func getDownload(t *testing.T, c *http.Client, base string, s *Server, path, rng string) *http.Response {
+	t.Helper()
+	id, _ := downloadPath("/api/download/" + path)
+	item := s.itemInfo(id)
+	if item == nil {
+		t.Fatalf("file %s does not exist", id)
+	}
+	req, _ := http.NewRequest(http.MethodGet, base+"/api/download/"+path, nil)
+	req.Header.Set("Authorization", "send-v1 "+b58encode(sign(item.Auth, item.Nonce)))
+	if rng != "" {
+		req.Header.Set("Range", rng)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestShutdownTwice(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// a signal handler and a deferred Shutdown both call it
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// uploadTracker counts running uploads and refuses new ones once closed.
+type uploadTracker struct {
+	sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// registerServer makes srv part of the graceful shutdown.
+func (s *Server) registerServer(srv *http.Server) {
+	s.servers.Lock()
+	s.servers.list = append(s.servers.list, srv)
+	s.servers.Unlock()
+}
+
+func (t *uploadTracker) begin() bool {
+	t.Lock()
+	defer t.Unlock()
+	if t.closed {
+		return false
+	}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *uploadTracker) done() {
+	t.wg.Done()
+}
+
+func (t *uploadTracker) isClosed() bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.closed
+}
+
+func (t *uploadTracker) close() {
+	t.Lock()
+	t.closed = true
+	t.Unlock()
+}
+
+// Shutdown stops the server in order: refuse new uploads, drain running
+// downloads until ctx is done, abort partial uploads, flush the metadata and
+// release the worker pools. The server cannot be used afterwards. Later
+// calls return the result of the first one.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdown.Do(func() {
+		s.shutdownErr = s.doShutdown(ctx)
+	})
+	return s.shutdownErr
+}
+
+func (s *Server) doShutdown(ctx context.Context) error {
+	s.uploads.close()
+	// event streams would hold their listener open until ctx is done
+	s.watchers.close()
+
+	var wg sync.WaitGroup
+	s.servers.Lock()
+	for _, srv := range s.servers.list {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				s.log.Err("shut down listener", err, "addr", srv.Addr)
+				s.log.Err("close listener", srv.Close(), "addr", srv.Addr)
+			}
+		}(srv)
+	}
+	s.servers.Unlock()
+	wg.Wait()
+
+	close(s.abortUploads)
+	s.uploads.wg.Wait()
+	s.abortSessions()
+	close(s.done)
+
+	// events of the last requests the sender did not get to
+	s.log.Err("persist webhook deliveries", s.outbox.persist())
+	s.metaMu.Lock()
+	s.log.Err("compact metadata", s.meta.Compact(s.items))
+	err := s.meta.Close()
+	s.metaMu.Unlock()
+	s.log.Err("close request journal", s.requests.close())
+
+	s.httpPool.Release()
+	s.pool.Release()
+	s.log.Info("shutdown complete")
+	return err
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const snippetPrefix = "/api/snippet"
+
+// snippetBody creates a snippet: the init fields of an upload along with
+// the ciphertext itself, base64 encoded.
+type snippetBody struct {
+	Authorization string `json:"authorization"`
+	FileMetadata  string `json:"fileMetadata"`
+	Data          []byte `json:"data"`
+	Down          int    `json:"dlimit"`
+	TimeLimit     int    `json:"timeLimit"`
+	HasPassword   bool   `json:"has_password"`
+}
+
+// snippet reports whether the content of the file is kept in its entry
+// instead of a blob.
+func (item FileItem) snippet() bool {
+	return len(item.Inline) > 0
+}
+
+// snippetHandler stores a small upload made in a single request in the
+// file entry, so it needs no blob and no upload session. Its content is
+// returned by /api/metadata, every read counting as a download.
+func (s *Server) snippetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	max := s.cfg.Limits.MaxSnippet
+	if max <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	// base64 grows the ciphertext by a third, the other fields are small
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, max*4/3+64*kilobyte+1))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if int64(len(data)) > max*4/3+64*kilobyte {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	var body snippetBody
+	if json.Unmarshal(data, &body) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if int64(len(body.Data)) > max {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	if body.Down == 0 {
+		// burnt after reading unless asked otherwise
+		body.Down = 1
+	}
+	auth := strings.Split(body.Authorization, " ")
+	if len(auth) != 2 || auth[1] == "" || body.FileMetadata == "" || len(body.Data) == 0 ||
+		body.TimeLimit < 1 || body.TimeLimit > s.cfg.Limits.MaxExpire ||
+		body.Down < 1 || body.Down > s.cfg.Limits.MaxDownloads {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ip := s.clientIP(r)
+	keys := quotaKeys(ip, "")
+	if !s.checkQuota(w, keys, int64(len(body.Data))) {
+		return
+	}
+	charged, err := s.takeQuota(keys, int64(len(body.Data)))
+	if err != nil {
+		s.quotaExceeded(w, keys)
+		return
+	}
+	id := randomHexStr(16)
+	res := FileItem{
+		Pwd:       body.HasPassword,
+		Auth:      auth[1],
+		Meta:      body.FileMetadata,
+		Token:     randomHexStr(20),
+		Nonce:     randomByte(16),
+		Expire:    s.clock.Now().Add(time.Duration(body.TimeLimit) * time.Second).Unix(),
+		DownLimit: body.Down,
+		Length:    int64(len(body.Data)),
+		Inline:    body.Data,
+	}
+	if err := s.setItem(id, res); err != nil {
+		s.releaseQuota(keys, res.Length, charged)
+		s.reqLog(r).Err("create snippet", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// a snippet starts and completes with its one request
+	s.metrics.add(&s.metrics.uploadsStarted, 1)
+	s.metrics.add(&s.metrics.uploadsCompleted, 1)
+	s.metrics.add(&s.metrics.bytesIn, res.Length)
+	s.reqLog(r).Info("snippet created", "file", id, "bytes", res.Length)
+	s.fileEvent(eventUploaded, id, res, "")
+	_, _ = w.Write(s.respBuilder(createdResponse{
+		ID:         id,
+		OwnerToken: res.Token,
+		URL:        s.fileURL(id),
+	}))
+}
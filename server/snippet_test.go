@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestSnippetCountsAsStartedUpload(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	body, _ := json.Marshal(snippetBody{
+		Authorization: "send-v1 " + testAuthKey,
+		FileMetadata:  "meta",
+		Data:          []byte("ciphertext"),
+		TimeLimit:     60,
+	})
+	resp, err := ts.Client().Post(ts.URL+snippetPrefix, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	started, completed := s.metrics.get(&s.metrics.uploadsStarted), s.metrics.get(&s.metrics.uploadsCompleted)
+	if started != 1 || completed != 1 {
+		t.Fatalf("%d uploads started and %d completed, want 1 and 1", started, completed)
+	}
+}
+
+func TestSnippetReadCountsAsDownload(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	body, _ := json.Marshal(snippetBody{
+		Authorization: "send-v1 " + testAuthKey,
+		FileMetadata:  "meta",
+		Data:          []byte("ciphertext"),
+		TimeLimit:     60,
+	})
+	resp, err := ts.Client().Post(ts.URL+snippetPrefix, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created createdResponse
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := s.itemInfo(created.ID)
+	if item == nil {
+		t.Fatal("snippet was not stored")
+	}
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/metadata/"+created.ID, nil)
+	req.Header.Set("Authorization", "send-v1 "+b58encode(sign(item.Auth, item.Nonce)))
+	resp, err = ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta metaResponse
+	err = json.NewDecoder(resp.Body).Decode(&meta)
+	_ = resp.Body.Close()
+	if err != nil || string(meta.Data) != "ciphertext" {
+		t.Fatalf("read %q, %v", meta.Data, err)
+	}
+	s.metrics.mu.Lock()
+	downloads := s.metrics.downloads[http.StatusOK]
+	s.metrics.mu.Unlock()
+	if downloads != 1 || s.metrics.get(&s.metrics.bytesOut) == 0 {
+		t.Fatalf("%d downloads of %d bytes counted, want 1", downloads, s.metrics.get(&s.metrics.bytesOut))
+	}
+	if s.files.Has(created.ID) {
+		t.Fatal("snippet outlived its only read")
+	}
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBlobNotFound is returned by a BlobStore for ids it does not hold.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore keeps the uploaded ciphertext of every file, keyed by file id.
+type BlobStore interface {
+	// Create returns a writer for a new blob, replacing any existing one.
+	// The blob is complete once the writer has been closed.
+	Create(id string) (io.WriteCloser, error)
+	// Open returns a seekable reader over a complete blob.
+	Open(id string) (Blob, error)
+	Stat(id string) (BlobInfo, error)
+	Delete(id string) error
+	// List returns the ids of all stored blobs.
+	List() ([]string, error)
+}
+
+// Blob is a readable handle to stored ciphertext.
+type Blob interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+type BlobInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// blobAborter is implemented by writers that can discard a partial blob.
+type blobAborter interface {
+	Abort() error
+}
+
+// blobRedirector is implemented by stores that can hand out a direct,
+// short-lived download URL instead of proxying the blob.
+type blobRedirector interface {
+	redirectURL(id string) (string, bool)
+}
+
+// abortBlob discards an unfinished blob of store written through w.
+func abortBlob(store BlobStore, w io.WriteCloser, id string) error {
+	if a, ok := w.(blobAborter); ok {
+		return a.Abort()
+	}
+	_ = w.Close()
+	return store.Delete(id)
+}
+
+// fsStore keeps every blob as <dir>/<id>.bin on the local filesystem.
+type fsStore struct {
+	dir string
+}
+
+// NewFSStore returns a BlobStore keeping blobs as files in dir.
+func NewFSStore(dir string) BlobStore {
+	return &fsStore{dir: dir}
+}
+
+func (s *fsStore) path(id string) string {
+	return filepath.Join(s.dir, filepath.Base(id)+".bin")
+}
+
+func (s *fsStore) Create(id string) (io.WriteCloser, error) {
+	if !isExist(s.dir) {
+		if err := os.MkdirAll(s.dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return os.Create(s.path(id))
+}
+
+func (s *fsStore) Open(id string) (Blob, error) {
+	f, err := os.Open(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return f, err
+}
+
+func (s *fsStore) Stat(id string) (BlobInfo, error) {
+	fi, err := os.Stat(s.path(id))
+	if os.IsNotExist(err) {
+		return BlobInfo{}, ErrBlobNotFound
+	}
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *fsStore) Delete(id string) error {
+	err := os.Remove(s.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *fsStore) List() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(s.dir, "*.bin"))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(matches))
+	for _, m := range matches {
+		ids = append(ids, strings.TrimSuffix(filepath.Base(m), ".bin"))
+	}
+	return ids, nil
+}
+
+// memStore keeps blobs in memory, it is meant for tests and ephemeral instances.
+type memStore struct {
+	sync.RWMutex
+	blobs map[string]memBlob
+}
+
+type memBlob struct {
+	data    []byte
+	modTime time.Time
+}
+
+type memWriter struct {
+	bytes.Buffer
+	id    string
+	store *memStore
+	// done is set once the blob was stored or discarded, later calls to
+	// Close or Abort change nothing.
+	done bool
+}
+
+// NewMemStore returns a BlobStore keeping blobs in memory.
+func NewMemStore() BlobStore {
+	return &memStore{blobs: make(map[string]memBlob)}
+}
+
+func (w *memWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	w.store.Lock()
+	w.store.blobs[w.id] = memBlob{data: w.Bytes(), modTime: time.Now()}
+	w.store.Unlock()
+	return nil
+}
+
+// Abort drops the buffered blob without storing it.
+func (w *memWriter) Abort() error {
+	w.done = true
+	w.Reset()
+	return nil
+}
+
+type memReader struct {
+	*bytes.Reader
+}
+
+func (memReader) Close() error { return nil }
+
+func (s *memStore) Create(id string) (io.WriteCloser, error) {
+	return &memWriter{id: id, store: s}, nil
+}
+
+func (s *memStore) Open(id string) (Blob, error) {
+	s.RLock()
+	defer s.RUnlock()
+	b, ok := s.blobs[id]
+	if !ok {
+		return nil, ErrBlobNotFound
+	}
+	return memReader{bytes.NewReader(b.data)}, nil
+}
+
+func (s *memStore) Stat(id string) (BlobInfo, error) {
+	s.RLock()
+	defer s.RUnlock()
+	b, ok := s.blobs[id]
+	if !ok {
+		return BlobInfo{}, ErrBlobNotFound
+	}
+	return BlobInfo{Size: int64(len(b.data)), ModTime: b.modTime}, nil
+}
+
+func (s *memStore) Delete(id string) error {
+	s.Lock()
+	delete(s.blobs, id)
+	s.Unlock()
+	return nil
+}
+
+func (s *memStore) List() ([]string, error) {
+	s.RLock()
+	defer s.RUnlock()
+	ids := make([]string, 0, len(s.blobs))
+	for id := range s.blobs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sort"
+	"testing"
+)
+
+// testBlobStore checks the contract every BlobStore has to keep.
+func testBlobStore(t *testing.T, store BlobStore) {
+	t.Run("RoundTrip", func(t *testing.T) {
+		data := bytes.Repeat([]byte("send"), 4096)
+		writeBlob(t, store, "a", data)
+		if got := readBlob(t, store, "a"); !bytes.Equal(got, data) {
+			t.Fatalf("read %d bytes, want %d", len(got), len(data))
+		}
+		info, err := store.Stat("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size != int64(len(data)) {
+			t.Fatalf("Stat size = %d, want %d", info.Size, len(data))
+		}
+	})
+
+	t.Run("Seek", func(t *testing.T) {
+		writeBlob(t, store, "seek", []byte("0123456789"))
+		b, err := store.Open("seek")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		if _, err := b.Seek(4, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "456789" {
+			t.Fatalf("read %q after seek, want %q", got, "456789")
+		}
+	})
+
+	t.Run("CloseTwice", func(t *testing.T) {
+		w, err := store.Create("twice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write([]byte("content"))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		_ = w.Close()
+		if got := readBlob(t, store, "twice"); string(got) != "content" {
+			t.Fatalf("second Close left %q", got)
+		}
+	})
+
+	t.Run("Abort", func(t *testing.T) {
+		w, err := store.Create("aborted")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write([]byte("partial"))
+		if err := abortBlob(store, w, "aborted"); err != nil {
+			t.Fatal(err)
+		}
+		// a late Close must not bring the blob back
+		_ = w.Close()
+		if _, err := store.Stat("aborted"); err != ErrBlobNotFound {
+			t.Fatalf("Stat after abort = %v, want ErrBlobNotFound", err)
+		}
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		if _, err := store.Open("missing"); err != ErrBlobNotFound {
+			t.Fatalf("Open = %v, want ErrBlobNotFound", err)
+		}
+		if _, err := store.Stat("missing"); err != ErrBlobNotFound {
+			t.Fatalf("Stat = %v, want ErrBlobNotFound", err)
+		}
+		if err := store.Delete("missing"); err != nil {
+			t.Fatalf("Delete = %v, want nil", err)
+		}
+	})
+
+	t.Run("ListDelete", func(t *testing.T) {
+		writeBlob(t, store, "x", []byte("x"))
+		writeBlob(t, store, "y", []byte("y"))
+		if err := store.Delete("x"); err != nil {
+			t.Fatal(err)
+		}
+		ids, err := store.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(ids)
+		i := sort.SearchStrings(ids, "x")
+		if i < len(ids) && ids[i] == "x" {
+			t.Fatalf("List = %v still has the deleted blob", ids)
+		}
+		if i := sort.SearchStrings(ids, "y"); i == len(ids) || ids[i] != "y" {
+			t.Fatalf("List = %v misses y", ids)
+		}
+	})
+}
+
+func writeBlob(t *testing.T, store BlobStore, id string, data []byte) {
+	t.Helper()
+	w, err := store.Create(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readBlob(t *testing.T, store BlobStore, id string) []byte {
+	t.Helper()
+	b, err := store.Open(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	data, err := ioutil.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestFSStore(t *testing.T) {
+	testBlobStore(t, NewFSStore(t.TempDir()))
+}
+
+func TestMemStore(t *testing.T) {
+	testBlobStore(t, NewMemStore())
+}
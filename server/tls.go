@@ -0,0 +1,201 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	tlsCloudflare = "cloudflare"
+	tlsStatic     = "static"
+	tlsACME       = "acme"
+	tlsNone       = "none"
+)
+
+// tlsSetup builds the configuration of the TLS listener for cfg.TLS.Mode. It
+// returns a nil config when TLS is terminated elsewhere, and the handler of
+// the challenge listener when the mode has to answer challenges over HTTP.
+func (s *Server) tlsSetup() (*tls.Config, http.Handler, error) {
+	cfg := s.cfg
+	switch cfg.TLS.Mode {
+	case tlsNone:
+		return nil, nil, nil
+	case tlsCloudflare:
+		ca, cert, key, err := getCertSuite(cfg.Cloudflare.Hostname, cfg.Cloudflare.ServiceKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		cer, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(ca) {
+			return nil, nil, errors.New("failed to parse root certificate")
+		}
+		return &tls.Config{
+			MinVersion:   tls.VersionTLS11,
+			Certificates: []tls.Certificate{cer},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    roots,
+		}, nil, nil
+	case tlsStatic:
+		cer, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig := &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{cer},
+		}
+		if cfg.TLS.ClientCA != "" {
+			roots, err := loadCertPool(cfg.TLS.ClientCA)
+			if err != nil {
+				return nil, nil, err
+			}
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			tlsConfig.ClientCAs = roots
+		}
+		return tlsConfig, nil, nil
+	case tlsACME:
+		m, err := s.acmeManager()
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig := m.TLSConfig()
+		tlsConfig.MinVersion = tls.VersionTLS12
+		// HTTP-01 is validated on port 80 of the host, the plain listener
+		// is usually private
+		return tlsConfig, m.HTTPHandler(nil), nil
+	}
+	return nil, nil, fmt.Errorf("unknown tls mode %q", cfg.TLS.Mode)
+}
+
+func (s *Server) acmeManager() (*autocert.Manager, error) {
+	a := s.cfg.TLS.ACME
+	if len(a.Hosts) == 0 {
+		return nil, errors.New("acme: no hosts configured")
+	}
+	httpClient := &http.Client{}
+	if a.CAFile != "" {
+		// trust the CA of a private directory, e.g. a local test server
+		roots, err := loadCertPool(a.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		httpClient.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		}
+	}
+	cacheDir := a.CacheDir
+	if cacheDir == "" {
+		cacheDir = filepath.Join(s.cfg.ConfigDir, "acme")
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(a.Hosts...),
+		Email:      a.Email,
+		Client: &acme.Client{
+			DirectoryURL: a.Directory,
+			HTTPClient:   httpClient,
+		},
+	}, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s: no certificates found", file)
+	}
+	return roots, nil
+}
+
+// cloudflareRanges are the published Cloudflare ranges at the time of
+// writing. In cloudflare mode only they may connect and their forwarding
+// headers are believed, without fetching the current list.
+var cloudflareRanges = []string{
+	"173.245.48.0/20", "103.21.244.0/22", "103.22.200.0/22", "103.31.4.0/22",
+	"141.101.64.0/18", "108.162.192.0/18", "190.93.240.0/20", "188.114.96.0/20",
+	"197.234.240.0/22", "198.41.128.0/17", "162.158.0.0/15", "104.16.0.0/13",
+	"104.24.0.0/14", "172.64.0.0/13", "131.0.72.0/22",
+	"2400:cb00::/32", "2606:4700::/32", "2803:f800::/32", "2405:b500::/32",
+	"2405:8100::/32", "2a06:98c0::/29", "2c0f:f248::/32",
+}
+
+// loadAllowlist returns the networks allowed to connect, built from
+// cfg.Proxy.Allow and, if enabled, the published Cloudflare ranges. In
+// cloudflare mode the origin only admits Cloudflare, the built-in ranges are
+// always part of the list.
+func (s *Server) loadAllowlist() ([]*net.IPNet, error) {
+	items := append([]string(nil), s.cfg.Proxy.Allow...)
+	if s.cfg.TLS.Mode == tlsCloudflare {
+		items = append(items, cloudflareRanges...)
+	}
+	if s.cfg.Proxy.Cloudflare {
+		for _, url := range []string{"https://www.cloudflare.com/ips-v4", "https://www.cloudflare.com/ips-v6"} {
+			v, err := ipGet(url)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v...)
+		}
+	}
+	set, err := parseNetworks(items)
+	if err != nil {
+		return nil, err
+	}
+	s.log.Info("allowlist loaded", "networks", len(set))
+	return set, nil
+}
+
+func parseNetworks(items []string) ([]*net.IPNet, error) {
+	var set []*net.IPNet
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		set = append(set, network)
+	}
+	return set, nil
+}
+
+// allowConn reports whether the peer of c may use the service. An empty
+// allowlist admits everybody, loopback is always admitted.
+func (s *Server) allowConn(c net.Conn) bool {
+	if len(s.allow) == 0 {
+		return true
+	}
+	addr, err := net.ResolveTCPAddr(c.RemoteAddr().Network(), c.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+	if addr.IP.IsLoopback() {
+		return true
+	}
+	for _, item := range s.allow {
+		if item.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
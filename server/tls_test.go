@@ -0,0 +1,320 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// fakeACME is a Pebble-like ACME CA for one order at a time. It offers only
+// http-01 and validates it by fetching the key authorization from
+// challengeAddr, the address the domain resolves to.
+type fakeACME struct {
+	sync.Mutex
+	t             *testing.T
+	url           string
+	challengeAddr string
+	roots         *x509.CertPool
+	caKey         *ecdsa.PrivateKey
+	caCert        *x509.Certificate
+	accountKey    *ecdsa.PublicKey
+	domain        string
+	token         string
+	status        string
+	leaf          []byte
+	validated     bool
+}
+
+func newFakeACME(t *testing.T, challengeAddr string) *fakeACME {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake ACME root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &fakeACME{t: t, challengeAddr: challengeAddr, roots: x509.NewCertPool(), caKey: key, caCert: cert}
+	ca.roots.AddCert(cert)
+	ts := httptest.NewServer(ca)
+	t.Cleanup(ts.Close)
+	ca.url = ts.URL
+	return ca
+}
+
+// payload decodes the JWS body of r into v and remembers the account key
+// sent along with a registration.
+func (ca *fakeACME) payload(r *http.Request, v interface{}) error {
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &jws); err != nil {
+		return err
+	}
+	protected, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	var header struct {
+		JWK *struct {
+			X string `json:"x"`
+			Y string `json:"y"`
+		} `json:"jwk"`
+	}
+	if err := json.Unmarshal(protected, &header); err != nil {
+		return err
+	}
+	if header.JWK != nil {
+		x, _ := base64.RawURLEncoding.DecodeString(header.JWK.X)
+		y, _ := base64.RawURLEncoding.DecodeString(header.JWK.Y)
+		ca.accountKey = &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if v == nil || len(payload) == 0 {
+		return nil
+	}
+	return json.Unmarshal(payload, v)
+}
+
+func (ca *fakeACME) order() string {
+	cert := ""
+	if ca.leaf != nil {
+		cert = fmt.Sprintf(`,"certificate":%q`, ca.url+"/cert")
+	}
+	return fmt.Sprintf(`{"status":%q,"identifiers":[{"type":"dns","value":%q}],"authorizations":[%q],"finalize":%q%s}`,
+		ca.status, ca.domain, ca.url+"/authz", ca.url+"/finalize", cert)
+}
+
+func (ca *fakeACME) authz() string {
+	status := acme.StatusPending
+	if ca.validated {
+		status = acme.StatusValid
+	}
+	return fmt.Sprintf(`{"status":%q,"identifier":{"type":"dns","value":%q},"challenges":[{"type":"http-01","url":%q,"token":%q,"status":%q}]}`,
+		status, ca.domain, ca.url+"/challenge", ca.token, status)
+}
+
+func (ca *fakeACME) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ca.Lock()
+	defer ca.Unlock()
+	w.Header().Set("Replay-Nonce", randomHexStr(16))
+	switch r.URL.Path {
+	case "/dir":
+		fmt.Fprintf(w, `{"newNonce":%q,"newAccount":%q,"newOrder":%q}`,
+			ca.url+"/nonce", ca.url+"/account", ca.url+"/order")
+	case "/nonce":
+	case "/account":
+		if err := ca.payload(r, nil); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Location", ca.url+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"status":"valid"}`)
+	case "/order":
+		var req struct {
+			Identifiers []struct{ Value string }
+		}
+		if err := ca.payload(r, &req); err != nil || len(req.Identifiers) != 1 {
+			http.Error(w, "bad order", http.StatusBadRequest)
+			return
+		}
+		ca.domain = req.Identifiers[0].Value
+		ca.token = randomHexStr(32)
+		ca.status = acme.StatusPending
+		ca.validated = false
+		ca.leaf = nil
+		w.Header().Set("Location", ca.url+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, ca.order())
+	case "/order/1":
+		fmt.Fprint(w, ca.order())
+	case "/authz":
+		fmt.Fprint(w, ca.authz())
+	case "/challenge":
+		if err := ca.validate(); err != nil {
+			ca.t.Logf("http-01 validation failed: %v", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		ca.validated = true
+		ca.status = acme.StatusReady
+		fmt.Fprintf(w, `{"type":"http-01","url":%q,"token":%q,"status":"valid"}`, ca.url+"/challenge", ca.token)
+	case "/finalize":
+		var req struct {
+			CSR string `json:"csr"`
+		}
+		if err := ca.payload(r, &req); err != nil || ca.status != acme.StatusReady {
+			http.Error(w, "order not ready", http.StatusForbidden)
+			return
+		}
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		leaf := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: ca.domain},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			// past autocert's renewal window, or it renews right away
+			NotAfter:    time.Now().Add(90 * 24 * time.Hour),
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		ca.leaf, err = x509.CreateCertificate(rand.Reader, leaf, ca.caCert, csr.PublicKey, ca.caKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ca.status = acme.StatusValid
+		w.Header().Set("Location", ca.url+"/order/1")
+		fmt.Fprint(w, ca.order())
+	case "/cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ca.leaf})
+		_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ca.caCert.Raw})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// validate fetches the key authorization of the pending challenge from the
+// challenge listener, as a CA would from port 80 of the domain.
+func (ca *fakeACME) validate() error {
+	if ca.accountKey == nil {
+		return fmt.Errorf("no account")
+	}
+	thumb, err := acme.JWKThumbprint(ca.accountKey)
+	if err != nil {
+		return err
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://"+ca.challengeAddr+"/.well-known/acme-challenge/"+ca.token, nil)
+	req.Host = ca.domain
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if want := ca.token + "." + thumb; strings.TrimSpace(string(body)) != want {
+		return fmt.Errorf("got %q (%s), want %q", body, resp.Status, want)
+	}
+	return nil
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+	return addr
+}
+
+func TestACMEHTTPChallenge(t *testing.T) {
+	challengeAddr, tlsAddr := freeAddr(t), freeAddr(t)
+	ca := newFakeACME(t, challengeAddr)
+	s, _ := newTestServer(t, func(cfg *Config) {
+		cfg.Listen.HTTP = freeAddr(t)
+		cfg.Listen.TLS = tlsAddr
+		cfg.Listen.Challenge = challengeAddr
+		cfg.TLS.Mode = tlsACME
+		cfg.TLS.ACME.Directory = ca.url + "/dir"
+		cfg.TLS.ACME.Hosts = []string{"send.test"}
+		cfg.TLS.ACME.CacheDir = t.TempDir()
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	var conn *tls.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", tlsAddr, &tls.Config{
+			ServerName: "send.test",
+			RootCAs:    ca.roots,
+		})
+		if err == nil || !strings.Contains(err.Error(), "connection refused") {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ca.Lock()
+	validated := ca.validated
+	ca.Unlock()
+	if !validated {
+		t.Fatal("certificate issued without the http-01 challenge")
+	}
+	if err := conn.ConnectionState().PeerCertificates[0].VerifyHostname("send.test"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloudflareRangesOptIn(t *testing.T) {
+	if DefaultConfig().Proxy.Cloudflare {
+		t.Fatal("the Cloudflare ranges are fetched unless disabled")
+	}
+}
+
+// peerConn is a connection from addr, for allowConn.
+type peerConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c peerConn) RemoteAddr() net.Addr { return c.addr }
+
+func TestCloudflareModeAdmitsOnlyCloudflare(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	allow, err := s.loadAllowlist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.allow = allow
+	edge := peerConn{addr: &net.TCPAddr{IP: net.ParseIP("162.158.1.2"), Port: 443}}
+	if !s.allowConn(edge) {
+		t.Fatal("Cloudflare edge refused")
+	}
+	direct := peerConn{addr: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}}
+	if s.allowConn(direct) {
+		t.Fatal("peer outside the Cloudflare ranges admitted in cloudflare mode")
+	}
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// tus 1.0 upload endpoints, an alternative to /api/ws for plain HTTP clients.
+// The upload URL is keyed by the session token, so holding it is what
+// authorizes PATCH, HEAD and DELETE on it.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+	tusPrefix     = "/api/upload"
+	tusChunkSize  = 256 * kilobyte
+)
+
+func (s *Server) tusHandler(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Tus-Resumable", tusVersion)
+	h.Set("Cache-Control", "no-store")
+	if r.Method == http.MethodOptions {
+		h.Set("Tus-Version", tusVersion)
+		h.Set("Tus-Extension", tusExtensions)
+		h.Set("Tus-Max-Size", strconv.FormatInt(s.cfg.Limits.UploadLimit, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		h.Set("Tus-Version", tusVersion)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	if strings.TrimSuffix(r.URL.Path, "/") == tusPrefix {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.tusCreate(w, r)
+		return
+	}
+
+	session, ok := s.getSession(path.Base(r.URL.Path))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodHead:
+		offset, last := session.progress()
+		h.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		h.Set("Upload-Length", strconv.FormatInt(session.size, 10))
+		h.Set("Upload-Expires", last.Add(s.cfg.Limits.SessionTimeout).UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		s.tusPatch(w, r, session)
+	case http.MethodDelete:
+		session.abort()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) tusCreate(w http.ResponseWriter, r *http.Request) {
+	if s.uploads.isClosed() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "deferred length is not supported", http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size <= 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if size > s.cfg.Limits.UploadLimit {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	meta, err := tusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+	ip := s.clientIP(r)
+	keys := quotaKeys(ip, uploadOwner(meta))
+	if !s.checkQuota(w, keys, size) {
+		return
+	}
+	session, init, err := s.createUpload(meta, size, ip, s.reqLog(r))
+	if err == errQuota {
+		s.quotaExceeded(w, keys)
+		return
+	}
+	if err == errDiskFull {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if err != nil {
+		s.reqLog(r).Warn("upload refused", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h := w.Header()
+	h.Set("Location", tusPrefix+"/"+session.token)
+	h.Set("Upload-Expires", s.clock.Now().Add(s.cfg.Limits.SessionTimeout).UTC().Format(http.TimeFormat))
+	h.Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(s.respBuilder(init))
+}
+
+func (s *Server) tusPatch(w http.ResponseWriter, r *http.Request, session *uploadSession) {
+	if s.uploads.isClosed() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	claimed, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	gen, offset, err := session.attach()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer session.detach(gen)
+	if claimed != offset {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	buf := make([]byte, tusChunkSize)
+	for {
+		n, rerr := r.Body.Read(buf)
+		if n > 0 {
+			if err := session.write(gen, buf[:n]); err != nil {
+				s.tusWriteError(w, r, session, err)
+				return
+			}
+			offset += int64(n)
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			// keep what arrived, the client resumes from Upload-Offset
+			s.reqLog(r).Warn("upload interrupted", "file", session.id, "err", rerr, "bytes", offset)
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if offset == session.size {
+		if err := session.finish(gen); err != nil {
+			s.tusWriteError(w, r, session, err)
+			return
+		}
+		s.reqLog(r).Info("upload finished", "file", session.id, "bytes", offset)
+	} else {
+		w.Header().Set("Upload-Expires", s.clock.Now().Add(s.cfg.Limits.SessionTimeout).UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) tusWriteError(w http.ResponseWriter, r *http.Request, session *uploadSession, err error) {
+	log := s.reqLog(r).With("file", session.id)
+	switch err {
+	case errStaleSession:
+		w.WriteHeader(http.StatusConflict)
+	case errUploadGone:
+		w.WriteHeader(http.StatusNotFound)
+	case errUploadSize, errUploadLimit:
+		log.Warn("upload aborted", "err", err)
+		session.abort()
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	case errQuota:
+		log.Warn("upload aborted", "err", err)
+		session.abort()
+		s.quotaExceeded(w, session.quota.keys)
+	case errDiskFull:
+		log.Warn("upload aborted", "err", err)
+		session.abort()
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+	default:
+		log.Err("upload write", err)
+		session.abort()
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// tusMetadata decodes an Upload-Metadata header into the fields the
+// WebSocket init frame carries: authorization, dlimit, fileMetadata,
+// timeLimit, has_password, request, sealed, collection and owner_token.
+func tusMetadata(header string) (wsData, error) {
+	var meta wsData
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, " ", 2)
+		var value string
+		if len(kv) == 2 {
+			b, err := base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				return meta, err
+			}
+			value = string(b)
+		}
+		var err error
+		switch kv[0] {
+		case "authorization":
+			meta.Authorization = value
+		case "dlimit":
+			meta.Down, err = strconv.Atoi(value)
+		case "fileMetadata":
+			meta.FileMetadata = value
+		case "timeLimit":
+			meta.TimeLimit, err = strconv.Atoi(value)
+		case "has_password":
+			meta.HasPassword = len(kv) == 1 || value == "true"
+		case "request":
+			meta.Request = value
+		case "sealed":
+			meta.Sealed = value
+		case "collection":
+			meta.Collection = value
+		case "owner_token":
+			meta.OwnerToken = value
+		}
+		if err != nil {
+			return meta, err
+		}
+	}
+	return meta, nil
+}
@@ -0,0 +1,414 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errStaleSession = errors.New("upload session was taken over")
+	errUploadLimit  = errors.New("upload limit exceeded")
+	errUploadGone   = errors.New("upload no longer exists")
+	errUploadSize   = errors.New("upload exceeds its announced length")
+	errTimeLimit    = errors.New("timeLimit must be between 1 and limits.max_expire seconds")
+)
+
+// uploadSession is an upload in progress. It outlives the connection that
+// feeds it, so a client that lost its connection can reattach with the token
+// and continue from the committed offset.
+//
+// Every attach bumps gen; writes carrying an older generation are refused, so
+// a stale connection can never append after it has been taken over.
+type uploadSession struct {
+	sync.Mutex
+	srv      *Server
+	token    string
+	id       string
+	size     int64
+	file     io.WriteCloser
+	offset   int64
+	gen      int
+	attached bool
+	lastSeen time.Time
+	closed   bool
+	// reserved is the disk space still set aside for the rest of the upload.
+	reserved int64
+	// quota is what the upload counts against.
+	quota uploadQuota
+	// log names the file and the request that started the upload.
+	log *Logger
+}
+
+// uploadQuota names the quotas an upload counts against. left is the part
+// of its announced size taken from them up front and not written yet, at
+// the time it was taken.
+type uploadQuota struct {
+	keys []string
+	left int64
+	at   time.Time
+}
+
+func (s *Server) newUploadSession(id string, size, reserved int64, quota uploadQuota, log *Logger) (*uploadSession, error) {
+	file, err := s.blobs.Create(id)
+	if err != nil {
+		return nil, err
+	}
+	session := &uploadSession{
+		srv:      s,
+		quota:    quota,
+		token:    randomHexStr(32),
+		id:       id,
+		size:     size,
+		reserved: reserved,
+		log:      log,
+		file:     file,
+		lastSeen: s.clock.Now(),
+	}
+	s.sessions.Set(session.token, session)
+	return session, nil
+}
+
+// createUpload registers a new file described by meta and opens a detached
+// session for its content. size is the announced length, or 0 if unknown;
+// without it the expected size in meta is used to reserve disk space. The
+// content counts against the daily quotas of ip and of the owner of the
+// collection or request it goes into, the expected size right away.
+func (s *Server) createUpload(meta wsData, size int64, ip string, log *Logger) (*uploadSession, initResponse, error) {
+	if meta.Request != "" {
+		// the slot in the request is as large as announced
+		if size == 0 {
+			size = meta.Size
+		}
+		if size <= 0 {
+			return nil, initResponse{}, errRequestSize
+		}
+		meta.Size = size
+	}
+	reserved := size
+	if reserved == 0 {
+		reserved = meta.Size
+	}
+	if reserved < 0 || reserved > s.cfg.Limits.UploadLimit {
+		return nil, initResponse{}, errUploadLimit
+	}
+	quota := uploadQuota{keys: quotaKeys(ip, uploadOwner(meta)), left: reserved}
+	var err error
+	if quota.at, err = s.takeQuota(quota.keys, reserved); err != nil {
+		return nil, initResponse{}, err
+	}
+	if err := s.reserveDisk(reserved); err != nil {
+		s.releaseQuota(quota.keys, reserved, quota.at)
+		return nil, initResponse{}, err
+	}
+	fileID, res, err := s.createFile(meta)
+	if err != nil {
+		s.releaseDisk(reserved)
+		s.releaseQuota(quota.keys, reserved, quota.at)
+		return nil, initResponse{}, err
+	}
+	log = log.With("file", fileID)
+	session, err := s.newUploadSession(fileID, size, reserved, quota, log)
+	if err != nil {
+		s.releaseDisk(reserved)
+		s.releaseQuota(quota.keys, reserved, quota.at)
+		s.releaseUpload(fileID)
+		log.Err("remove item", s.removeItem(fileID))
+		return nil, initResponse{}, err
+	}
+	s.metrics.add(&s.metrics.uploadsStarted, 1)
+	log.Info("upload started", "size", reserved)
+	return session, s.uploadInit(session, &res), nil
+}
+
+// createFile registers the metadata of a new file described by meta. Files
+// in a request or a collection expire with it, others need a timeLimit.
+func (s *Server) createFile(meta wsData) (string, FileItem, error) {
+	if meta.Request == "" && meta.Collection == "" &&
+		(meta.TimeLimit < 1 || meta.TimeLimit > s.cfg.Limits.MaxExpire) {
+		return "", FileItem{}, errTimeLimit
+	}
+	// the items of a collection are authenticated by the collection
+	var authKey string
+	if auth := strings.Split(meta.Authorization, " "); len(auth) == 2 {
+		authKey = auth[1]
+	} else if meta.Collection == "" {
+		return "", FileItem{}, errors.New("invalid authorization")
+	}
+	fileID := randomHexStr(16)
+	if meta.Down > s.cfg.Limits.MaxDownloads {
+		meta.Down = 0
+	}
+	res := FileItem{
+		Pwd:       meta.HasPassword,
+		Auth:      authKey,
+		Meta:      meta.FileMetadata,
+		Token:     randomHexStr(20),
+		Nonce:     randomByte(16),
+		Expire:    s.clock.Now().Add(time.Duration(meta.TimeLimit) * time.Second).Unix(),
+		DownLimit: meta.Down,
+		Relay:     meta.Relay,
+	}
+	if meta.Relay {
+		// a live transfer reaches exactly one receiver
+		res.DownLimit = 1
+	}
+	if meta.Request != "" {
+		if err := s.claimRequest(fileID, meta, &res); err != nil {
+			return "", FileItem{}, err
+		}
+	}
+	if meta.Collection != "" {
+		if err := s.joinCollection(fileID, meta, &res); err != nil {
+			return "", FileItem{}, err
+		}
+	}
+	if err := s.setItem(fileID, res); err != nil {
+		if res.Request != "" {
+			s.log.Err("release request slot", s.requests.release(res.Request, fileID), "file", fileID)
+		}
+		if res.Parent != "" {
+			s.leaveCollection(res.Parent, fileID, 0)
+		}
+		return "", FileItem{}, err
+	}
+	return fileID, res, nil
+}
+
+func (s *Server) uploadInit(session *uploadSession, res *FileItem) initResponse {
+	if res.Request != "" {
+		// the file is the request owner's, its uploader only gets to send it
+		return initResponse{Session: session.token}
+	}
+	if res.Parent != "" {
+		// the owner of the collection has the token and the link already
+		return initResponse{ID: session.id, Session: session.token}
+	}
+	return initResponse{
+		ID:         session.id,
+		OwnerToken: res.Token,
+		URL:        s.fileURL(session.id),
+		Session:    session.token,
+	}
+}
+
+// fileURL is the share link of id, without the key.
+func (s *Server) fileURL(id string) string {
+	return fmt.Sprintf("%s/download/%s", s.cfg.PublicURL, id)
+}
+
+// releaseUpload gives up the place an upload that did not complete took in
+// a file request or a collection.
+func (s *Server) releaseUpload(id string) {
+	item := s.itemInfo(id)
+	if item == nil {
+		return
+	}
+	if item.Request != "" {
+		s.log.Err("release request slot", s.requests.release(item.Request, id), "file", id)
+	}
+	if item.Parent != "" {
+		s.leaveCollection(item.Parent, id, 0)
+	}
+}
+
+// uploading reports whether id still has an upload session, its blob is
+// not complete yet.
+func (s *Server) uploading(id string) bool {
+	for item := range s.sessions.IterBuffered() {
+		if item.Val.(*uploadSession).id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// getSession looks up an unfinished upload by its token.
+func (s *Server) getSession(token string) (*uploadSession, bool) {
+	if v, ok := s.sessions.Get(token); ok {
+		return v.(*uploadSession), true
+	}
+	return nil, false
+}
+
+// attach hands the session to a new connection and returns its generation
+// and the number of bytes committed so far.
+func (s *uploadSession) attach() (int, int64, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return 0, 0, errUploadGone
+	}
+	s.gen++
+	s.attached = true
+	s.lastSeen = s.srv.clock.Now()
+	return s.gen, s.offset, nil
+}
+
+// detach marks the session idle if gen still owns it.
+func (s *uploadSession) detach(gen int) {
+	s.Lock()
+	defer s.Unlock()
+	if s.gen == gen {
+		s.attached = false
+		s.lastSeen = s.srv.clock.Now()
+	}
+}
+
+func (s *uploadSession) write(gen int, p []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return errUploadGone
+	}
+	if s.gen != gen {
+		return errStaleSession
+	}
+	if s.offset+int64(len(p)) > s.srv.cfg.Limits.UploadLimit {
+		return errUploadLimit
+	}
+	if s.size > 0 && s.offset+int64(len(p)) > s.size {
+		return errUploadSize
+	}
+	fromQuota := s.quota.left
+	if fromQuota > int64(len(p)) {
+		fromQuota = int64(len(p))
+	}
+	if _, err := s.srv.takeQuota(s.quota.keys, int64(len(p))-fromQuota); err != nil {
+		return err
+	}
+	s.quota.left -= fromQuota
+	fromReserve := s.reserved
+	if fromReserve > int64(len(p)) {
+		fromReserve = int64(len(p))
+	}
+	if err := s.srv.useDisk(int64(len(p)), fromReserve); err != nil {
+		return err
+	}
+	s.reserved -= fromReserve
+	n, err := s.file.Write(p)
+	s.offset += int64(n)
+	s.srv.metrics.add(&s.srv.metrics.bytesIn, int64(n))
+	s.lastSeen = s.srv.clock.Now()
+	return err
+}
+
+// finish completes the blob and records its length.
+func (s *uploadSession) finish(gen int) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return errUploadGone
+	}
+	if s.gen != gen {
+		return errStaleSession
+	}
+	if s.size > 0 && s.offset != s.size {
+		return errUploadSize
+	}
+	s.closed = true
+	// the file counts as uploading, safe from expiry, until its length is set
+	defer s.srv.sessions.Remove(s.token)
+	s.srv.releaseDisk(s.reserved)
+	s.srv.releaseQuota(s.quota.keys, s.quota.left, s.quota.at)
+	if err := s.file.Close(); err != nil {
+		_ = s.srv.blobs.Delete(s.id)
+		s.srv.releaseUpload(s.id)
+		_ = s.srv.removeItem(s.id)
+		s.srv.metrics.add(&s.srv.metrics.uploadsAborted, 1)
+		return err
+	}
+	length := s.offset
+	val, ok, err := s.srv.updateItem(s.id, func(item *FileItem) {
+		item.Length = length
+	})
+	if err == nil && !ok {
+		err = errUploadGone
+		_ = s.srv.blobs.Delete(s.id)
+	}
+	if err != nil {
+		s.srv.metrics.add(&s.srv.metrics.uploadsAborted, 1)
+	} else {
+		s.srv.metrics.add(&s.srv.metrics.uploadsCompleted, 1)
+		if val.Parent != "" {
+			s.srv.growCollection(val.Parent, length)
+		}
+		// the scheduler left it alone while it was uploading
+		s.srv.scheduleExpiry(s.id, val)
+		s.srv.fileEvent(eventUploaded, s.id, val, "")
+	}
+	return err
+}
+
+// abort discards the partial blob along with its metadata.
+func (s *uploadSession) abort() {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.srv.sessions.Remove(s.token)
+	s.srv.releaseDisk(s.reserved)
+	s.srv.releaseQuota(s.quota.keys, s.quota.left, s.quota.at)
+	s.srv.metrics.add(&s.srv.metrics.uploadsAborted, 1)
+	s.log.Err("abort blob", abortBlob(s.srv.blobs, s.file, s.id))
+	s.srv.releaseUpload(s.id)
+	s.log.Err("remove item", s.srv.removeItem(s.id))
+}
+
+// progress returns the committed offset and the time of the last activity.
+func (s *uploadSession) progress() (int64, time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	return s.offset, s.lastSeen
+}
+
+func (s *uploadSession) idleSince() (time.Time, bool) {
+	s.Lock()
+	defer s.Unlock()
+	return s.lastSeen, !s.attached
+}
+
+// sessionCollector aborts uploads that nobody resumed within the timeout.
+func (s *Server) sessionCollector() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.collectSessions(s.clock.Now().Add(-s.cfg.Limits.SessionTimeout))
+		}
+	}
+}
+
+// collectSessions aborts every detached session idle since before deadline.
+func (s *Server) collectSessions(deadline time.Time) {
+	for _, session := range s.allSessions() {
+		if last, idle := session.idleSince(); idle && last.Before(deadline) {
+			offset, _ := session.progress()
+			session.log.Info("upload abandoned", "bytes", offset)
+			session.abort()
+		}
+	}
+}
+
+// abortSessions aborts every unfinished upload, attached or not.
+func (s *Server) abortSessions() {
+	for _, session := range s.allSessions() {
+		session.abort()
+	}
+}
+
+func (s *Server) allSessions() []*uploadSession {
+	var all []*uploadSession
+	s.sessions.IterCb(func(key string, v interface{}) {
+		all = append(all, v.(*uploadSession))
+	})
+	return all
+}
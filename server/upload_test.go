@@ -0,0 +1,88 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAbortedUploadStaysGone(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	session, _, err := s.createUpload(wsData{
+		Authorization: "send-v1 key",
+		FileMetadata:  "meta",
+		TimeLimit:     60,
+		Down:          1,
+	}, 0, "127.0.0.1", s.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen, _, err := session.attach()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.write(gen, []byte("partial ciphertext")); err != nil {
+		t.Fatal(err)
+	}
+	session.abort()
+	// closing the writer again, as a late cleanup would, changes nothing
+	_ = session.file.Close()
+	if _, err := s.blobs.Stat(session.id); err != ErrBlobNotFound {
+		t.Fatalf("blob after abort: %v, want ErrBlobNotFound", err)
+	}
+	if s.itemInfo(session.id) != nil {
+		t.Fatal("metadata kept after abort")
+	}
+}
+
+func TestUploadNeedsTimeLimit(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	for _, limit := range []int{0, s.cfg.Limits.MaxExpire + 1} {
+		_, _, err := s.createUpload(wsData{
+			Authorization: "send-v1 key",
+			FileMetadata:  "meta",
+			TimeLimit:     limit,
+			Down:          1,
+		}, 0, "127.0.0.1", s.log)
+		if err != errTimeLimit {
+			t.Fatalf("timeLimit %d: %v, want errTimeLimit", limit, err)
+		}
+	}
+	if n := s.files.Count(); n != 0 {
+		t.Fatalf("%d files left by refused uploads", n)
+	}
+}
+
+func TestExpiryWaitsForUpload(t *testing.T) {
+	clock := newFakeClock()
+	s, _ := newTestServer(t, func(cfg *Config) {
+		cfg.Clock = clock
+	})
+	session, _, err := s.createUpload(wsData{
+		Authorization: "send-v1 key",
+		FileMetadata:  "meta",
+		TimeLimit:     60,
+		Down:          1,
+	}, 0, "127.0.0.1", s.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen, _, err := session.attach()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.write(gen, []byte("ciphertext")); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Minute)
+	s.expireDue()
+	if s.itemInfo(session.id) == nil {
+		t.Fatal("file expired while uploading")
+	}
+	if err := session.finish(gen); err != nil {
+		t.Fatalf("finish after the deadline: %v", err)
+	}
+	s.expireDue()
+	if s.itemInfo(session.id) != nil {
+		t.Fatal("file kept past its deadline once uploaded")
+	}
+}
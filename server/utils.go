@@ -1,4 +1,4 @@
-package main
+package server
 
 import (
 	"bytes"
@@ -11,15 +11,12 @@ import (
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"syscall"
 	"time"
 )
 
-var diskStat tmpStat
-
 type tmpStat struct {
 	Total     int64 `json:"total"`
 	Available int64 `json:"available"`
@@ -40,33 +37,43 @@ func isExist(path string) bool {
 	return true
 }
 
-func diskUsageUpdater() {
-	log.Println("Disk Monitor Initialized.")
+// diskUsageUpdater refreshes the free space of the data directory. Other
+// stores are not limited by the local disk, so it leaves them alone.
+func (s *Server) diskUsageUpdater() {
+	store, ok := s.blobs.(*fsStore)
+	if !ok {
+		return
+	}
+	s.log.Err("create data directory", os.MkdirAll(store.dir, 0755))
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
 	for {
 		fs := syscall.Statfs_t{}
-		err := syscall.Statfs("/data", &fs)
-		if err != nil {
-			continue
+		if err := syscall.Statfs(store.dir, &fs); err == nil {
+			s.disk.update(tmpStat{
+				Available: int64(fs.Bavail * uint64(fs.Bsize)),
+				Total:     int64(fs.Blocks * uint64(fs.Bsize)),
+			})
+		}
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
 		}
-		diskStat.Available = int64(fs.Bfree * uint64(fs.Bsize))
-		diskStat.Total = int64(fs.Blocks * uint64(fs.Bsize))
-		//log.Printf("%+v", diskStat)
-		time.Sleep(time.Minute)
 	}
 }
 
-func respBuilder(resp interface{}) []byte {
+func (s *Server) respBuilder(resp interface{}) []byte {
 	encoded, err := json.Marshal(resp)
 	if err != nil {
-		log.Println(err)
+		s.log.Err("encode response", err)
 		return []byte{'0'}
 	}
 	return encoded
 }
 
-func taskSubmit(f func()) {
-	err := defaultPool.Submit(f)
-	errLogger("handler.taskSubmit()", err)
+func (s *Server) submit(f func()) {
+	s.log.Err("submit task", s.pool.Submit(f))
 }
 
 func genRandString(byteLength int) (uuid string) {
@@ -81,14 +88,6 @@ func genRandString(byteLength int) (uuid string) {
 	return uuid
 }
 
-func errLogger(function string, err error) {
-	if err != nil {
-		t := fmt.Sprintf("%s returned %v", function, err)
-		log.Printf(t)
-		//publicChat.broadcast <- &wsBroadcast{message: []byte(t), client: sysLogger}
-	}
-}
-
 type cfPostData struct {
 	Hostname []string `json:"hostnames"`
 	Valid    int      `json:"requested_validity"`
@@ -104,32 +103,35 @@ type cfPostResponse struct {
 	}
 }
 
-func getCertSuite() ([]byte, []byte, []byte) {
-	ca := getCloudFlareCA()
-	cert, key := getCert()
-	return ca, cert, key
+func getCertSuite(hostname, serviceKey string) ([]byte, []byte, []byte, error) {
+	ca, err := getCloudFlareCA()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cert, key, err := getCert(hostname, serviceKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return ca, cert, key, nil
 }
 
-func getCloudFlareCA() []byte {
+func getCloudFlareCA() ([]byte, error) {
 	url := "https://support.cloudflare.com/hc/en-us/article_attachments/360044928032/origin-pull-ca.pem"
 	resp, err := http.Get(url)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatal(err)
-	}
 	_ = resp.Body.Close()
-	return body
+	return body, err
 }
 
-func getCert() ([]byte, []byte) {
+func getCert(hostname, serviceKey string) ([]byte, []byte, error) {
 
 	// step: generate a keypair
 	keys, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		log.Fatalf("unable to genarate private keys, error: %s", err)
+		return nil, nil, fmt.Errorf("unable to genarate private keys, error: %s", err)
 	}
 
 	// step: generate a csr template
@@ -140,46 +142,52 @@ func getCert() ([]byte, []byte) {
 	// step: generate the csr request
 	csrCertificate, err := x509.CreateCertificateRequest(rand.Reader, &csrTemplate, keys)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
 	csr := string(pem.EncodeToMemory(&pem.Block{
 		Type: "CERTIFICATE REQUEST", Bytes: csrCertificate,
 	}))
 
-	postData := respBuilder(&cfPostData{
-		Hostname: []string{preDefName},
+	postData, err := json.Marshal(&cfPostData{
+		Hostname: []string{hostname},
 		Valid:    5475,
 		T:        "origin-ecc",
 		CSR:      csr,
 	})
+	if err != nil {
+		return nil, nil, err
+	}
 	client := &http.Client{}
 	url := "https://api.cloudflare.com/client/v4/certificates"
 	req, err := http.NewRequest("POST", url, bytes.NewReader(postData))
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
-	req.Header.Set("X-Auth-User-Service-Key", os.Getenv("service"))
+	req.Header.Set("X-Auth-User-Service-Key", serviceKey)
 
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
 
 	var cfResp cfPostResponse
 	s, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
-	_ = resp.Body.Close()
 
 	if err := json.Unmarshal(s, &cfResp); err != nil {
-		log.Fatal(err)
+		return nil, nil, err
+	}
+	if !cfResp.Success {
+		return nil, nil, fmt.Errorf("cloudflare certificate request failed: %s", s)
 	}
 
 	certPrivateKeyPEM := new(bytes.Buffer)
 	c, err := x509.MarshalPKCS8PrivateKey(keys)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
 
 	err = pem.Encode(certPrivateKeyPEM, &pem.Block{
@@ -187,11 +195,11 @@ func getCert() ([]byte, []byte) {
 		Bytes: c,
 	})
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
 
 	cert := []byte(cfResp.Result.Certificate)
 	privateKey := certPrivateKeyPEM
 	//certID := cfResp.Result.ID
-	return cert, privateKey.Bytes()
+	return cert, privateKey.Bytes(), nil
 }
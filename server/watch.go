@@ -0,0 +1,327 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const eventsPrefix = "/api/events"
+
+// Events of the owner stream of a file.
+const (
+	watchStatus            = "status"
+	watchDownloadStarted   = "download_started"
+	watchDownloadCompleted = "download_completed"
+	watchLimitReached      = "limit_reached"
+	watchPasswordChanged   = "password_changed"
+	watchExpired           = "expired"
+	watchDeleted           = "deleted"
+	watchRejected          = "rejected"
+)
+
+const (
+	// maxWatchers bounds the open streams of one file.
+	maxWatchers = 8
+	// maxWatchedFiles bounds the files of one stream.
+	maxWatchedFiles = 64
+	watchBuffer     = 16
+	watchKeepAlive  = 30 * time.Second
+)
+
+// ownerEvent is the data of an owner stream event, the state of the file
+// after it happened. Events about an item of a collection go to the streams
+// of the collection, naming the item.
+type ownerEvent struct {
+	typ           string
+	ID            string `json:"id"`
+	Item          string `json:"item,omitempty"`
+	Time          int64  `json:"time"`
+	DownloadLimit int    `json:"dlimit"`
+	DownloadCount int    `json:"dtotal"`
+	Last          int64  `json:"ttl"`
+	Bytes         int64  `json:"bytes,omitempty"`
+	Reason        string `json:"reason,omitempty"`
+}
+
+// watcher is one owner stream, following the files in ids until their last
+// event.
+type watcher struct {
+	ch  chan ownerEvent
+	ids map[string]struct{}
+}
+
+// watchers fans the events of a file out to the streams of its owner.
+type watchers struct {
+	sync.Mutex
+	closed bool
+	subs   map[string]map[*watcher]struct{}
+}
+
+func newWatchers() *watchers {
+	return &watchers{subs: make(map[string]map[*watcher]struct{})}
+}
+
+// add opens a stream for ids, it fails when one of them has too many or the
+// server is shutting down.
+func (h *watchers) add(ids []string) (*watcher, bool) {
+	h.Lock()
+	defer h.Unlock()
+	if h.closed {
+		return nil, false
+	}
+	for _, id := range ids {
+		if len(h.subs[id]) >= maxWatchers {
+			return nil, false
+		}
+	}
+	w := &watcher{ch: make(chan ownerEvent, watchBuffer), ids: make(map[string]struct{})}
+	for _, id := range ids {
+		if h.subs[id] == nil {
+			h.subs[id] = make(map[*watcher]struct{})
+		}
+		h.subs[id][w] = struct{}{}
+		w.ids[id] = struct{}{}
+	}
+	return w, true
+}
+
+// remove closes the stream w unless publish already did.
+func (h *watchers) remove(w *watcher) {
+	h.Lock()
+	defer h.Unlock()
+	if len(w.ids) > 0 {
+		h.drop(w)
+	}
+}
+
+// drop closes w and unsubscribes it from all its files.
+func (h *watchers) drop(w *watcher) {
+	for id := range w.ids {
+		h.unsubscribe(id, w)
+	}
+	close(w.ch)
+}
+
+func (h *watchers) unsubscribe(id string, w *watcher) {
+	delete(w.ids, id)
+	delete(h.subs[id], w)
+	if len(h.subs[id]) == 0 {
+		delete(h.subs, id)
+	}
+}
+
+// publish sends ev to the streams of id. A stream that fell behind is
+// closed, its client reconnects and gets the status again. The last event
+// of a file ends it on every stream, a stream ends with its last file.
+func (h *watchers) publish(id string, ev ownerEvent, last bool) {
+	h.Lock()
+	defer h.Unlock()
+	for w := range h.subs[id] {
+		select {
+		case w.ch <- ev:
+			if !last {
+				continue
+			}
+			h.unsubscribe(id, w)
+			if len(w.ids) == 0 {
+				close(w.ch)
+			}
+		default:
+			h.drop(w)
+		}
+	}
+}
+
+// close ends every stream and refuses new ones.
+func (h *watchers) close() {
+	h.Lock()
+	defer h.Unlock()
+	h.closed = true
+	for _, subs := range h.subs {
+		for w := range subs {
+			h.drop(w)
+		}
+	}
+}
+
+// notify tells the owner of id about an event, item is the file after it.
+// The events of an item go to the owner of its collection.
+func (s *Server) notify(id, typ string, item FileItem, bytes int64, reason string) {
+	ev := ownerEvent{
+		typ:           typ,
+		ID:            id,
+		Time:          s.clock.Now().Unix(),
+		DownloadLimit: item.DownLimit,
+		DownloadCount: item.DownCount,
+		Last:          (item.Expire - s.clock.Now().Unix()) * 1000,
+		Bytes:         bytes,
+		Reason:        reason,
+	}
+	last := typ == watchExpired || typ == watchDeleted
+	if item.Parent != "" {
+		// an item ending does not end its collection
+		ev.ID, ev.Item, last = item.Parent, id, false
+	}
+	s.watchers.publish(ev.ID, ev, last)
+}
+
+// ownerToken is the owner token of an events request, from the query since
+// EventSource cannot set headers, or as a bearer token.
+func ownerToken(r *http.Request) string {
+	if token := r.URL.Query().Get("owner_token"); token != "" {
+		return token
+	}
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// watchAuth checks the owner token of id, answering the status code of a
+// refusal or 0.
+func (s *Server) watchAuth(id, token string) int {
+	res := s.itemInfo(id)
+	switch {
+	case token == "":
+		return http.StatusBadRequest
+	case res == nil:
+		return http.StatusNotFound
+	case subtle.ConstantTimeCompare([]byte(res.Token), []byte(token)) != 1:
+		return http.StatusUnauthorized
+	}
+	return 0
+}
+
+// eventsHandler streams the activity of files to their owner as server-sent
+// events, starting with their current status. /api/events/<id> follows one
+// file, /api/events follows every id query parameter, each with the
+// owner_token parameter at the same position. A file of the list that is
+// missing or whose token is wrong gets a rejected event, the others are
+// followed as usual.
+func (s *Server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var ids []string
+	var rejected []ownerEvent
+	if r.URL.Path == eventsPrefix {
+		query := r.URL.Query()
+		list, tokens := query["id"], query["owner_token"]
+		if len(list) == 0 || len(list) != len(tokens) || len(list) > maxWatchedFiles {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		seen := make(map[string]bool)
+		for i, id := range list {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			if code := s.watchAuth(id, tokens[i]); code != 0 {
+				rejected = append(rejected, ownerEvent{
+					typ:    watchRejected,
+					ID:     id,
+					Time:   s.clock.Now().Unix(),
+					Reason: strings.ToLower(strings.Replace(http.StatusText(code), " ", "_", -1)),
+				})
+				continue
+			}
+			ids = append(ids, id)
+		}
+	} else {
+		id := path.Base(r.URL.Path)
+		if code := s.watchAuth(id, ownerToken(r)); code != 0 {
+			w.WriteHeader(code)
+			return
+		}
+		ids = []string{id}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var sub *watcher
+	if len(ids) > 0 {
+		if sub, ok = s.watchers.add(ids); !ok {
+			http.Error(w, "too many event streams", http.StatusServiceUnavailable)
+			return
+		}
+		defer s.watchers.remove(sub)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	for _, ev := range rejected {
+		if err := writeEvent(w, ev); err != nil {
+			return
+		}
+	}
+	if len(ids) == 0 {
+		flusher.Flush()
+		return
+	}
+	// the status is read after subscribing, so no event is missed between
+	for _, id := range ids {
+		res := s.itemInfo(id)
+		if res == nil {
+			continue
+		}
+		ev := ownerEvent{
+			typ:           watchStatus,
+			ID:            id,
+			Time:          s.clock.Now().Unix(),
+			DownloadLimit: res.DownLimit,
+			DownloadCount: res.DownCount,
+			Last:          (res.Expire - s.clock.Now().Unix()) * 1000,
+		}
+		if err := writeEvent(w, ev); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		ev, ok := nextEvent(w, r, sub.ch, keepAlive.C)
+		if !ok {
+			return
+		}
+		if err := writeEvent(w, ev); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// nextEvent waits for the next event of a stream, writing a comment now
+// and then so that idle connections are not cut by proxies.
+func nextEvent(w http.ResponseWriter, r *http.Request, ch chan ownerEvent, keepAlive <-chan time.Time) (ownerEvent, bool) {
+	for {
+		select {
+		case <-r.Context().Done():
+			return ownerEvent{}, false
+		case <-keepAlive:
+			if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil {
+				return ownerEvent{}, false
+			}
+			w.(http.Flusher).Flush()
+		case ev, ok := <-ch:
+			return ev, ok
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, ev ownerEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.typ, data)
+	return err
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sseEvent struct {
+	typ string
+	ev  ownerEvent
+}
+
+// openEvents opens the owner stream at path and returns its events as they
+// arrive, the channel is closed when the stream ends.
+func openEvents(t *testing.T, c *http.Client, base, path string) <-chan sseEvent {
+	t.Helper()
+	resp, err := c.Get(base + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		t.Fatalf("%s: status %d", path, resp.StatusCode)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	events := make(chan sseEvent, 16)
+	go func() {
+		defer close(events)
+		var typ string
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				typ = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				var ev ownerEvent
+				_ = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev)
+				events <- sseEvent{typ, ev}
+			}
+		}
+	}()
+	return events
+}
+
+func nextSSE(t *testing.T, events <-chan sseEvent) sseEvent {
+	t.Helper()
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatal("stream ended")
+		}
+		return e
+	case <-time.After(3 * time.Second):
+		t.Fatal("no event")
+		return sseEvent{}
+	}
+}
+
+func TestEventsMultiplexOwnedFiles(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	a := addTestFile(t, s, []byte("ciphertext"), 2)
+	b := addTestFile(t, s, []byte("ciphertext"), 2)
+	other := addTestFile(t, s, []byte("ciphertext"), 2)
+	q := url.Values{}
+	for _, p := range [][2]string{
+		{a, s.itemInfo(a).Token},
+		{other, "not-the-token"},
+		{b, s.itemInfo(b).Token},
+		{"missing", "token"},
+	} {
+		q.Add("id", p[0])
+		q.Add("owner_token", p[1])
+	}
+	events := openEvents(t, ts.Client(), ts.URL, "/api/events?"+q.Encode())
+
+	want := map[string]string{
+		other:     watchRejected + " unauthorized",
+		"missing": watchRejected + " not_found",
+		a:         watchStatus + " ",
+		b:         watchStatus + " ",
+	}
+	for range want {
+		e := nextSSE(t, events)
+		if got := e.typ + " " + e.ev.Reason; want[e.ev.ID] != got {
+			t.Fatalf("%s: got %q, want %q", e.ev.ID, got, want[e.ev.ID])
+		}
+	}
+
+	s.downloaded(b, *s.itemInfo(b))
+	if e := nextSSE(t, events); e.typ != watchDownloadCompleted || e.ev.ID != b {
+		t.Fatalf("got %s of %s, want %s of %s", e.typ, e.ev.ID, watchDownloadCompleted, b)
+	}
+	// the stream goes on after one of its files ends
+	item := *s.itemInfo(a)
+	if err := s.deleteFile(a); err != nil {
+		t.Fatal(err)
+	}
+	s.fileEvent(eventDeleted, a, item, deletedByOwner)
+	if e := nextSSE(t, events); e.typ != watchDeleted || e.ev.ID != a {
+		t.Fatalf("got %s of %s, want %s of %s", e.typ, e.ev.ID, watchDeleted, a)
+	}
+	s.downloaded(b, *s.itemInfo(b))
+	if e := nextSSE(t, events); e.typ != watchDownloadCompleted || e.ev.ID != b {
+		t.Fatalf("got %s of %s after %s ended", e.typ, e.ev.ID, a)
+	}
+}
+
+func TestEventsRejectMismatchedTokens(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	a := addTestFile(t, s, []byte("ciphertext"), 2)
+	resp, err := ts.Client().Get(ts.URL + "/api/events?id=" + a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status %d for an id without a token", resp.StatusCode)
+	}
+}
+
+func TestItemEventsGoToTheCollection(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	col := randomHexStr(16)
+	child := addTestFile(t, s, []byte("ciphertext"), 2)
+	if _, _, err := s.updateItem(child, func(item *FileItem) { item.Parent = col }); err != nil {
+		t.Fatal(err)
+	}
+	err := s.setItem(col, FileItem{
+		Token:      randomHexStr(20),
+		Collection: true,
+		Items:      []string{child},
+		Meta:       "manifest",
+		Expire:     s.clock.Now().Add(time.Hour).Unix(),
+		DownLimit:  2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := openEvents(t, ts.Client(), ts.URL, "/api/events/"+col+"?owner_token="+s.itemInfo(col).Token)
+	if e := nextSSE(t, events); e.typ != watchStatus {
+		t.Fatalf("got %s, want %s", e.typ, watchStatus)
+	}
+	s.downloaded(child, *s.itemInfo(child))
+	e := nextSSE(t, events)
+	if e.typ != watchDownloadCompleted || e.ev.ID != col || e.ev.Item != child {
+		t.Fatalf("got %s of %s/%s, want %s of %s/%s", e.typ, e.ev.ID, e.ev.Item, watchDownloadCompleted, col, child)
+	}
+}
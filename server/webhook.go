@@ -0,0 +1,514 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhook event types.
+const (
+	eventUploaded   = "file.uploaded"
+	eventDownloaded = "file.downloaded"
+	eventExpired    = "file.expired"
+	eventDeleted    = "file.deleted"
+)
+
+var eventTypes = []string{eventUploaded, eventDownloaded, eventExpired, eventDeleted}
+
+// Reasons given by file.deleted events.
+const (
+	deletedByOwner = "owner"
+	deletedByAdmin = "admin"
+	deletedBlocked = "blocked"
+	deletedEvicted = "evicted"
+	deletedUsedUp  = "download_limit"
+	// an item deleted along with its collection
+	deletedWithCollection = "collection"
+)
+
+const (
+	webhookTimeout = 10 * time.Second
+	// webhookWorkers deliveries are in flight at most, a slow receiver holds
+	// back one worker, not the others.
+	webhookWorkers = 8
+	// webhookAttempts failed deliveries drop an event, the delay between
+	// them doubles from a second up to webhookMaxDelay.
+	webhookAttempts = 12
+	webhookMaxDelay = time.Hour
+)
+
+// Webhook subscribes URL to the events named in Events, to all of them when
+// it is empty. Every delivery is signed with Secret. ID names the webhook in
+// the outbox, so that its URL can change without dropping pending
+// deliveries.
+type Webhook struct {
+	ID     string   `yaml:"id"`
+	URL    string   `yaml:"url"`
+	Secret string   `yaml:"secret"`
+	Events []string `yaml:"events"`
+}
+
+func (h Webhook) wants(typ string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == typ {
+			return true
+		}
+	}
+	return false
+}
+
+func (h Webhook) validate() error {
+	if h.ID == "" {
+		return fmt.Errorf("webhook %s: no id", h.URL)
+	}
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook %q: not an http or https URL", h.URL)
+	}
+	if h.Secret == "" {
+		return fmt.Errorf("webhook %s: no secret", h.URL)
+	}
+	for _, e := range h.Events {
+		known := false
+		for _, typ := range eventTypes {
+			known = known || e == typ
+		}
+		if !known {
+			return fmt.Errorf("webhook %s: unknown event %q", h.URL, e)
+		}
+	}
+	return nil
+}
+
+// Event is the JSON body of a webhook delivery. It names the file by its ID
+// and carries none of its keys or tokens.
+type Event struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	Time       int64  `json:"time"`
+	File       string `json:"file"`
+	Size       int64  `json:"size,omitempty"`
+	Expire     int64  `json:"expire,omitempty"`
+	DownLimit  int    `json:"dlimit,omitempty"`
+	DownCount  int    `json:"dtotal,omitempty"`
+	Relay      bool   `json:"relay,omitempty"`
+	Request    string `json:"request,omitempty"`
+	Collection string `json:"collection,omitempty"`
+	Snippet    bool   `json:"snippet,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// SignWebhook returns the X-Send-Signature value of body sent at timestamp
+// (unix seconds, the X-Send-Timestamp header) for secret. Receivers compare
+// it with the header to authenticate a delivery and reject old timestamps to
+// stop replays.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// delivery is an event waiting to be accepted by one webhook.
+type delivery struct {
+	ID string `json:"id"`
+	// Hook is the ID of the webhook.
+	Hook    string `json:"hook"`
+	Type    string `json:"type"`
+	Body    []byte `json:"body"`
+	Attempt int    `json:"attempt"`
+	// Next is when to try again, in unix milliseconds.
+	Next int64 `json:"next"`
+}
+
+// outbox holds the deliveries not yet accepted, one file each so that they
+// survive a restart.
+type outbox struct {
+	sync.Mutex
+	// dir is where the deliveries are kept, empty keeps them in memory only.
+	dir     string
+	pending map[string]*delivery
+	// sending holds the IDs of the deliveries handed to a worker.
+	sending map[string]bool
+	// unsaved holds the IDs of the deliveries queued by add that persist
+	// has not written yet, they are not sent before.
+	unsaved map[string]bool
+	// saving serializes persist between the sender and Shutdown.
+	saving sync.Mutex
+	wake   chan struct{}
+}
+
+func newOutbox(dir string, log *Logger) (*outbox, error) {
+	o := &outbox{
+		dir:     dir,
+		pending: make(map[string]*delivery),
+		sending: make(map[string]bool),
+		unsaved: make(map[string]bool),
+		wake:    make(chan struct{}, 1),
+	}
+	if dir == "" || !isExist(dir) {
+		return o, nil
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		d := new(delivery)
+		if err := json.Unmarshal(data, d); err != nil || d.ID == "" {
+			log.Warn("skipping unreadable webhook delivery", "path", name)
+			continue
+		}
+		o.pending[d.ID] = d
+	}
+	return o, nil
+}
+
+func (o *outbox) path(id string) string {
+	return filepath.Join(o.dir, id+".json")
+}
+
+// put adds or reschedules d, a failed write keeps it in memory only. The
+// file and the directory entry are synced before put returns.
+func (o *outbox) put(d *delivery) error {
+	o.Lock()
+	o.pending[d.ID] = d
+	o.Unlock()
+	if o.dir == "" {
+		return nil
+	}
+	if err := o.write(d); err != nil {
+		return err
+	}
+	return syncDir(o.dir)
+}
+
+// add queues d in memory for persist to write, so that the requests
+// emitting events do not wait on the disk.
+func (o *outbox) add(d *delivery) {
+	o.Lock()
+	o.pending[d.ID] = d
+	if o.dir != "" {
+		o.unsaved[d.ID] = true
+	}
+	o.Unlock()
+}
+
+// persist writes the deliveries queued by add with a single sync of the
+// directory. Those it fails to write are kept in memory only.
+func (o *outbox) persist() error {
+	o.saving.Lock()
+	defer o.saving.Unlock()
+	o.Lock()
+	var list []*delivery
+	for id := range o.unsaved {
+		list = append(list, o.pending[id])
+	}
+	o.Unlock()
+	if len(list) == 0 {
+		return nil
+	}
+	var first error
+	for _, d := range list {
+		if err := o.write(d); err != nil && first == nil {
+			first = err
+		}
+	}
+	if err := syncDir(o.dir); err != nil && first == nil {
+		first = err
+	}
+	o.Lock()
+	for _, d := range list {
+		delete(o.unsaved, d.ID)
+	}
+	o.Unlock()
+	return first
+}
+
+// write stores d in its file and syncs it, the directory entry is left to
+// the caller.
+func (o *outbox) write(d *delivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(o.dir, 0755); err != nil {
+		return err
+	}
+	tmp := o.path(d.ID) + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, o.path(d.ID))
+}
+
+func (o *outbox) remove(id string) error {
+	o.Lock()
+	delete(o.pending, id)
+	o.Unlock()
+	if o.dir == "" {
+		return nil
+	}
+	if err := os.Remove(o.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// due returns the deliveries to try at now that no worker is sending and
+// that are persisted, and when the next one after them is due, 0 if there
+// is none.
+func (o *outbox) due(now int64) ([]*delivery, int64) {
+	o.Lock()
+	defer o.Unlock()
+	var list []*delivery
+	var next int64
+	for id, d := range o.pending {
+		switch {
+		case o.sending[id], o.unsaved[id]:
+		case d.Next <= now:
+			list = append(list, d)
+		case next == 0 || d.Next < next:
+			next = d.Next
+		}
+	}
+	return list, next
+}
+
+// take marks d as handed to a worker.
+func (o *outbox) take(d *delivery) {
+	o.Lock()
+	o.sending[d.ID] = true
+	o.Unlock()
+}
+
+// untake marks d as no longer handed to a worker.
+func (o *outbox) untake(d *delivery) {
+	o.Lock()
+	delete(o.sending, d.ID)
+	o.Unlock()
+}
+
+// sent marks d as back from its worker and wakes the sender for the
+// deliveries that waited for one.
+func (o *outbox) sent(d *delivery) {
+	o.untake(d)
+	o.notify()
+}
+
+func (o *outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// emit queues ev for every webhook subscribed to its type.
+func (s *Server) emit(ev Event) {
+	if len(s.cfg.Webhooks) == 0 {
+		return
+	}
+	ev.ID = randomHexStr(16)
+	ev.Time = s.clock.Now().Unix()
+	body, err := json.Marshal(ev)
+	if err != nil {
+		s.log.Err("encode event", err, "event", ev.Type)
+		return
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for _, h := range s.cfg.Webhooks {
+		if !h.wants(ev.Type) {
+			continue
+		}
+		s.outbox.add(&delivery{ID: randomHexStr(16), Hook: h.ID, Type: ev.Type, Body: body, Next: now})
+	}
+	// the sender persists the deliveries before it hands them out
+	s.outbox.notify()
+}
+
+// fileEvent queues an event of typ about the file id described by item and
+// tells its owner.
+func (s *Server) fileEvent(typ, id string, item FileItem, reason string) {
+	ev := Event{
+		Type:       typ,
+		File:       id,
+		Size:       item.Length,
+		Expire:     item.Expire,
+		DownLimit:  item.DownLimit,
+		Relay:      item.Relay,
+		Request:    item.Request,
+		Collection: item.Parent,
+		Snippet:    item.snippet(),
+		Reason:     reason,
+	}
+	if typ == eventDownloaded {
+		ev.DownCount = item.DownCount
+	}
+	s.emit(ev)
+	switch typ {
+	case eventDownloaded:
+		s.notify(id, watchDownloadCompleted, item, item.Length, "")
+		if item.usedUp() {
+			s.notify(id, watchLimitReached, item, 0, "")
+		}
+	case eventExpired:
+		s.notify(id, watchExpired, item, 0, "")
+	case eventDeleted:
+		s.notify(id, watchDeleted, item, 0, reason)
+	}
+}
+
+// webhookSender hands the due deliveries of the outbox to webhookWorkers
+// workers. It never waits for a delivery, those left over while every
+// worker is busy go out as soon as one is free.
+func (s *Server) webhookSender() {
+	if len(s.cfg.Webhooks) == 0 {
+		return
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	queue := make(chan *delivery, webhookWorkers)
+	for i := 0; i < webhookWorkers; i++ {
+		go func() {
+			for {
+				select {
+				case <-s.done:
+					return
+				case d := <-queue:
+					s.deliver(client, d)
+					s.outbox.sent(d)
+				}
+			}
+		}()
+	}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.outbox.wake:
+		case <-timer.C:
+		}
+		s.log.Err("persist webhook deliveries", s.outbox.persist())
+		list, next := s.outbox.due(time.Now().UnixNano() / int64(time.Millisecond))
+	queueing:
+		for _, d := range list {
+			s.outbox.take(d)
+			select {
+			case queue <- d:
+			default:
+				// the next worker done wakes the sender again
+				s.outbox.untake(d)
+				break queueing
+			}
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if next > 0 {
+			timer.Reset(time.Until(time.Unix(0, next*int64(time.Millisecond))))
+		}
+	}
+}
+
+// deliver posts d once and removes it or schedules its next attempt.
+func (s *Server) deliver(client *http.Client, d *delivery) {
+	log := s.log.With("delivery", d.ID, "event", d.Type, "webhook", d.Hook)
+	hook, ok := s.webhook(d.Hook)
+	if !ok {
+		log.Warn("dropping webhook delivery, the webhook is no longer configured")
+		log.Err("remove webhook delivery", s.outbox.remove(d.ID))
+		return
+	}
+	log = log.With("url", hook.URL)
+	err := post(client, hook, d)
+	if err == nil {
+		log.Debug("webhook delivered", "attempt", d.Attempt+1)
+		s.metrics.add(&s.metrics.webhooksDelivered, 1)
+		log.Err("remove webhook delivery", s.outbox.remove(d.ID))
+		return
+	}
+	s.metrics.add(&s.metrics.webhooksFailed, 1)
+	retry := *d
+	retry.Attempt++
+	if retry.Attempt >= webhookAttempts {
+		log.Error("dropping webhook delivery", "err", err, "attempts", retry.Attempt)
+		log.Err("remove webhook delivery", s.outbox.remove(d.ID))
+		return
+	}
+	delay := webhookMaxDelay
+	if retry.Attempt < 20 && time.Second<<uint(retry.Attempt-1) < delay {
+		delay = time.Second << uint(retry.Attempt-1)
+	}
+	retry.Next = time.Now().Add(delay).UnixNano() / int64(time.Millisecond)
+	log.Warn("webhook delivery failed", "err", err, "attempt", retry.Attempt, "retry_in", delay)
+	log.Err("queue webhook delivery", s.outbox.put(&retry))
+}
+
+func (s *Server) webhook(id string) (Webhook, bool) {
+	for _, h := range s.cfg.Webhooks {
+		if h.ID == id {
+			return h, true
+		}
+	}
+	return Webhook{}, false
+}
+
+func post(client *http.Client, hook Webhook, d *delivery) error {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "send-webhook")
+	req.Header.Set("X-Send-Event", d.Type)
+	req.Header.Set("X-Send-Delivery", d.ID)
+	now := time.Now().Unix()
+	req.Header.Set("X-Send-Timestamp", strconv.FormatInt(now, 10))
+	req.Header.Set("X-Send-Signature", SignWebhook(hook.Secret, now, d.Body))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*kilobyte))
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver answered %s", strings.TrimSpace(resp.Status))
+	}
+	return nil
+}
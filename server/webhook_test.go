@@ -0,0 +1,171 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// receivedHook is a delivery as seen by a test receiver.
+type receivedHook struct {
+	header http.Header
+	body   []byte
+}
+
+// startReceiver runs a webhook receiver passing every delivery to the
+// returned channel. Deliveries to a blocked receiver wait until the test
+// ends.
+func startReceiver(t *testing.T, blocked bool) (string, <-chan receivedHook) {
+	t.Helper()
+	got := make(chan receivedHook, 16)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if blocked {
+			<-release
+		}
+		got <- receivedHook{r.Header, body}
+	}))
+	t.Cleanup(ts.Close)
+	t.Cleanup(func() { close(release) })
+	return ts.URL, got
+}
+
+func receive(t *testing.T, got <-chan receivedHook) receivedHook {
+	t.Helper()
+	select {
+	case h := <-got:
+		return h
+	case <-time.After(3 * time.Second):
+		t.Fatal("no webhook delivery")
+		return receivedHook{}
+	}
+}
+
+func TestWebhookSignsTimestampAndBody(t *testing.T) {
+	url, got := startReceiver(t, false)
+	s, _ := newTestServer(t, func(cfg *Config) {
+		cfg.Webhooks = []Webhook{{ID: "audit", URL: url, Secret: "secret"}}
+	})
+	id := addTestFile(t, s, []byte("ciphertext"), 1)
+	s.fileEvent(eventDeleted, id, *s.itemInfo(id), deletedByOwner)
+
+	h := receive(t, got)
+	ts, err := strconv.ParseInt(h.header.Get("X-Send-Timestamp"), 10, 64)
+	if err != nil {
+		t.Fatalf("timestamp header: %v", err)
+	}
+	if d := time.Since(time.Unix(ts, 0)); d < -time.Minute || d > time.Minute {
+		t.Fatalf("timestamp %d is %v off", ts, d)
+	}
+	if sig := h.header.Get("X-Send-Signature"); sig != SignWebhook("secret", ts, h.body) {
+		t.Fatalf("signature %q does not cover the timestamp and body", sig)
+	}
+	if sig := h.header.Get("X-Send-Signature"); sig == SignWebhook("secret", ts+1, h.body) {
+		t.Fatal("signature does not depend on the timestamp")
+	}
+	var ev Event
+	if err := json.Unmarshal(h.body, &ev); err != nil || ev.File != id || ev.Type != eventDeleted {
+		t.Fatalf("event %+v (%v), want %s of %s", ev, err, eventDeleted, id)
+	}
+}
+
+func TestSlowWebhookDoesNotHoldBackOthers(t *testing.T) {
+	slow, _ := startReceiver(t, true)
+	fast, got := startReceiver(t, false)
+	s, _ := newTestServer(t, func(cfg *Config) {
+		cfg.Webhooks = []Webhook{
+			{ID: "slow", URL: slow, Secret: "secret"},
+			{ID: "fast", URL: fast, Secret: "secret"},
+		}
+	})
+	for i := 0; i < 3; i++ {
+		id := addTestFile(t, s, []byte("ciphertext"), 1)
+		s.fileEvent(eventDeleted, id, *s.itemInfo(id), deletedByOwner)
+		var ev Event
+		if err := json.Unmarshal(receive(t, got).body, &ev); err != nil || ev.File != id {
+			t.Fatalf("event %d: got %+v (%v), want file %s", i, ev, err, id)
+		}
+	}
+}
+
+func TestWebhookDeliveriesFollowTheID(t *testing.T) {
+	url, got := startReceiver(t, false)
+	s, _ := newTestServer(t, func(cfg *Config) {
+		cfg.Webhooks = []Webhook{{ID: "audit", URL: url, Secret: "secret"}}
+	})
+	// queued while the webhook had another URL
+	d := &delivery{ID: randomHexStr(16), Hook: "audit", Type: eventExpired, Body: []byte(`{}`)}
+	if err := s.outbox.put(d); err != nil {
+		t.Fatal(err)
+	}
+	s.outbox.notify()
+	if h := receive(t, got); h.header.Get("X-Send-Delivery") != d.ID {
+		t.Fatalf("got delivery %s, want %s", h.header.Get("X-Send-Delivery"), d.ID)
+	}
+}
+
+func TestWebhookIDsAreRequiredAndUnique(t *testing.T) {
+	for _, hooks := range [][]Webhook{
+		{{URL: "https://hooks.test/a", Secret: "s"}},
+		{{ID: "a", URL: "https://hooks.test/a", Secret: "s"}, {ID: "a", URL: "https://hooks.test/b", Secret: "s"}},
+	} {
+		cfg := DefaultConfig()
+		cfg.ConfigDir = t.TempDir()
+		cfg.Storage.Driver = "memory"
+		cfg.LogOutput = ioutil.Discard
+		cfg.Webhooks = hooks
+		if s, err := New(*cfg); err == nil {
+			s.pool.Release()
+			t.Fatalf("webhooks %+v accepted", hooks)
+		}
+	}
+}
+
+func TestOutboxSurvivesReload(t *testing.T) {
+	dir := t.TempDir()
+	log := NewLogger(ioutil.Discard, "logfmt", LevelInfo)
+	o, err := newOutbox(dir, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &delivery{ID: "d1", Hook: "audit", Type: eventUploaded, Body: []byte(`{}`), Attempt: 2}
+	if err := o.put(d); err != nil {
+		t.Fatal(err)
+	}
+	o, err = newOutbox(dir, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := o.pending["d1"]; got == nil || got.Hook != "audit" || got.Attempt != 2 {
+		t.Fatalf("reloaded %+v", got)
+	}
+}
+
+func TestQueuedDeliveriesArePersistedBeforeSending(t *testing.T) {
+	dir := t.TempDir()
+	log := NewLogger(ioutil.Discard, "logfmt", LevelInfo)
+	o, err := newOutbox(dir, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.add(&delivery{ID: "d1", Hook: "audit", Type: eventDownloaded, Body: []byte(`{}`)})
+	if isExist(o.path("d1")) {
+		t.Fatal("add wrote the delivery")
+	}
+	if list, _ := o.due(1); len(list) != 0 {
+		t.Fatal("unsaved delivery handed out")
+	}
+	if err := o.persist(); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := o.due(1); len(list) != 1 {
+		t.Fatalf("%d deliveries due after persist, want 1", len(list))
+	}
+	if o, err = newOutbox(dir, log); err != nil || o.pending["d1"] == nil {
+		t.Fatalf("persisted delivery not reloaded: %v", err)
+	}
+}
@@ -1,30 +1,28 @@
-package main
+package server
 
 import (
 	"crypto/rand"
 	"encoding/hex"
-	"fmt"
 	"github.com/gorilla/websocket"
-	"os"
-	"strings"
-	"sync/atomic"
 	"time"
 )
 
-var fileMap = NewCMap()
-
 const (
-	b           = 1
-	kilobyte    = 1024 * b
-	megabyte    = 1024 * kilobyte
-	gigabyte    = 1024 * megabyte
-	uploadLimit = 10 * gigabyte
+	b        = 1
+	kilobyte = 1024 * b
+	megabyte = 1024 * kilobyte
+	gigabyte = 1024 * megabyte
 )
 
 type wsClient struct {
+	srv *Server
+	// ip is the client address uploads are charged to.
+	ip      string
 	init    bool
 	conn    *websocket.Conn
 	channel *chanSet
+	// log names the request that opened the connection.
+	log *Logger
 }
 
 type chanSet struct {
@@ -34,7 +32,8 @@ type chanSet struct {
 	file  wsData
 }
 
-type fileItem struct {
+// FileItem is the metadata of an uploaded file.
+type FileItem struct {
 	Pwd       bool   `json:"pwd"`
 	Nonce     []byte `json:"nonce"`
 	Auth      string `json:"auth"`
@@ -44,12 +43,33 @@ type fileItem struct {
 	DownLimit int    `json:"down_limit"`
 	DownCount int    `json:"down_count"`
 	Length    int64  `json:"length"`
+	// Relay files are streamed from a connected sender, nothing is stored.
+	Relay bool `json:"relay,omitempty"`
+	// Request is the file request the file was uploaded to, Sealed its key
+	// encrypted to the public key of the request.
+	Request string `json:"request,omitempty"`
+	Sealed  string `json:"sealed,omitempty"`
+	// Collection files have no content of their own: Items lists the files
+	// uploaded into one, their Parent, and Meta is the manifest of them.
+	Collection bool     `json:"collection,omitempty"`
+	Items      []string `json:"items,omitempty"`
+	Parent     string   `json:"parent,omitempty"`
+	// Inline is the content of a snippet, which has no blob.
+	Inline []byte `json:"inline,omitempty"`
 }
 
 type initResponse struct {
 	ID         string `json:"id"`
 	OwnerToken string `json:"ownerToken"`
 	URL        string `json:"url"`
+	// Session resumes the upload after a dropped connection, Offset is the
+	// number of bytes the server already has.
+	Session string `json:"session"`
+	Offset  int64  `json:"offset"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
 }
 
 type wsData struct {
@@ -58,6 +78,21 @@ type wsData struct {
 	FileMetadata  string `json:"fileMetadata"`
 	TimeLimit     int    `json:"timeLimit"`
 	HasPassword   bool   `json:"has_password"`
+	// Session is set instead of the fields above to resume an upload.
+	Session string `json:"session"`
+	// Relay streams the upload to a receiver instead of storing it.
+	Relay bool `json:"relay"`
+	// Size is the expected length of the encrypted upload, disk space for
+	// it is reserved up front. 0 if unknown.
+	Size int64 `json:"size"`
+	// Request uploads into a file request instead, the key of the file
+	// goes along in Sealed.
+	Request string `json:"request"`
+	Sealed  string `json:"sealed"`
+	// Collection adds the upload to a collection, whose owner token has to
+	// come along in OwnerToken.
+	Collection string `json:"collection"`
+	OwnerToken string `json:"owner_token"`
 }
 
 var (
@@ -65,37 +100,38 @@ var (
 	pongWait   = 60 * time.Second
 	pingPeriod = (pongWait * 9) / 10
 
-	maxMessageSize = int64(10 * megabyte)
-	newline        = []byte{'\n'}
+	newline = []byte{'\n'}
 	//space          = []byte{' '}
 )
 
-func wsHandler(conn *websocket.Conn) {
-	client := newClient(conn)
-	taskSubmit(client.readPump)
-	taskSubmit(client.writePump)
+func (s *Server) wsHandler(conn *websocket.Conn, ip string, log *Logger) {
+	client := newClient(s, conn, ip, log)
+	s.submit(client.readPump)
+	s.submit(client.writePump)
 }
 
-func newClient(conn *websocket.Conn) *wsClient {
+func newClient(srv *Server, conn *websocket.Conn, ip string, log *Logger) *wsClient {
 	channel := &chanSet{
 		close: make(chan struct{}, 6),
 		write: make(chan []byte, 16),
 		read:  make(chan []byte, 16),
 	}
-	return &wsClient{false, conn, channel}
+	return &wsClient{srv, ip, false, conn, channel, log}
 }
 
 func (c *wsClient) pongHandler(string) error {
 	err := c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	errLogger("wsClient.SetReadDeadline()", err)
+	c.log.Err("ws set read deadline", err)
 	return nil
 }
 
 func (c *wsClient) readPump() {
+	c.srv.metrics.add(&c.srv.metrics.wsConns, 1)
 	defer func() {
+		c.srv.metrics.add(&c.srv.metrics.wsConns, -1)
 		c.channel.close <- struct{}{}
 	}()
-	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadLimit(c.srv.cfg.Limits.MaxMessageSize)
 	c.conn.SetPongHandler(c.pongHandler)
 	for {
 		_, message, err := c.conn.ReadMessage()
@@ -114,35 +150,86 @@ func (c *wsClient) readPump() {
 			if err := json.Unmarshal(message, &meta); err != nil {
 				break
 			}
-			fileID := randomHexStr(16)
-			if meta.TimeLimit > 604800 {
-				meta.TimeLimit = 0
+			if !c.srv.uploads.begin() {
+				break
+			}
+			if meta.Relay && meta.Session == "" {
+				if !c.startRelay(meta) {
+					c.srv.uploads.done()
+					break
+				}
+				if c.srv.cfg.Limits.MaxMessageSize > relayMessageSize {
+					c.conn.SetReadLimit(relayMessageSize)
+				}
+				c.init = true
+				continue
 			}
-			if meta.Down > 300 {
-				meta.Down = 0
+			var resp []byte
+			var session *uploadSession
+			var gen int
+			var err error
+			if meta.Session != "" {
+				resp, session, gen, err = c.srv.resumeUpload(meta.Session)
+			} else {
+				resp, session, gen, err = c.srv.startUpload(meta, c.ip, c.log)
 			}
-			res := fileItem{
-				Pwd:       meta.HasPassword,
-				Auth:      strings.Split(meta.Authorization, " ")[1],
-				Meta:      meta.FileMetadata,
-				Token:     randomHexStr(20),
-				Nonce:     randomByte(16),
-				Expire:    time.Now().Add(time.Duration(meta.TimeLimit) * time.Second).Unix(),
-				DownLimit: meta.Down,
+			if err != nil {
+				c.log.Warn("upload refused", "err", err)
+				c.channel.write <- c.srv.respBuilder(errorResponse{Error: err.Error()})
+				c.srv.uploads.done()
+				break
 			}
-			resp, _ := json.Marshal(initResponse{
-				ID:         fileID,
-				OwnerToken: res.Token,
-				URL:        fmt.Sprintf("https://neko.nz/download/%s", fileID),
-			})
-			fileMap.Set(fileID, res)
 			c.init = true
 			c.channel.write <- resp
-			taskSubmit(func() { wsUploadHandler(c, fileID) })
+			log := c.log.With("file", session.id)
+			if meta.Session != "" {
+				offset, _ := session.progress()
+				log.Info("upload resumed", "bytes", offset)
+			}
+			if err := c.srv.pool.Submit(func() { c.uploadHandler(session, gen, log) }); err != nil {
+				log.Err("submit upload handler", err)
+				session.detach(gen)
+				c.srv.uploads.done()
+				break
+			}
 		}
 	}
 }
 
+// startUpload registers a new file described by meta and attaches to its session.
+func (s *Server) startUpload(meta wsData, ip string, log *Logger) ([]byte, *uploadSession, int, error) {
+	session, init, err := s.createUpload(meta, 0, ip, log)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	gen, _, err := session.attach()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	resp, _ := json.Marshal(init)
+	return resp, session, gen, nil
+}
+
+// resumeUpload reattaches to the unfinished upload identified by token.
+func (s *Server) resumeUpload(token string) ([]byte, *uploadSession, int, error) {
+	session, ok := s.getSession(token)
+	if !ok {
+		return nil, nil, 0, errUploadGone
+	}
+	res := s.itemInfo(session.id)
+	if res == nil {
+		return nil, nil, 0, errUploadGone
+	}
+	gen, offset, err := session.attach()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	init := s.uploadInit(session, res)
+	init.Offset = offset
+	resp, _ := json.Marshal(init)
+	return resp, session, gen, nil
+}
+
 func (c *wsClient) writePump() {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
@@ -156,7 +243,7 @@ func (c *wsClient) writePump() {
 			return
 		case message, ok := <-c.channel.write:
 			err := c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			errLogger("wsClient.conn.SetWriteDeadline()", err)
+			c.log.Err("ws set write deadline", err)
 			if !ok {
 				// channel closed.
 				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
@@ -165,18 +252,18 @@ func (c *wsClient) writePump() {
 
 			w, err := c.conn.NextWriter(websocket.TextMessage)
 			if err != nil {
-				errLogger("wsClient.conn.NextWriter()", err)
+				c.log.Err("ws next writer", err)
 				return
 			}
 			_, err = w.Write(message)
-			errLogger("wsClient.conn.Write()", err)
+			c.log.Err("ws write", err)
 
 			n := len(c.channel.write)
 			for i := 0; i < n; i++ {
 				_, err := w.Write(newline)
-				errLogger("wsClient.conn.Write(newline)", err)
+				c.log.Err("ws write", err)
 				_, err = w.Write(<-c.channel.write)
-				errLogger("wsClient.conn.Write(msg)", err)
+				c.log.Err("ws write", err)
 			}
 
 			if err := w.Close(); err != nil {
@@ -184,7 +271,7 @@ func (c *wsClient) writePump() {
 			}
 		case <-ticker.C:
 			err := c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			errLogger("wsClient.conn.SetWriteDeadline()", err)
+			c.log.Err("ws set write deadline", err)
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
@@ -192,55 +279,46 @@ func (c *wsClient) writePump() {
 	}
 }
 
-func wsUploadHandler(c *wsClient, id string) {
+func (c *wsClient) uploadHandler(s *uploadSession, gen int, log *Logger) {
 	defer func() {
 		c.channel.close <- struct{}{}
-	}()
-	path := "data/"
-	if !isExist(path) {
-		err := os.MkdirAll(path, 00666)
-		if err != nil {
-			errLogger("ws.mkdir()", err)
-			return
-		}
-	}
-	filePath := path + id + ".bin"
-	file, err := os.Create(filePath)
-	sizeCounter := int64(0)
-	if err != nil {
-		errLogger("initHandler.file.Create()", err)
-		return
-	}
-	defer func() {
-		_ = file.Close()
+		c.srv.uploads.done()
 	}()
 	for {
-		var n int
 		select {
 		case <-c.channel.close:
-			_ = file.Close()
-			_ = os.Remove(filePath)
+			// keep the partial upload around for the client to resume
+			s.detach(gen)
+			offset, _ := s.progress()
+			log.Info("upload detached", "bytes", offset)
+			return
+		case <-c.srv.abortUploads:
+			log.Warn("upload aborted", "err", "server is shutting down")
+			s.abort()
 			return
 		case msg, ok := <-c.channel.read:
 			if !ok {
+				s.detach(gen)
 				return
 			}
 			if msg[0] == 0 && len(msg) == 1 {
 				// Upload Finished
-				c.channel.write <- []byte("{\"ok\": true}")
-				if res, ok := fileMap.Get(id); ok {
-					val := res.(fileItem)
-					val.Length = sizeCounter
-					fileMap.Set(id, res)
+				if err := s.finish(gen); err != nil {
+					log.Err("upload finish", err)
+					return
 				}
+				offset, _ := s.progress()
+				log.Info("upload finished", "bytes", offset)
+				c.channel.write <- []byte("{\"ok\": true}")
 				return
-			} else {
-				n, _ = file.Write(msg)
 			}
-			atomic.AddInt64(&sizeCounter, int64(n))
-			if sizeCounter > uploadLimit {
-				_ = file.Close()
-				_ = os.Remove(filePath)
+			if err := s.write(gen, msg); err != nil {
+				if err != errStaleSession {
+					offset, _ := s.progress()
+					log.Warn("upload aborted", "err", err, "bytes", offset)
+					c.channel.write <- c.srv.respBuilder(errorResponse{Error: err.Error()})
+					s.abort()
+				}
 				return
 			}
 		}